@@ -3,7 +3,9 @@
 
 // ApplicationType encode the application type. This type is used by the server
 // to dispatch incoming packet to the correct application. This type is encoded in the
-// packet sent by the nodes.
+// packet sent by the nodes. The experiment specific applications register their
+// own type on the server (see server/applications/registry.go), from AppTypeAll
+// to 255.
 enum ApplicationType { 
     AppTypeGraph,
     AppTypeTopology,
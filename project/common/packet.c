@@ -56,6 +56,11 @@ uint8_t decode_sequence_number(Header header) {
     return header & SEQUENCE_NUMBER_MASK;
 }
 
+int sequence_number_less(uint8_t s1, uint8_t s2) {
+    uint8_t distance = (s2 - s1 + SEQUENCE_NUMBER_SPACE) % SEQUENCE_NUMBER_SPACE;
+    return distance != 0 && distance < SEQUENCE_NUMBER_SPACE / 2;
+}
+
 // RemoveHeaderFromPacket remove the header that contains a PacketType and a SequenceNumber
 // The header is a byte that has the following structure:
 // 0b01 000111
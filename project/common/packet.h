@@ -7,6 +7,7 @@
 #include "contiki.h"
 
 #define SEQUENCE_NUMBER_MAX 0b00111111
+#define SEQUENCE_NUMBER_SPACE (SEQUENCE_NUMBER_MAX + 1)
 
 typedef uint8_t Header;
 
@@ -33,6 +34,12 @@ int encode_sequence_number(Header* header, uint8_t sequence_number);
 
 uint8_t decode_sequence_number(Header header);
 
+// sequence_number_less returns 1 if `s1` comes before `s2` in the sequence number
+// space (serial number arithmetic as defined in RFC 1982), 0 otherwise.
+// Sequence numbers wrap around after SEQUENCE_NUMBER_MAX so they must never be
+// compared with `<` or `>`.
+int sequence_number_less(uint8_t s1, uint8_t s2);
+
 // RemoveHeaderFromPacket remove the header that contains a PacketType and a SequenceNumber
 // The header is a byte that has the following structure:
 // 0b01 0000111
@@ -11,6 +11,7 @@
 
 uint16_t schedule_updater_pkt_size_needed(struct schedule_updater_pkt *pkt) {
     return sizeof(pkt->type) 
+           + sizeof(pkt->epoch)
            + sizeof(pkt->neighbor_addr)
            + sizeof(pkt->cell_count)
            + sizeof(uint8_t) * pkt->cell_count
@@ -20,6 +21,7 @@ uint16_t schedule_updater_pkt_size_needed(struct schedule_updater_pkt *pkt) {
 
 void schedule_updater_pkt_encode(uint8_t *dest, struct schedule_updater_pkt *pkt) {
     dest[UPDATE_PKT_TYPE_OFFSET] = pkt->type;
+    memcpy(&dest[UPDATE_PKT_EPOCH_OFFSET], &pkt->epoch, sizeof(pkt->epoch));
     memcpy(&dest[UPDATE_PKT_NEIGHBOR_ADDR_OFFSET], &pkt->neighbor_addr, 8);
     dest[UPDATE_PKT_CELLS_COUNT_OFFSET] = pkt->cell_count;
     int index = UPDATE_PKT_CELL_START(0);
@@ -37,6 +39,12 @@ enum schedule_updater_pkt_type update_pkt_type(const uint8_t *pkt_raw) {
     return pkt_raw[UPDATE_PKT_TYPE_OFFSET];
 }
 
+uint16_t update_pkt_epoch(const uint8_t *pkt_raw) {
+    uint16_t epoch;
+    memcpy(&epoch, pkt_raw + UPDATE_PKT_EPOCH_OFFSET, sizeof(epoch));
+    return epoch;
+}
+
 linkaddr_t update_pkt_neighbor_addr(const uint8_t *pkt_raw) {
     linkaddr_t neighbor_addr;
     memcpy(&neighbor_addr, &pkt_raw[UPDATE_PKT_NEIGHBOR_ADDR_OFFSET], sizeof(neighbor_addr));
@@ -64,8 +72,28 @@ uint16_t update_pkt_cell_channel(const uint8_t *pkt_raw, uint8_t cell_number) {
     return channel;
 }
 
-void update_pkt_add_cells(const uint8_t *pkt, struct tsch_slotframe *sf) {
+static uint16_t header_pkt_uint16(const uint8_t *pkt_raw, uint8_t offset) {
+    uint16_t value;
+    memcpy(&value, pkt_raw + offset, sizeof(value));
+    return value;
+}
+
+struct slotframe_geometry header_pkt_geometry(const uint8_t *pkt_raw) {
+    struct slotframe_geometry geometry;
+    geometry.handle = header_pkt_uint16(pkt_raw, HEADER_PKT_HANDLE_OFFSET);
+    geometry.length = header_pkt_uint16(pkt_raw, HEADER_PKT_LENGTH_OFFSET);
+    geometry.first_channel = header_pkt_uint16(pkt_raw, HEADER_PKT_FIRST_CHANNEL_OFFSET);
+    geometry.last_channel = header_pkt_uint16(pkt_raw, HEADER_PKT_LAST_CHANNEL_OFFSET);
+    return geometry;
+}
+
+bool header_pkt_incremental(const uint8_t *pkt_raw) {
+    return (pkt_raw[HEADER_PKT_FLAGS_OFFSET] & HEADER_PKT_FLAG_INCREMENTAL) != 0;
+}
+
+uint8_t update_pkt_add_cells(const uint8_t *pkt, struct tsch_slotframe *sf, const struct slotframe_geometry *geometry) {
     uint8_t cell_count = update_pkt_cells_count(pkt);
+    uint8_t failed_cells = 0;
     
     uint8_t i;
     for (i = 0; i < cell_count; i++) {
@@ -73,59 +101,224 @@ void update_pkt_add_cells(const uint8_t *pkt, struct tsch_slotframe *sf) {
         uint16_t timeslot = update_pkt_cell_timeslot(pkt, i);
         uint16_t channel = update_pkt_cell_channel(pkt, i);
         linkaddr_t neighbor_addr = update_pkt_neighbor_addr(pkt);
+        if (timeslot >= geometry->length
+                || channel < geometry->first_channel || channel > geometry->last_channel) {
+            LOG_ERR("The cell (%u, %u) is outside the slotframe geometry\n", timeslot, channel);
+            failed_cells++;
+            continue;
+        }
         struct tsch_link *err = tsch_schedule_add_link(sf, link_options, LINK_TYPE_NORMAL, 
                 &neighbor_addr, timeslot, channel, 1);
         if (err == NULL) {
             LOG_ERR("Error while adding a new link, tsch_schedule_add_link\n");
+            failed_cells++;
+        }
+    }
+    return failed_cells;
+}
+
+void update_pkt_remove_cells(const uint8_t *pkt, struct tsch_slotframe *sf) {
+    uint8_t cell_count = update_pkt_cells_count(pkt);
+
+    uint8_t i;
+    for (i = 0; i < cell_count; i++) {
+        uint16_t timeslot = update_pkt_cell_timeslot(pkt, i);
+        uint16_t channel = update_pkt_cell_channel(pkt, i);
+        if (!tsch_schedule_remove_link_by_timeslot(sf, timeslot, channel)) {
+            LOG_ERR("Error while removing a link, tsch_schedule_remove_link_by_timeslot\n");
+        }
+    }
+}
+
+/* Copies the links of the installed slotframe into the new one */
+static void copy_slotframe_links(struct tsch_slotframe *from, struct tsch_slotframe *to) {
+    struct tsch_link *l;
+    for (l = list_head(from->links_list); l != NULL; l = list_item_next(l)) {
+        if (tsch_schedule_add_link(to, l->link_options, l->link_type, &l->addr,
+                    l->timeslot, l->channel_offset, 1) == NULL) {
+            LOG_ERR("Error while copying a link, tsch_schedule_add_link\n");
         }
     }
 }
 
-static uint16_t other_slotframe_handle(uint16_t current_slotframe_handle) {
-    /* if current_slotframe_handle == 1 then 2 else 1 */
-    return (current_slotframe_handle % 2) + 1;
+static uint16_t other_slotframe_handle(const struct slotframe_geometry *geometry, uint16_t current_slotframe_handle) {
+    /* if current_slotframe_handle == handle then handle + 1 else handle */
+    if (current_slotframe_handle == geometry->handle) {
+        return geometry->handle + 1;
+    }
+    return geometry->handle;
+}
+
+static struct slotframe_geometry geometry = {
+    SCHEDULE_UPDATER_SLOTFRAME_HANDLE,
+    SCHEDULE_UPDATER_SLOTFRAME_SIZE,
+    SCHEDULE_UPDATER_FIRST_CHANNEL,
+    SCHEDULE_UPDATER_LAST_CHANNEL,
+};
+static uint16_t slotframe_handle = SCHEDULE_UPDATER_SLOTFRAME_HANDLE;
+/* 0 is the handle of the 6TiSCH minimal slotframe: no schedule installed yet */
+static uint16_t installed_handle = 0;
+static bool incremental = false;
+static bool in_update = false;
+static struct tsch_slotframe* slotframe = NULL;
+/* The server increments the epoch at each update, 0 means no update received yet */
+static uint16_t update_epoch = 0;
+static uint16_t installed_epoch = 0;
+
+uint16_t schedule_updater_update_epoch(void) {
+    return update_epoch;
+}
+
+uint16_t schedule_updater_installed_epoch(void) {
+    return installed_epoch;
+}
+
+/* The epochs wrap around, `a` is older than `b` when it is less than half of
+   the epoch space behind `b` */
+static bool epoch_older(uint16_t a, uint16_t b) {
+    return (int16_t)(a - b) < 0;
 }
 
-void update_pkt_dispatch(const uint8_t *pkt) {
+/* The first packet of an update creates the new slotframe, a copy of the
+   installed one for an incremental update */
+static struct tsch_slotframe* update_slotframe(void) {
+    if (in_update) {
+        return slotframe;
+    }
+    in_update = true;
+    slotframe = tsch_schedule_add_slotframe(slotframe_handle, geometry.length);
+    if (slotframe != NULL && incremental && installed_handle != 0) {
+        struct tsch_slotframe* installed = tsch_schedule_get_slotframe_by_handle(installed_handle);
+        if (installed != NULL) {
+            copy_slotframe_links(installed, slotframe);
+        }
+    }
+    return slotframe;
+}
+
+/* The slotframe of an unfinished update is removed, the installed one stays in use */
+static void drop_update_slotframe(void) {
+    if (in_update && slotframe != NULL) {
+        tsch_schedule_remove_slotframe(slotframe);
+    }
+    in_update = false;
+    slotframe = NULL;
+}
+
+enum schedule_updater_decline_reason update_pkt_dispatch(const uint8_t *pkt, uint8_t *failed_cells) {
     update_pkt_log_type(pkt);
-    static uint16_t slotframe_handle = 1;
-    static bool in_update = false;
-    static struct tsch_slotframe* slotframe = NULL;
-    uint16_t other_handle;
+    struct tsch_slotframe* old_slotframe;
+    linkaddr_t neighbor_addr;
+    uint16_t epoch = update_pkt_epoch(pkt);
+    *failed_cells = 0;
+    /* A delayed packet of an earlier update must not modify the slotframe of
+       the update in progress */
     switch (update_pkt_type(pkt)) {
+        case schedule_updater_pkt_type_header:
+            if (update_epoch != 0 && epoch_older(epoch, update_epoch)) {
+                LOG_WARN("Header of the epoch %u while the epoch %u started\n", epoch, update_epoch);
+                return schedule_updater_decline_stale_epoch;
+            }
+            break;
+        case schedule_updater_pkt_type_epoch_query:
+            break;
+        default:
+            if (epoch != update_epoch) {
+                LOG_WARN("Packet of the epoch %u during the epoch %u\n", epoch, update_epoch);
+                *failed_cells = update_pkt_type(pkt) == schedule_updater_pkt_type_update ? update_pkt_cells_count(pkt) : 0;
+                return schedule_updater_decline_stale_epoch;
+            }
+            break;
+    }
+    switch (update_pkt_type(pkt)) {
+        case schedule_updater_pkt_type_header:
+            /* A new update starts, the slotframe of an unfinished update is dropped */
+            drop_update_slotframe();
+            update_epoch = epoch;
+            geometry = header_pkt_geometry(pkt);
+            incremental = header_pkt_incremental(pkt);
+            slotframe_handle = other_slotframe_handle(&geometry, installed_handle);
+            break;
         case schedule_updater_pkt_type_update:
-            if (!in_update) {
-                slotframe = tsch_schedule_add_slotframe(slotframe_handle, 21);
-                in_update = true;
+            neighbor_addr = update_pkt_neighbor_addr(pkt);
+            if (uip_ds6_nbr_ll_lookup((const uip_lladdr_t *) &neighbor_addr) == NULL) {
+                LOG_ERR("The neighbor of the cells is unknown\n");
+                *failed_cells = update_pkt_cells_count(pkt);
+                return schedule_updater_decline_unknown_neighbor;
             }
-            if (slotframe == NULL) {
+            if (update_slotframe() == NULL) {
                 LOG_ERR("The TSCH slotframe is NULL\n");
-                return;
+                *failed_cells = update_pkt_cells_count(pkt);
+                return schedule_updater_decline_slotframe_busy;
             }
-            update_pkt_add_cells(pkt, slotframe);
+            *failed_cells = update_pkt_add_cells(pkt, slotframe, &geometry);
+            if (*failed_cells > 0) {
+                return schedule_updater_decline_link_memory;
+            }
+            break;
+        case schedule_updater_pkt_type_remove:
+            if (update_slotframe() == NULL) {
+                LOG_ERR("The TSCH slotframe is NULL\n");
+                return schedule_updater_decline_slotframe_busy;
+            }
+            update_pkt_remove_cells(pkt, slotframe);
             break;
         case schedule_updater_pkt_type_update_complete:
-            other_handle = other_slotframe_handle(slotframe_handle);
-            struct tsch_slotframe* old_slotframe = tsch_schedule_get_slotframe_by_handle(other_handle);
-            if (old_slotframe == NULL) {
-                return;
+            /* An update without cells (a node without links) has no slotframe
+               yet: it is created here, otherwise the installed handle would
+               point to a slotframe that does not exist */
+            if (update_slotframe() == NULL) {
+                LOG_ERR("The TSCH slotframe is NULL\n");
+                return schedule_updater_decline_slotframe_busy;
+            }
+            /* There is no old slotframe to remove for the first update, the
+               handles must still be swapped so the next update is built in a
+               new slotframe instead of the one currently in use. */
+            old_slotframe = tsch_schedule_get_slotframe_by_handle(installed_handle);
+            if (installed_handle != 0 && installed_handle != slotframe_handle && old_slotframe != NULL) {
+                tsch_schedule_remove_slotframe(old_slotframe);
             }
-            tsch_schedule_remove_slotframe(old_slotframe);
-            slotframe_handle = other_handle;
+            installed_handle = slotframe_handle;
+            slotframe_handle = other_slotframe_handle(&geometry, installed_handle);
             in_update = false;
+            installed_epoch = epoch;
+            break;
+        case schedule_updater_pkt_type_abort:
+            drop_update_slotframe();
+            slotframe_handle = other_slotframe_handle(&geometry, installed_handle);
+            break;
+        case schedule_updater_pkt_type_epoch_query:
             break;
     }
+    return schedule_updater_decline_none;
 }
 
 void update_pkt_log(const uint8_t *pkt) {
     LOG_INFO("schedule_updater_pkt log:\n");
     LOG_INFO("  pkt->type_num = %d\n", update_pkt_type(pkt));
+    LOG_INFO("  pkt->epoch = %u\n", update_pkt_epoch(pkt));
     switch (update_pkt_type(pkt)) {
+        case schedule_updater_pkt_type_header:
+            LOG_INFO("  pkt->type = header\n");
+            struct slotframe_geometry header_geometry = header_pkt_geometry(pkt);
+            LOG_INFO("  pkt->handle = %u\n", header_geometry.handle);
+            LOG_INFO("  pkt->length = %u\n", header_geometry.length);
+            LOG_INFO("  pkt->channels = %u to %u\n", header_geometry.first_channel, header_geometry.last_channel);
+            LOG_INFO("  pkt->incremental = %d\n", header_pkt_incremental(pkt));
+            break;
         case schedule_updater_pkt_type_update_complete:
             LOG_INFO("  pkt->type = complete\n");
             break;
+        case schedule_updater_pkt_type_abort:
+            LOG_INFO("  pkt->type = abort\n");
+            break;
+        case schedule_updater_pkt_type_epoch_query:
+            LOG_INFO("  pkt->type = epoch query\n");
+            break;
         case schedule_updater_pkt_type_update:
-            LOG_INFO("  pkt->type = update\n");
+        case schedule_updater_pkt_type_remove:
+            LOG_INFO("  pkt->type = %s\n",
+                    update_pkt_type(pkt) == schedule_updater_pkt_type_update ? "update" : "remove");
             LOG_INFO("  pkt->neighbor_addr = ");
             linkaddr_t neighbor_addr = update_pkt_neighbor_addr(pkt);
             LOG_INFO_LLADDR(&neighbor_addr);
@@ -145,11 +338,23 @@ void update_pkt_log(const uint8_t *pkt) {
 
 void update_pkt_log_type(const uint8_t *pkt) {
     switch (update_pkt_type(pkt)) {
+        case schedule_updater_pkt_type_header:
+            LOG_WARN("pkt->type = header\n");
+            break;
         case schedule_updater_pkt_type_update_complete:
             LOG_WARN("pkt->type = complete\n");
             break;
         case schedule_updater_pkt_type_update:
             LOG_WARN("pkt->type = update\n");
             break;
+        case schedule_updater_pkt_type_remove:
+            LOG_WARN("pkt->type = remove\n");
+            break;
+        case schedule_updater_pkt_type_abort:
+            LOG_WARN("pkt->type = abort\n");
+            break;
+        case schedule_updater_pkt_type_epoch_query:
+            LOG_WARN("pkt->type = epoch query\n");
+            break;
     }
 }
@@ -6,20 +6,63 @@
 #include "net/mac/tsch/tsch.h"
 #include "net/mac/tsch/tsch-schedule.h"
 
-#define SCHEDULE_UPDATER_SLOTFRAME_HANDLE 2
-#define SCHEDULE_UPDATER_SLOTFRAME_SIZE 7
+/* Geometry of the slotframe used until a schedule header is received. The node
+   alternates between the handles SCHEDULE_UPDATER_SLOTFRAME_HANDLE and
+   SCHEDULE_UPDATER_SLOTFRAME_HANDLE + 1. */
+#define SCHEDULE_UPDATER_SLOTFRAME_HANDLE 1
+#define SCHEDULE_UPDATER_SLOTFRAME_SIZE 21
+#define SCHEDULE_UPDATER_FIRST_CHANNEL 1
+#define SCHEDULE_UPDATER_LAST_CHANNEL 3
 
 #define SCHEDULE_UPDATER_MAX_CELLS 20
 
+/* Every packet starts with its type and the epoch of the update it belongs to */
 #define UPDATE_PKT_TYPE_OFFSET 0
-#define UPDATE_PKT_NEIGHBOR_ADDR_OFFSET 1
-#define UPDATE_PKT_CELLS_COUNT_OFFSET 1 + sizeof(linkaddr_t)
+#define UPDATE_PKT_EPOCH_OFFSET 1
+#define UPDATE_PKT_NEIGHBOR_ADDR_OFFSET 3
+#define UPDATE_PKT_CELLS_COUNT_OFFSET 3 + sizeof(linkaddr_t)
 #define CELL_SIZE (sizeof(uint8_t) + 2 * sizeof(uint16_t))
 #define UPDATE_PKT_CELL_START(cell_number) UPDATE_PKT_CELLS_COUNT_OFFSET + 1 + cell_number * CELL_SIZE
 
+#define HEADER_PKT_HANDLE_OFFSET 3
+#define HEADER_PKT_LENGTH_OFFSET 5
+#define HEADER_PKT_FIRST_CHANNEL_OFFSET 7
+#define HEADER_PKT_LAST_CHANNEL_OFFSET 9
+#define HEADER_PKT_FLAGS_OFFSET 11
+
+/* The new slotframe starts as a copy of the installed one, the update only
+   contains the cells to add and to remove */
+#define HEADER_PKT_FLAG_INCREMENTAL 1
+
 enum schedule_updater_pkt_type {
     schedule_updater_pkt_type_update,
     schedule_updater_pkt_type_update_complete,
+    schedule_updater_pkt_type_header,
+    schedule_updater_pkt_type_remove,
+    /* The update in progress is cancelled, the installed slotframe is kept */
+    schedule_updater_pkt_type_abort,
+    /* Only acknowledged, the ACK carries the epochs of the node */
+    schedule_updater_pkt_type_epoch_query,
+};
+
+/* Reason sent in the ACK of an update packet the node could not apply */
+enum schedule_updater_decline_reason {
+    schedule_updater_decline_none,
+    /* tsch_schedule_add_link failed, the node has no link memory left */
+    schedule_updater_decline_link_memory,
+    /* The neighbor of the cells is not in the neighbor table of the node */
+    schedule_updater_decline_unknown_neighbor,
+    /* The new slotframe could not be created */
+    schedule_updater_decline_slotframe_busy,
+    /* The packet belongs to another update than the one in progress */
+    schedule_updater_decline_stale_epoch,
+};
+
+struct slotframe_geometry {
+    uint16_t handle;
+    uint16_t length;
+    uint16_t first_channel;
+    uint16_t last_channel;
 };
 
 struct cell {
@@ -30,6 +73,7 @@ struct cell {
 
 struct schedule_updater_pkt {
     enum schedule_updater_pkt_type type;
+    uint16_t epoch;
     linkaddr_t neighbor_addr;
     uint8_t cell_count;
     struct cell cells[SCHEDULE_UPDATER_MAX_CELLS];
@@ -41,6 +85,8 @@ void schedule_updater_pkt_encode(uint8_t *dest, struct schedule_updater_pkt *pkt
 
 enum schedule_updater_pkt_type update_pkt_type(const uint8_t *pkt_raw);
 
+uint16_t update_pkt_epoch(const uint8_t *pkt_raw);
+
 linkaddr_t update_pkt_neighbor_addr(const uint8_t *pkt_raw);
 
 uint8_t update_pkt_cells_count(const uint8_t *pkt_raw);
@@ -51,9 +97,24 @@ uint16_t update_pkt_cell_timeslot(const uint8_t *pkt_raw, uint8_t cell_number);
 
 uint16_t update_pkt_cell_channel(const uint8_t *pkt_raw, uint8_t cell_number);
 
-void update_pkt_add_cells(const uint8_t *pkt_raw, struct tsch_slotframe *sf);
+struct slotframe_geometry header_pkt_geometry(const uint8_t *pkt_raw);
+
+bool header_pkt_incremental(const uint8_t *pkt_raw);
+
+uint8_t update_pkt_add_cells(const uint8_t *pkt_raw, struct tsch_slotframe *sf, const struct slotframe_geometry *geometry);
+
+void update_pkt_remove_cells(const uint8_t *pkt_raw, struct tsch_slotframe *sf);
+
+/* Applies the update packet, returns schedule_updater_decline_none or the reason
+   why the packet was declined. `failed_cells` is set to the number of cells that
+   could not be installed. */
+enum schedule_updater_decline_reason update_pkt_dispatch(const uint8_t *pkt, uint8_t *failed_cells);
+
+/* Epoch of the update in progress, or of the last one, 0 before the first update */
+uint16_t schedule_updater_update_epoch(void);
 
-void update_pkt_dispatch(const uint8_t *pkt);
+/* Epoch of the installed schedule, 0 before the first update */
+uint16_t schedule_updater_installed_epoch(void);
 
 void update_pkt_log(const uint8_t *pkt);
 
@@ -30,7 +30,46 @@ static struct simple_udp_connection udp_conn;
 PROCESS(udpack_process, "UDP Ack Process");
 /*---------------------------------------------------------------------------*/
 
-static uint16_t highest_ack = 0;
+// The server may send several packets at the same time (window), so packets
+// can arrive out of order. The schedule updater depends on their order (the
+// cells of a batch are removed before the new ones are added), therefore a
+// packet ahead of the expected sequence number is kept in the receive buffer
+// until the packets before it arrive. Each packet is acknowledged once
+// processed, so that its ACK carries the result.
+#ifndef UDPACK_RECEIVE_WINDOW
+#define UDPACK_RECEIVE_WINDOW 8
+#endif
+#define UDPACK_RECEIVE_BUFFER_SIZE 128
+static uint8_t expected_sequence_number = 1;
+static uint8_t receive_buffer[UDPACK_RECEIVE_WINDOW][UDPACK_RECEIVE_BUFFER_SIZE];
+// receive_buffer_len is 0 when the slot of the receive buffer is free
+static uint16_t receive_buffer_len[UDPACK_RECEIVE_WINDOW] = {0};
+// The result of each packet is kept so that the ACK of a duplicate carries
+// the same confirmation as the ACK of the packet processed.
+static uint8_t declined_reasons[SEQUENCE_NUMBER_SPACE] = {0};
+static uint8_t failed_cells[SEQUENCE_NUMBER_SPACE] = {0};
+
+static void send_ack(struct simple_udp_connection *c, const uip_ipaddr_t *sender_addr, uint8_t sequence_number) {
+    static uint8_t send_buffer[10] = {0};
+    LOG_INFO("Sending ack %u\n", sequence_number);
+    memset(send_buffer, 0, sizeof(send_buffer));
+    uint16_t len = new_ack_packet(send_buffer, sequence_number);
+    // encode the confirmation message followed by the reason of a decline and
+    // the epochs the node holds, so that the server can tell a stale ACK apart
+#define CONFIRMATION_DECLINE 0
+#define CONFIRMATION_OK 1
+    send_buffer[len++] = declined_reasons[sequence_number] == schedule_updater_decline_none ? CONFIRMATION_OK : CONFIRMATION_DECLINE;
+    send_buffer[len++] = declined_reasons[sequence_number];
+    send_buffer[len++] = failed_cells[sequence_number];
+    uint16_t epoch = schedule_updater_update_epoch();
+    memcpy(&send_buffer[len], &epoch, sizeof(epoch));
+    len += sizeof(epoch);
+    epoch = schedule_updater_installed_epoch();
+    memcpy(&send_buffer[len], &epoch, sizeof(epoch));
+    len += sizeof(epoch);
+    simple_udp_sendto(c, send_buffer, 10, sender_addr);
+}
+
 static void udp_rx_callback(struct simple_udp_connection *c,
                             const uip_ipaddr_t *sender_addr,
                             uint16_t sender_port,
@@ -46,23 +85,32 @@ static void udp_rx_callback(struct simple_udp_connection *c,
     remove_header_from_packet(data, &header);
     uint8_t sequence_number = decode_sequence_number(header);
     LOG_INFO("Received response with sequence_number %u \n", sequence_number);
-    LOG_INFO("Sending ack %u\n", sequence_number);
-    static uint8_t send_buffer[10] = {0};
-
-    uint16_t len = new_ack_packet(send_buffer, sequence_number);
-    // encode the confirmation message for now we accept every new schedule sent to us
-#define CONFIRMATION 1
-    send_buffer[len++] = CONFIRMATION;
-    simple_udp_sendto(c, send_buffer, 10, sender_addr);
 
-    if (sequence_number <= highest_ack) {
+    if (sequence_number_less(sequence_number, expected_sequence_number)) {
         LOG_INFO("Packet already process, only sending ACK\n");
+        send_ack(c, sender_addr, sequence_number);
         return;
     }
-    highest_ack = sequence_number;
+    uint8_t distance = (sequence_number + SEQUENCE_NUMBER_SPACE - expected_sequence_number) % SEQUENCE_NUMBER_SPACE;
+    if (distance >= UDPACK_RECEIVE_WINDOW || datalen - 1 > UDPACK_RECEIVE_BUFFER_SIZE) {
+        // Not acknowledged, the server sends the packet again later
+        LOG_WARN("Dropping the packet %u, the receive buffer cannot hold it\n", sequence_number);
+        return;
+    }
+    uint8_t slot = sequence_number % UDPACK_RECEIVE_WINDOW;
+    if (receive_buffer_len[slot] == 0) {
+        memcpy(receive_buffer[slot], data + 1, datalen - 1);
+        receive_buffer_len[slot] = datalen - 1;
+    }
 
-    const uint8_t *pkt = data + 1;
-    update_pkt_dispatch(pkt);
+    // Process the packets that follow the last one processed without gap
+    for (slot = expected_sequence_number % UDPACK_RECEIVE_WINDOW; receive_buffer_len[slot] != 0;
+         slot = expected_sequence_number % UDPACK_RECEIVE_WINDOW) {
+        declined_reasons[expected_sequence_number] = update_pkt_dispatch(receive_buffer[slot], &failed_cells[expected_sequence_number]);
+        receive_buffer_len[slot] = 0;
+        send_ack(c, sender_addr, expected_sequence_number);
+        expected_sequence_number = (expected_sequence_number + 1) % SEQUENCE_NUMBER_SPACE;
+    }
 }
 
 static void ack_middleware(struct simple_udp_connection *c,
@@ -131,7 +179,7 @@ PROCESS_THREAD(udpack_process, ev, encoder) {
                 sequence_number++;
                 break;
             }
-            if (ack_sequence_number > sequence_number && sequence_number != 0) {
+            if (sequence_number_less(sequence_number, ack_sequence_number)) {
                 LOG_INFO("The sequence number received is greather than the expected sequence number, therefore we do nothing and wait for the precedents packages to arrive\n");
                 continue;
             } else {
@@ -0,0 +1,160 @@
+package addrtranslation
+
+// EUI-64: the IPv6 addresses of the nodes are made of a /64 prefix followed by
+// an interface identifier derived from their 8 bytes MAC address (RFC 4944
+// section 6, RFC 6282 section 3.2.2): the MAC address with the
+// universal/local bit inverted. The link-local address of a node uses the
+// fe80::/64 prefix and its global addresses the prefixes of the network.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// universalLocalBit is the bit inverted in the first byte of the MAC address
+// to obtain the interface identifier.
+const universalLocalBit = 0x02
+
+// Prefix is a /64 IPv6 prefix.
+type Prefix [8]byte
+
+// LinkLocalPrefix is the prefix of the link-local addresses, fe80::/64.
+var LinkLocalPrefix = Prefix{0xfe, 0x80}
+
+// DefaultGlobalPrefix is the prefix of the global addresses used by Contiki-NG
+// (UIP_DS6_DEFAULT_PREFIX), fd00::/64.
+var DefaultGlobalPrefix = Prefix{0xfd, 0x00}
+
+// ParsePrefix parses a prefix in CIDR notation, e.g. "fd00::/64". The prefix
+// length must be 64.
+func ParsePrefix(s string) (Prefix, error) {
+	var prefix Prefix
+	ip, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return prefix, err
+	}
+	if ones, bits := ipNet.Mask.Size(); ones != 64 || bits != 128 || ip.To4() != nil {
+		return prefix, errors.New(fmt.Sprintf("%s is not a /64 IPv6 prefix", s))
+	}
+	copy(prefix[:], ipNet.IP)
+	return prefix, nil
+}
+
+// ParsePrefixes parses a comma separated list of prefixes.
+func ParsePrefixes(s string) ([]Prefix, error) {
+	prefixes := make([]Prefix, 0)
+	for _, field := range strings.Split(s, ",") {
+		prefix, err := ParsePrefix(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+func (prefix Prefix) String() string {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix[:])
+	return ip.String() + "/64"
+}
+
+// Contains reports whether `ip` belongs to the prefix.
+func (prefix Prefix) Contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil || ip.To4() != nil {
+		return false
+	}
+	return Prefix(*(*[8]byte)(ip[:8])) == prefix
+}
+
+var globalPrefixes = struct {
+	prefixes []Prefix
+	lock     sync.RWMutex
+}{prefixes: []Prefix{DefaultGlobalPrefix}}
+
+// SetGlobalPrefixes sets the prefixes of the global addresses of the nodes.
+// The first one is used to derive the global address of a node.
+func SetGlobalPrefixes(prefixes ...Prefix) error {
+	if len(prefixes) == 0 {
+		return errors.New("at least one global prefix is required")
+	}
+	globalPrefixes.lock.Lock()
+	defer globalPrefixes.lock.Unlock()
+	globalPrefixes.prefixes = append([]Prefix{}, prefixes...)
+	return nil
+}
+
+// GlobalPrefixes returns the prefixes of the global addresses of the nodes.
+func GlobalPrefixes() []Prefix {
+	globalPrefixes.lock.RLock()
+	defer globalPrefixes.lock.RUnlock()
+	return append([]Prefix{}, globalPrefixes.prefixes...)
+}
+
+// InterfaceID returns the interface identifier derived from the MAC address.
+func (macaddr MacAddr) InterfaceID() [8]byte {
+	iid := [8]byte(macaddr)
+	iid[0] ^= universalLocalBit
+	return iid
+}
+
+// MacFromInterfaceID returns the MAC address from which `iid` was derived.
+func MacFromInterfaceID(iid [8]byte) MacAddr {
+	iid[0] ^= universalLocalBit
+	return MacAddr(iid)
+}
+
+// IP returns the address of the node in `prefix`.
+func (macaddr MacAddr) IP(prefix Prefix) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix[:])
+	iid := macaddr.InterfaceID()
+	copy(ip[8:], iid[:])
+	return ip
+}
+
+// LinkLocalIP returns the link-local address of the node.
+func (macaddr MacAddr) LinkLocalIP() IPString {
+	return NetIPToIPString(macaddr.IP(LinkLocalPrefix))
+}
+
+// GlobalIP returns the global address of the node in the first global prefix.
+func (macaddr MacAddr) GlobalIP() IPString {
+	return NetIPToIPString(macaddr.IP(GlobalPrefixes()[0]))
+}
+
+// MacFromIP returns the MAC address from which the interface identifier of
+// `ip` was derived. `ip` must be a link-local address or belong to one of the
+// global prefixes.
+func MacFromIP(ip net.IP) (MacAddr, error) {
+	if !isNodeIP(ip) {
+		return MacAddr{}, errors.New(fmt.Sprintf("%v is neither a link-local address nor in the global prefixes %v", ip, GlobalPrefixes()))
+	}
+	return MacFromInterfaceID(*(*[8]byte)(ip.To16()[8:])), nil
+}
+
+func isNodeIP(ip net.IP) bool {
+	if LinkLocalPrefix.Contains(ip) {
+		return true
+	}
+	for _, prefix := range GlobalPrefixes() {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Mac returns the MAC address from which the address was derived, see
+// MacFromIP.
+func (ipString IPString) Mac() (MacAddr, error) {
+	ip := net.ParseIP(string(ipString))
+	if ip == nil {
+		return MacAddr{}, errors.New(fmt.Sprintf("%s is not an IP address", ipString))
+	}
+	return MacFromIP(ip)
+}
@@ -0,0 +1,61 @@
+package addrtranslation
+
+import (
+	"net"
+	"testing"
+)
+
+func TestEUI64RoundTrip(t *testing.T) {
+	tests := []struct {
+		mac       MacAddr
+		linkLocal IPString
+		global    IPString
+	}{
+		// The Cooja motes, the U/L bit is set in the interface identifier
+		{MacAddr{0, 2, 0, 2, 0, 2, 0, 2}, "fe80::202:2:2:2", "fd00::202:2:2:2"},
+		// The U/L bit already set in the MAC address is cleared
+		{MacAddr{0x02, 0x12, 0x4b, 0, 0x06, 0x0d, 0x9f, 0x38}, "fe80::12:4b00:60d:9f38", "fd00::12:4b00:60d:9f38"},
+	}
+	for _, test := range tests {
+		if ip := test.mac.LinkLocalIP(); ip != test.linkLocal {
+			t.Errorf("the link-local address of %v is %s, expected %s", test.mac, ip, test.linkLocal)
+		}
+		if ip := test.mac.GlobalIP(); ip != test.global {
+			t.Errorf("the global address of %v is %s, expected %s", test.mac, ip, test.global)
+		}
+		for _, ip := range []IPString{test.linkLocal, test.global} {
+			mac, err := ip.Mac()
+			if err != nil || mac != test.mac {
+				t.Errorf("the MAC address of %s is %v (%v), expected %v", ip, mac, err, test.mac)
+			}
+		}
+		if ip := test.linkLocal.LinkLocalToGlobal(); ip != test.global {
+			t.Errorf("the global address of %s is %s, expected %s", test.linkLocal, ip, test.global)
+		}
+	}
+}
+
+func TestEUI64Prefixes(t *testing.T) {
+	prefixes, err := ParsePrefixes("fd01::/64,fd00::/64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetGlobalPrefixes(prefixes...); err != nil {
+		t.Fatal(err)
+	}
+	defer SetGlobalPrefixes(DefaultGlobalPrefix)
+
+	mac := MacAddr{0, 3, 0, 3, 0, 3, 0, 3}
+	if ip := mac.GlobalIP(); ip != "fd01::203:3:3:3" {
+		t.Errorf("the global address of %v is %s, expected it in the first prefix", mac, ip)
+	}
+	if found, err := IPString("fd00::203:3:3:3").Mac(); err != nil || found != mac {
+		t.Errorf("the address in the second prefix gives %v (%v), expected %v", found, err, mac)
+	}
+	if _, err := MacFromIP(net.ParseIP("fd02::203:3:3:3")); err == nil {
+		t.Error("an address outside the prefixes gave a MAC address")
+	}
+	if _, err := ParsePrefix("fd00::/48"); err == nil {
+		t.Error("a /48 prefix was accepted")
+	}
+}
@@ -3,8 +3,10 @@ package addrtranslation
 // This package allows to keep a one-to-one relation between an IP address of a node and its LinkLocalAddr.
 
 import (
+	"fmt"
 	"net"
-	"strings"
+	"sort"
+	"sync"
 )
 
 type MacAddr [8]byte
@@ -18,59 +20,170 @@ func (macaddr *MacAddr) Equal(other *MacAddr) bool {
 	return true
 }
 
+func (macaddr MacAddr) String() string {
+	return net.HardwareAddr(macaddr[:]).String()
+}
+
+// MacIPPair is the MAC address and the IP address of a node.
 type MacIPPair struct {
-	mac *MacAddr
-	ip  IPString
+	Mac MacAddr
+	IP  IPString
+}
+
+// TranslationConflict is returned by MacIPTranslation.Add when the new pair
+// replaces the IP address of a MAC address or the MAC address of an IP address.
+type TranslationConflict struct {
+	Pair MacIPPair
+	// PreviousIP is the IP address of the MAC address before the new pair, if any
+	PreviousIP IPString
+	// PreviousMac is the MAC address claiming the IP address before the new pair, if any
+	PreviousMac *MacAddr
+}
+
+func (conflict *TranslationConflict) Error() string {
+	if conflict.PreviousIP != "" {
+		return fmt.Sprintf("%v moved from %s to %s", conflict.Pair.Mac, conflict.PreviousIP, conflict.Pair.IP)
+	}
+	return fmt.Sprintf("%s is claimed by %v and %v", conflict.Pair.IP, *conflict.PreviousMac, conflict.Pair.Mac)
 }
 
+// MacIPTranslation is the bidirectional relation between the MAC addresses
+// and the IP addresses of the nodes. It is safe for concurrent use.
 type MacIPTranslation struct {
-	MacIPaddrs []*MacIPPair
+	macToIP map[MacAddr]IPString
+	ipToMac map[IPString]MacAddr
+	lock    *sync.RWMutex
 }
 
 func NewMacIPTranslation() MacIPTranslation {
-	return MacIPTranslation{MacIPaddrs: make([]*MacIPPair, 0)}
+	return MacIPTranslation{
+		macToIP: make(map[MacAddr]IPString),
+		ipToMac: make(map[IPString]MacAddr),
+		lock:    &sync.RWMutex{},
+	}
 }
 
-func (macIPTranslation *MacIPTranslation) Add(macAddr *MacAddr, ip IPString) {
-	if _, in := macIPTranslation.Find(macAddr); !in {
-		macIPTranslation.MacIPaddrs = append(macIPTranslation.MacIPaddrs, &MacIPPair{
-			mac: macAddr,
-			ip:  ip,
-		})
+// Add records that `macAddr` has the address `ip`. The latest pair is kept
+// when `macAddr` had another IP address or `ip` belonged to another MAC
+// address, and the conflict is returned as a *TranslationConflict.
+func (macIPTranslation *MacIPTranslation) Add(macAddr MacAddr, ip IPString) error {
+	macIPTranslation.lock.Lock()
+	defer macIPTranslation.lock.Unlock()
+	conflict := &TranslationConflict{Pair: MacIPPair{Mac: macAddr, IP: ip}}
+	if previousIP, in := macIPTranslation.macToIP[macAddr]; in {
+		if previousIP == ip {
+			return nil
+		}
+		conflict.PreviousIP = previousIP
+		delete(macIPTranslation.ipToMac, previousIP)
+	}
+	if previousMac, in := macIPTranslation.ipToMac[ip]; in {
+		conflict.PreviousMac = &previousMac
+		delete(macIPTranslation.macToIP, previousMac)
 	}
+	macIPTranslation.macToIP[macAddr] = ip
+	macIPTranslation.ipToMac[ip] = macAddr
+	if conflict.PreviousIP == "" && conflict.PreviousMac == nil {
+		return nil
+	}
+	return conflict
 }
 
-func (macIPTranslation *MacIPTranslation) Find(macAddr *MacAddr) (IPString, bool) {
-	for _, macip := range macIPTranslation.MacIPaddrs {
-		if macip.mac.Equal(macAddr) {
-			return macip.ip, true
-		}
+// Remove forgets the pair of `ip`.
+func (macIPTranslation *MacIPTranslation) Remove(ip IPString) {
+	macIPTranslation.lock.Lock()
+	defer macIPTranslation.lock.Unlock()
+	if macAddr, in := macIPTranslation.ipToMac[ip]; in {
+		delete(macIPTranslation.macToIP, macAddr)
+		delete(macIPTranslation.ipToMac, ip)
 	}
-	return "", false
 }
 
-func (macIPTranslation *MacIPTranslation) FindMac(ipAddr IPString) (*MacAddr, bool) {
-	for _, macip := range macIPTranslation.MacIPaddrs {
-		if macip.ip == ipAddr {
-			return macip.mac, true
+// Find returns the IP address reported for `macAddr`.
+func (macIPTranslation *MacIPTranslation) Find(macAddr MacAddr) (IPString, bool) {
+	macIPTranslation.lock.RLock()
+	defer macIPTranslation.lock.RUnlock()
+	ip, in := macIPTranslation.macToIP[macAddr]
+	return ip, in
+}
+
+// FindMac returns the MAC address of `ipAddr`. When the node did not report its
+// MAC address yet, it is derived from the interface identifier of `ipAddr`.
+func (macIPTranslation *MacIPTranslation) FindMac(ipAddr IPString) (MacAddr, bool) {
+	macIPTranslation.lock.RLock()
+	macAddr, in := macIPTranslation.ipToMac[ipAddr]
+	macIPTranslation.lock.RUnlock()
+	if in {
+		return macAddr, true
+	}
+	if macAddr, err := ipAddr.Mac(); err == nil {
+		return macAddr, true
+	}
+	return MacAddr{}, false
+}
+
+// Len returns the number of pairs.
+func (macIPTranslation *MacIPTranslation) Len() int {
+	macIPTranslation.lock.RLock()
+	defer macIPTranslation.lock.RUnlock()
+	return len(macIPTranslation.ipToMac)
+}
+
+// Snapshot returns the pairs sorted by IP address. The snapshot is not
+// affected by the later changes.
+func (macIPTranslation *MacIPTranslation) Snapshot() []MacIPPair {
+	macIPTranslation.lock.RLock()
+	pairs := make([]MacIPPair, 0, len(macIPTranslation.ipToMac))
+	for ip, macAddr := range macIPTranslation.ipToMac {
+		pairs = append(pairs, MacIPPair{Mac: macAddr, IP: ip})
+	}
+	macIPTranslation.lock.RUnlock()
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].IP < pairs[j].IP
+	})
+	return pairs
+}
+
+// Range calls `f` on each pair of a snapshot, sorted by IP address, until `f`
+// returns false.
+func (macIPTranslation *MacIPTranslation) Range(f func(pair MacIPPair) bool) {
+	for _, pair := range macIPTranslation.Snapshot() {
+		if !f(pair) {
+			return
 		}
 	}
-	return nil, false
 }
 
 type IPString string
 
-func AddrToIPString(addr *net.UDPAddr) IPString {
-	return IPString(addr.IP.String())
+// AddrToIPString returns the IP address of `addr`. Addresses that do not carry
+// an IP address (e.g. a serial bridge) are identified by their string form.
+func AddrToIPString(addr net.Addr) IPString {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return IPString(addr.IP.String())
+	case *net.IPAddr:
+		return IPString(addr.IP.String())
+	default:
+		return IPString(addr.String())
+	}
 }
 
 func NetIPToIPString(addr net.IP) IPString {
 	return IPString(addr.String())
 }
 
+// LinkLocalToGlobal returns the global address in the first global prefix
+// with the interface identifier of a link-local address. The other addresses
+// are returned unchanged.
 func (ipString IPString) LinkLocalToGlobal() IPString {
-	// Normally this should not be done, we need a better way to translate link local to global addresses.
-	// For simulations though it's totally usable because the translation between an IP address and the LinkLocal
-	// address is deterministic.
-	return IPString(strings.Replace(string(ipString), "fe80", "fd00", 1))
+	ip := net.ParseIP(string(ipString))
+	if ip == nil || !LinkLocalPrefix.Contains(ip) {
+		return ipString
+	}
+	global := make(net.IP, net.IPv6len)
+	prefix := GlobalPrefixes()[0]
+	copy(global, prefix[:])
+	copy(global[8:], ip.To16()[8:])
+	return NetIPToIPString(global)
 }
@@ -0,0 +1,89 @@
+package addrtranslation
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMacIPTranslationConflicts(t *testing.T) {
+	macA := MacAddr{0, 1, 0, 1, 0, 1, 0, 1}
+	macB := MacAddr{0, 2, 0, 2, 0, 2, 0, 2}
+	tests := []struct {
+		name        string
+		setup       []MacIPPair
+		add         MacIPPair
+		previousIP  IPString
+		previousMac *MacAddr
+	}{
+		{"same pair", []MacIPPair{{macA, "fd00::a"}}, MacIPPair{macA, "fd00::a"}, "", nil},
+		{"new pair", []MacIPPair{{macA, "fd00::a"}}, MacIPPair{macB, "fd00::b"}, "", nil},
+		{"MAC address moved", []MacIPPair{{macA, "fd00::a"}}, MacIPPair{macA, "fd00::c"}, "fd00::a", nil},
+		{"IP address claimed", []MacIPPair{{macA, "fd00::a"}}, MacIPPair{macB, "fd00::a"}, "", &macA},
+		{"both", []MacIPPair{{macA, "fd00::a"}, {macB, "fd00::b"}}, MacIPPair{macA, "fd00::b"}, "fd00::a", &macB},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			translation := NewMacIPTranslation()
+			for _, pair := range test.setup {
+				if err := translation.Add(pair.Mac, pair.IP); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := translation.Add(test.add.Mac, test.add.IP)
+			if test.previousIP == "" && test.previousMac == nil {
+				if err != nil {
+					t.Fatal("unexpected conflict:", err)
+				}
+			} else {
+				var conflict *TranslationConflict
+				if !errors.As(err, &conflict) {
+					t.Fatalf("got the error %v, expected a TranslationConflict", err)
+				}
+				if conflict.Pair != test.add || conflict.PreviousIP != test.previousIP ||
+					(conflict.PreviousMac == nil) != (test.previousMac == nil) ||
+					(conflict.PreviousMac != nil && *conflict.PreviousMac != *test.previousMac) {
+					t.Errorf("unexpected conflict: %v", conflict)
+				}
+			}
+			// The latest pair wins in both directions
+			if ip, _ := translation.Find(test.add.Mac); ip != test.add.IP {
+				t.Errorf("%v has the address %s, expected %s", test.add.Mac, ip, test.add.IP)
+			}
+			if mac, _ := translation.FindMac(test.add.IP); mac != test.add.Mac {
+				t.Errorf("%s has the MAC address %v, expected %v", test.add.IP, mac, test.add.Mac)
+			}
+			// The replaced pairs are forgotten in both directions
+			if test.previousIP != "" {
+				if mac, _ := translation.FindMac(test.previousIP); mac == test.add.Mac {
+					t.Errorf("%s still belongs to %v", test.previousIP, mac)
+				}
+			}
+			if test.previousMac != nil {
+				if ip, in := translation.Find(*test.previousMac); in {
+					t.Errorf("%v still has the address %s", *test.previousMac, ip)
+				}
+			}
+			for _, pair := range translation.Snapshot() {
+				if found, _ := translation.Find(pair.Mac); found != pair.IP {
+					t.Errorf("the pair %v is only known in one direction", pair)
+				}
+			}
+		})
+	}
+}
+
+func TestMacIPTranslationRemove(t *testing.T) {
+	mac := MacAddr{0, 1, 0, 1, 0, 1, 0, 1}
+	translation := NewMacIPTranslation()
+	if err := translation.Add(mac, "fd00::a"); err != nil {
+		t.Fatal(err)
+	}
+	translation.Remove("fd00::a")
+	if _, in := translation.Find(mac); in || translation.Len() != 0 {
+		t.Error("the pair was not removed")
+	}
+	// The node comes back with another address
+	if err := translation.Add(mac, "fd00::b"); err != nil {
+		t.Error("unexpected conflict after the removal:", err)
+	}
+}
@@ -3,7 +3,6 @@ package applications
 import (
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"scheduleupdater-server/addrtranslation"
 	"sync"
@@ -15,6 +14,7 @@ type BandwidthMap map[addrtranslation.IPString]uint
 // The bandwidth requirement is an integer indicating the number of packets that the node
 // wants to send in a single slotframe.
 type ApplicationBandwidth struct {
+	ChangeNotifier
 	Bandwith BandwidthMap
 	nClients uint
 	lock     sync.RWMutex
@@ -22,9 +22,10 @@ type ApplicationBandwidth struct {
 
 func NewApplicationBandwidth(nClients uint) ApplicationBandwidth {
 	return ApplicationBandwidth{
-		Bandwith: make(BandwidthMap),
-		nClients: nClients,
-		lock:     sync.RWMutex{},
+		ChangeNotifier: newChangeNotifier(),
+		Bandwith:       make(BandwidthMap),
+		nClients:       nClients,
+		lock:           sync.RWMutex{},
 	}
 }
 
@@ -32,21 +33,74 @@ func (app *ApplicationBandwidth) Type() AppType {
 	return AppTypeBandwidth
 }
 
-func (app *ApplicationBandwidth) ProcessPacket(addr *net.UDPAddr, packet []byte) {
+func (app *ApplicationBandwidth) ProcessPacket(addr net.Addr, packet []byte) error {
 	addrIP := addrtranslation.AddrToIPString(addr)
 	bandwith, err := decodeBandwith(packet)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
+	app.setBandwidth(addrIP, bandwith)
+	return nil
+}
+
+func (app *ApplicationBandwidth) ProcessDecoded(addr net.Addr, decoded interface{}) error {
+	bandwith, ok := decoded.(uint)
+	if !ok {
+		return errors.New(fmt.Sprintf("a bandwidth was expected instead of %T", decoded))
+	}
+	app.setBandwidth(addrtranslation.AddrToIPString(addr), bandwith)
+	return nil
+}
+
+func (app *ApplicationBandwidth) setBandwidth(addrIP addrtranslation.IPString, bandwith uint) {
 	app.lock.Lock()
 	defer app.lock.Unlock()
-	app.Bandwith[addrIP] = bandwith
+	if previous, in := app.Bandwith[addrIP]; !in || previous != bandwith {
+		app.Bandwith[addrIP] = bandwith
+		app.notify()
+	}
 }
 
 func (app *ApplicationBandwidth) Ready() bool {
+	app.lock.RLock()
+	defer app.lock.RUnlock()
 	return len(app.Bandwith) == int(app.nClients)
 }
 
+// ReadyFor reports whether every node of `nodes` sent its bandwidth.
+func (app *ApplicationBandwidth) ReadyFor(nodes []addrtranslation.IPString) bool {
+	app.lock.RLock()
+	defer app.lock.RUnlock()
+	for _, node := range nodes {
+		if _, in := app.Bandwith[node]; !in {
+			return false
+		}
+	}
+	return true
+}
+
+// Forget removes the bandwidth of a node that left the network.
+func (app *ApplicationBandwidth) Forget(addrIP addrtranslation.IPString) {
+	app.lock.Lock()
+	defer app.lock.Unlock()
+	if _, in := app.Bandwith[addrIP]; in {
+		delete(app.Bandwith, addrIP)
+		app.notify()
+	}
+}
+
+// Snapshot returns a copy of the bandwidths, which is not affected by the next
+// updates.
+func (app *ApplicationBandwidth) Snapshot() BandwidthMap {
+	app.lock.RLock()
+	defer app.lock.RUnlock()
+	bandwidthMap := make(BandwidthMap, len(app.Bandwith))
+	for addrIP, bandwith := range app.Bandwith {
+		bandwidthMap[addrIP] = bandwith
+	}
+	return bandwidthMap
+}
+
 func decodeBandwith(packet []byte) (uint, error) {
 	if len(packet) < 1 {
 		return 0, errors.New(fmt.Sprintf(
@@ -1,72 +1,237 @@
 package applications
 
 import (
+	"errors"
+	"hash/fnv"
 	"log"
 	"net"
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/stats"
+	"scheduleupdater-server/utils"
+	"sync"
+	"time"
 )
 
 // App an application allows clients to communicate with the server
 // by sending packet identified by an AppType unique to the application.
 // Each App must have a method named `ProcessPacket` that handles each
-// packet received from a client.
+// packet received from a client, and returns an error when the packet is
+// rejected.
 type App interface {
-	ProcessPacket(addr *net.UDPAddr, packet []byte)
+	ProcessPacket(addr net.Addr, packet []byte) error
 	Type() AppType
 }
 
+// DecodedApp is an App receiving the packets decoded by the Decoder of its
+// AppType instead of the raw packets.
+type DecodedApp interface {
+	App
+	ProcessDecoded(addr net.Addr, decoded interface{}) error
+}
+
+// AppType identifies the application of a packet, see AppTypeRegistry.
 type AppType int
 
+// The built-in AppTypes, they mirror common/application-type.h
 const (
-	AppTypeGraph = iota
+	AppTypeGraph AppType = iota
 	AppTypeTopology
 	AppTypeBandwidth
 	AppTypeHelloWorld
-	ApplicationTypeAll
 )
 
-func (appType AppType) debug() string {
-	return [...]string{
-		"AppTypeGraph",
-		"AppTypeTopology",
-		"AppTypeBandwith",
-		"AppTypeHelloWorld",
-		"ApplicationTypeAll",
-	}[appType]
+// DispatcherConfig configures the workers processing the packets of an
+// AppDispatcher.
+type DispatcherConfig struct {
+	// Workers is the number of packets processed concurrently. The packets of
+	// a node are always processed by the same worker, in their arrival order.
+	Workers int
+	// QueueSize is the number of packets waiting for each worker
+	QueueSize int
+	// EnqueueTimeout is the time the Handler waits for room in a full queue,
+	// which slows down the reception, before dropping the packet
+	EnqueueTimeout time.Duration
+}
+
+func NewDefaultDispatcherConfig() DispatcherConfig {
+	return DispatcherConfig{
+		Workers:        4,
+		QueueSize:      64,
+		EnqueueTimeout: 10 * time.Millisecond,
+	}
+}
+
+// dispatchJob is a packet waiting for its applications.
+type dispatchJob struct {
+	addr    net.Addr
+	appType AppType
+	packet  []byte
+	// decoded is the packet decoded by the Decoder of the AppType, if any
+	decoded    interface{}
+	hasDecoded bool
 }
 
 // AppDispatcher dispatches the packets by their AppType. AppDispatcher allows
 // applications to subscribe to the AppDispatcher to receive the packets with
 // their AppType.
 type AppDispatcher struct {
-	applications [ApplicationTypeAll][]App
+	registry     *AppTypeRegistry
+	applications map[AppType][]App
+	config       DispatcherConfig
+	queues       []chan dispatchJob
+	closed       bool
+	lock         sync.RWMutex
 }
 
+// NewAppDispatcher creates an AppDispatcher with the built-in AppTypes
+// registered and the default DispatcherConfig.
 func NewAppDispatcher() *AppDispatcher {
-	return &AppDispatcher{}
+	return NewAppDispatcherWithConfig(NewDefaultDispatcherConfig())
+}
+
+// NewAppDispatcherWithConfig creates an AppDispatcher with the built-in
+// AppTypes registered and starts its workers.
+func NewAppDispatcherWithConfig(config DispatcherConfig) *AppDispatcher {
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
+	registry := NewAppTypeRegistry()
+	for _, info := range builtinAppTypes() {
+		if err := registry.Register(info); err != nil {
+			log.Panic(err)
+		}
+	}
+	dispatcher := &AppDispatcher{
+		registry:     registry,
+		applications: make(map[AppType][]App),
+		config:       config,
+		queues:       make([]chan dispatchJob, config.Workers),
+		lock:         sync.RWMutex{},
+	}
+	for i := range dispatcher.queues {
+		dispatcher.queues[i] = make(chan dispatchJob, config.QueueSize)
+		go dispatcher.work(dispatcher.queues[i])
+	}
+	return dispatcher
+}
+
+// Register registers a new AppType, it fails with a *DuplicateAppTypeError
+// when its ID or its name is already registered.
+func (dispatcher *AppDispatcher) Register(info AppTypeInfo) error {
+	return dispatcher.registry.Register(info)
+}
+
+// AppTypes returns the registered AppTypes sorted by ID.
+func (dispatcher *AppDispatcher) AppTypes() []AppTypeInfo {
+	return dispatcher.registry.Types()
 }
 
 // Subscribe subscribes an application to the AppDispatcher to receive
-// packets with their AppType.
+// packets with their AppType. The AppType must be registered and the
+// applications must subscribe before the packets are dispatched.
 func (dispatcher *AppDispatcher) Subscribe(app App) *AppDispatcher {
 	appType := app.Type()
+	if _, in := dispatcher.registry.Lookup(appType); !in {
+		log.Panic("The application subscribes to the AppType ", int(appType), " which is not registered")
+	}
 	dispatcher.applications[appType] = append(dispatcher.applications[appType], app)
 	return dispatcher
 }
 
-// Handler handles a `packet` coming from an address `addr` and dispatches
-// the `packet` to the corresponding applications.
-func (dispatcher *AppDispatcher) Handler(addr *net.UDPAddr, packet []byte) {
-	appType, packetWithoutAppType := removeAppType(packet)
-	if appType >= ApplicationTypeAll {
-		log.Panic("The AppType contained in the packet is not a valid AppType"+
-			" (value: ", appType, ")")
+// Handler handles a `packet` coming from an address `addr` and queues the
+// `packet` for the corresponding applications. The rejected and the dropped
+// packets are logged and counted in the stats.
+func (dispatcher *AppDispatcher) Handler(addr net.Addr, packet []byte) {
+	appType, packetWithoutAppType, err := removeAppType(packet)
+	if err != nil {
+		dispatcher.reject(addr, appType, err)
+		return
+	}
+	info, in := dispatcher.registry.Lookup(appType)
+	if !in {
+		dispatcher.reject(addr, appType, errors.New("the AppType contained in the packet is not a registered AppType"))
+		return
 	}
-	for _, app := range dispatcher.applications[appType] {
-		go app.ProcessPacket(addr, packetWithoutAppType)
+	job := dispatchJob{addr: addr, appType: appType, packet: packetWithoutAppType}
+	if info.Decode != nil {
+		job.decoded, err = info.Decode(addr, packetWithoutAppType)
+		if err != nil {
+			dispatcher.reject(addr, appType, err)
+			return
+		}
+		job.hasDecoded = true
 	}
+	dispatcher.enqueue(job)
 }
 
-func removeAppType(packet []byte) (AppType, []byte) {
+// enqueue gives the job to the worker of its source, the job is dropped when
+// the queue of the worker stays full.
+func (dispatcher *AppDispatcher) enqueue(job dispatchJob) {
+	addrIP := addrtranslation.AddrToIPString(job.addr)
+	dispatcher.lock.RLock()
+	defer dispatcher.lock.RUnlock()
+	if dispatcher.closed {
+		return
+	}
+	source := fnv.New32a()
+	source.Write([]byte(addrIP))
+	queue := dispatcher.queues[source.Sum32()%uint32(len(dispatcher.queues))]
+	select {
+	case queue <- job:
+		return
+	default:
+	}
+	select {
+	case queue <- job:
+	case <-time.After(dispatcher.config.EnqueueTimeout):
+		utils.Log.WarningPrintln("Dropped a ", dispatcher.registry.Name(job.appType), " packet from ", addrIP, ": the dispatcher is overloaded")
+		stats.SimulationStats.Dropped.Increment(addrIP)
+	}
+}
+
+// work processes the jobs of `queue` one after the other, each job is given
+// to the applications in their subscription order.
+func (dispatcher *AppDispatcher) work(queue chan dispatchJob) {
+	for job := range queue {
+		for _, app := range dispatcher.applications[job.appType] {
+			var err error
+			if decodedApp, ok := app.(DecodedApp); ok && job.hasDecoded {
+				err = decodedApp.ProcessDecoded(job.addr, job.decoded)
+			} else {
+				err = app.ProcessPacket(job.addr, job.packet)
+			}
+			if err != nil {
+				dispatcher.reject(job.addr, job.appType, err)
+			}
+		}
+	}
+}
+
+// Close stops the workers once the queued packets are processed, the packets
+// handled afterwards are ignored.
+func (dispatcher *AppDispatcher) Close() {
+	dispatcher.lock.Lock()
+	defer dispatcher.lock.Unlock()
+	if dispatcher.closed {
+		return
+	}
+	dispatcher.closed = true
+	for _, queue := range dispatcher.queues {
+		close(queue)
+	}
+}
+
+func (dispatcher *AppDispatcher) reject(addr net.Addr, appType AppType, err error) {
+	addrIP := addrtranslation.AddrToIPString(addr)
+	name := dispatcher.registry.Name(appType)
+	utils.Log.WarningPrintln("Rejected a ", name, " packet from ", addrIP, ": ", err)
+	stats.SimulationStats.Rejected.Increment(addrIP, name)
+}
+
+func removeAppType(packet []byte) (AppType, []byte, error) {
+	if len(packet) < 1 {
+		return 0, nil, errors.New("the packet is empty")
+	}
 	rawAppType := packet[0]
-	return AppType(rawAppType), packet[1:]
+	return AppType(rawAppType), packet[1:], nil
 }
@@ -0,0 +1,133 @@
+package applications
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/stats"
+	"scheduleupdater-server/utils"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	utils.NewLogger(utils.LogLevelError, utils.WHITE)
+	os.Exit(m.Run())
+}
+
+const appTypeTest AppType = 200
+
+// orderApp records the sequence numbers of the packets of each source.
+type orderApp struct {
+	received map[addrtranslation.IPString][]uint16
+	lock     sync.Mutex
+	// started and release, when set, block the processing of each packet
+	started chan struct{}
+	release chan struct{}
+}
+
+func newOrderApp() *orderApp {
+	return &orderApp{received: make(map[addrtranslation.IPString][]uint16)}
+}
+
+func (app *orderApp) Type() AppType {
+	return appTypeTest
+}
+
+func (app *orderApp) ProcessPacket(addr net.Addr, packet []byte) error {
+	if app.started != nil {
+		app.started <- struct{}{}
+		<-app.release
+	}
+	app.lock.Lock()
+	defer app.lock.Unlock()
+	addrIP := addrtranslation.AddrToIPString(addr)
+	app.received[addrIP] = append(app.received[addrIP], binary.LittleEndian.Uint16(packet))
+	return nil
+}
+
+func newTestDispatcher(t *testing.T, config DispatcherConfig, app App) *AppDispatcher {
+	dispatcher := NewAppDispatcherWithConfig(config)
+	if err := dispatcher.Register(AppTypeInfo{ID: appTypeTest, Name: "AppTypeTest"}); err != nil {
+		t.Fatal(err)
+	}
+	dispatcher.Subscribe(app)
+	return dispatcher
+}
+
+func testPacket(seq uint16) []byte {
+	packet := []byte{byte(appTypeTest), 0, 0}
+	binary.LittleEndian.PutUint16(packet[1:], seq)
+	return packet
+}
+
+func testSource(id int) net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP(fmt.Sprintf("fd00::%x", id+1)), Port: 3000}
+}
+
+func TestAppDispatcherKeepsTheOrderOfEachSource(t *testing.T) {
+	const sources = 8
+	const packets = 500
+	app := newOrderApp()
+	dispatcher := newTestDispatcher(t, DispatcherConfig{Workers: 3, QueueSize: 4, EnqueueTimeout: time.Minute}, app)
+
+	var wg sync.WaitGroup
+	for source := 0; source < sources; source++ {
+		wg.Add(1)
+		go func(addr net.Addr) {
+			defer wg.Done()
+			for seq := uint16(0); seq < packets; seq++ {
+				dispatcher.Handler(addr, testPacket(seq))
+			}
+		}(testSource(source))
+	}
+	wg.Wait()
+	dispatcher.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for source := 0; source < sources; source++ {
+		addrIP := addrtranslation.AddrToIPString(testSource(source))
+		for {
+			app.lock.Lock()
+			received := append([]uint16{}, app.received[addrIP]...)
+			app.lock.Unlock()
+			if len(received) == packets || time.Now().After(deadline) {
+				for i, seq := range received {
+					if seq != uint16(i) {
+						t.Fatalf("%s: the packet %d was processed at the position %d", addrIP, seq, i)
+					}
+				}
+				if len(received) != packets {
+					t.Fatalf("%s: %d packets processed out of %d", addrIP, len(received), packets)
+				}
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestAppDispatcherDropsWhenTheQueueStaysFull(t *testing.T) {
+	app := newOrderApp()
+	app.started = make(chan struct{}, 3)
+	app.release = make(chan struct{})
+	dispatcher := newTestDispatcher(t, DispatcherConfig{Workers: 1, QueueSize: 1, EnqueueTimeout: time.Millisecond}, app)
+	defer dispatcher.Close()
+	stats.SimulationStats.Dropped.Reset()
+
+	source := testSource(0)
+	// The first packet blocks the worker, the second one fills the queue
+	dispatcher.Handler(source, testPacket(0))
+	<-app.started
+	dispatcher.Handler(source, testPacket(1))
+	dispatcher.Handler(source, testPacket(2))
+	close(app.release)
+
+	dropped := stats.SimulationStats.Dropped.Copy()
+	if count := dropped.IPMap[addrtranslation.AddrToIPString(source)]; count != 1 {
+		t.Errorf("%d packets dropped, expected 1", count)
+	}
+}
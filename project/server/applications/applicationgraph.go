@@ -1,6 +1,7 @@
 package applications
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -10,115 +11,190 @@ import (
 	"time"
 )
 
-// ApplicationGraph retrieve the RPL graph from the nodes.
+// ApplicationGraph retrieve the RPL graph from the nodes. Each link expires
+// after the link lifetime unless the child reports its parent again.
 type ApplicationGraph struct {
+	ChangeNotifier
 	Graph    RPLGraph
 	nClients uint
-	lock     sync.RWMutex
+	// linkLifetime is 0 when the links never expire
+	linkLifetime time.Duration
+	linkHandlers []func(LinkEvent)
+	lock         sync.RWMutex
+}
+
+// LinkEvent is the removal of an expired link from the graph.
+type LinkEvent struct {
+	ChildIP  addrtranslation.IPString
+	ParentIP addrtranslation.IPString
+	Time     time.Time
 }
 
 func NewApplicationGraph(nClients uint) ApplicationGraph {
 	return ApplicationGraph{
-		Graph:    make(RPLGraph),
-		nClients: nClients,
-		lock:     sync.RWMutex{},
+		ChangeNotifier: newChangeNotifier(),
+		Graph:          make(RPLGraph),
+		nClients:       nClients,
+		lock:           sync.RWMutex{},
 	}
 }
 
+// SetLinkLifetime sets the time a link stays in the graph after the last report
+// of the child, 0 means that the links never expire.
+func (app *ApplicationGraph) SetLinkLifetime(lifetime time.Duration) {
+	app.lock.Lock()
+	defer app.lock.Unlock()
+	app.linkLifetime = lifetime
+}
+
+// OnLinkExpired registers a function called on the removal of each expired
+// link. The functions must be registered before the sweeper starts.
+func (app *ApplicationGraph) OnLinkExpired(handler func(LinkEvent)) *ApplicationGraph {
+	app.linkHandlers = append(app.linkHandlers, handler)
+	return app
+}
+
 func (app *ApplicationGraph) Type() AppType {
 	return AppTypeGraph
 }
 
-func (app *ApplicationGraph) ProcessPacket(addr *net.UDPAddr, packet []byte) {
-	graphUpdate := decodeGraphUpdateData(addr.IP, packet)
+func (app *ApplicationGraph) ProcessPacket(addr net.Addr, packet []byte) error {
+	graphUpdate, err := decodeGraphUpdateData(addrtranslation.AddrToIPString(addr), packet)
+	if err != nil {
+		return err
+	}
 	app.updateGraph(&graphUpdate)
+	return nil
+}
+
+func (app *ApplicationGraph) ProcessDecoded(addr net.Addr, decoded interface{}) error {
+	graphUpdate, ok := decoded.(GraphTopologyUpdate)
+	if !ok {
+		return errors.New(fmt.Sprintf("a graph update was expected instead of %T", decoded))
+	}
+	app.updateGraph(&graphUpdate)
+	return nil
 }
 
 func (app *ApplicationGraph) Ready() bool {
+	app.lock.RLock()
+	defer app.lock.RUnlock()
 	if len(app.Graph) > int(app.nClients-1) {
 		utils.Log.ErrorPrintln("Something wrong...")
 	}
 	return len(app.Graph) == int(app.nClients-1) // -1 since we count the number of links
 }
 
+// ReadyFor reports whether every node of `nodes` but the root sent its RPL
+// parent.
+func (app *ApplicationGraph) ReadyFor(nodes []addrtranslation.IPString) bool {
+	app.lock.RLock()
+	defer app.lock.RUnlock()
+	withoutParent := 0
+	now := time.Now()
+	for _, node := range nodes {
+		if link, in := app.Graph[node]; !in || link.Expired(now) {
+			withoutParent++
+		}
+	}
+	return withoutParent <= 1
+}
+
+// Forget removes the link of a node that left the network and the links of
+// its children, which are added back when they report their new parent.
+func (app *ApplicationGraph) Forget(addrIP addrtranslation.IPString) {
+	app.lock.Lock()
+	defer app.lock.Unlock()
+	changed := false
+	for childIP, link := range app.Graph {
+		if childIP == addrIP || link.ParentIP == addrIP {
+			delete(app.Graph, childIP)
+			changed = true
+		}
+	}
+	if changed {
+		app.notify()
+	}
+}
+
 func (app *ApplicationGraph) updateGraph(graphUpdate *GraphTopologyUpdate) {
 	// This is mostly a hack and should be replaced in a proper environement
-	childIPString := addrtranslation.IPString(graphUpdate.ChildIP.String())
+	childIPString := graphUpdate.ChildIP
 	parentIPString := addrtranslation.IPString(graphUpdate.ParentIP.String()).LinkLocalToGlobal()
+	app.lock.Lock()
+	defer app.lock.Unlock()
+	var expiredTime time.Time
+	if app.linkLifetime > 0 {
+		expiredTime = time.Now().Add(app.linkLifetime)
+	}
 	if v, in := app.Graph[childIPString]; !in || v.ParentIP != parentIPString {
 		log.Printf("Adding RPL Link: from %s to %s\n", childIPString, parentIPString)
 		app.Graph[childIPString] = &RPLLink{
-			ParentIP: parentIPString,
+			ParentIP:    parentIPString,
+			ExpiredTime: expiredTime,
+		}
+		app.notify()
+	} else if app.linkLifetime > 0 {
+		// The snapshots may still hold the previous link, it is replaced
+		// instead of being modified
+		app.Graph[childIPString] = &RPLLink{
+			ParentIP:    v.ParentIP,
+			ExpiredTime: expiredTime,
 		}
 	}
 }
 
-type RPLGraph map[addrtranslation.IPString]*RPLLink
-
-// LeavesToRootOrder returns an ordered list of IP addresses. The list is ordered in a way
-// that the leaves are first and then the following addresses are their ancestors up to the root
-// of the RPL tree.
-func (rplGraph RPLGraph) LeavesToRootOrder() []addrtranslation.IPString {
-	order := make([]addrtranslation.IPString, len(rplGraph)+1)
-	leaves := rplGraph.findLeaves()
-	index := 0
-
-	insertIfNotIn := func(value addrtranslation.IPString) {
-		for i := 0; i < index; i++ {
-			if order[i] == value {
-				return
-			}
+// Sweep removes the links expired at `now`, gives their LinkEvent to the
+// handlers and signals the change of the graph once all of them were called.
+func (app *ApplicationGraph) Sweep(now time.Time) []LinkEvent {
+	events := make([]LinkEvent, 0)
+	app.lock.Lock()
+	for childIP, link := range app.Graph {
+		if link.Expired(now) {
+			delete(app.Graph, childIP)
+			events = append(events, LinkEvent{ChildIP: childIP, ParentIP: link.ParentIP, Time: now})
 		}
-		order[index] = value
-		index++
 	}
-
-	for _, leaf := range leaves {
-		insertIfNotIn(leaf)
-		for {
-			if link, in := rplGraph[leaf]; in {
-				insertIfNotIn(link.ParentIP)
-				leaf = link.ParentIP
-			} else {
-				break
-			}
+	app.lock.Unlock()
+	for _, event := range events {
+		for _, handler := range app.linkHandlers {
+			handler(event)
 		}
 	}
-	fmt.Printf("ORDER: %+v", order)
-	return order
-}
-
-func (rplGraph RPLGraph) findLeaves() []addrtranslation.IPString {
-	leaves := make([]addrtranslation.IPString, 0)
-	for potentialLeaf := range rplGraph {
-		isLeaf := true
-		for _, childLink := range rplGraph {
-			notALeaf := childLink != nil && childLink.ParentIP == potentialLeaf
-			if notALeaf {
-				isLeaf = false
-				break
-			}
-		}
-		if isLeaf {
-			leaves = append(leaves, potentialLeaf)
-		}
+	if len(events) > 0 {
+		app.notify()
+	}
+	return events
+}
+
+// RunSweeper removes the expired links every `interval`, it never returns.
+func (app *ApplicationGraph) RunSweeper(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		app.Sweep(now)
 	}
-	return leaves
 }
 
-type RPLLink struct {
-	ParentIP    addrtranslation.IPString
-	ExpiredTime time.Time
+// Snapshot returns a copy of the links of the graph that are not expired,
+// which is not affected by the next updates.
+func (app *ApplicationGraph) Snapshot() RPLGraph {
+	app.lock.RLock()
+	defer app.lock.RUnlock()
+	return app.Graph.Active(time.Now())
 }
 
 type GraphTopologyUpdate struct {
-	ChildIP  net.IP
+	ChildIP  addrtranslation.IPString
 	ParentIP net.IP
 }
 
-func decodeGraphUpdateData(addr net.IP, data []byte) GraphTopologyUpdate {
+func decodeGraphUpdateData(addr addrtranslation.IPString, data []byte) (GraphTopologyUpdate, error) {
+	if len(data) < net.IPv6len {
+		return GraphTopologyUpdate{}, errors.New(fmt.Sprintf(
+			"the graph packet is malformed, it must contain the %d bytes IP address of the parent and the packet received is %d bytes long",
+			net.IPv6len, len(data)))
+	}
 	return GraphTopologyUpdate{
-		ParentIP: data[:16],
+		ParentIP: data[:net.IPv6len],
 		ChildIP:  addr,
-	}
+	}, nil
 }
@@ -0,0 +1,119 @@
+package applications
+
+import (
+	"scheduleupdater-server/addrtranslation"
+	"testing"
+	"time"
+)
+
+const (
+	graphRoot   = addrtranslation.IPString("fd00::201:1:1:1")
+	graphNode2  = addrtranslation.IPString("fd00::202:2:2:2")
+	graphNode3  = addrtranslation.IPString("fd00::203:3:3:3")
+	graphNode4  = addrtranslation.IPString("fd00::204:4:4:4")
+	graphNode5  = addrtranslation.IPString("fd00::205:5:5:5")
+	linkTimeout = time.Minute
+)
+
+// newTestApplicationGraph returns the graph 2->1, 3->2, 4->3, 5->1 whose links
+// expire at `expiredTime`, except the link of 5 which expires one lifetime
+// later.
+func newTestApplicationGraph(expiredTime time.Time) *ApplicationGraph {
+	app := NewApplicationGraph(5)
+	app.Graph[graphNode2] = &RPLLink{ParentIP: graphRoot, ExpiredTime: expiredTime}
+	app.Graph[graphNode3] = &RPLLink{ParentIP: graphNode2, ExpiredTime: expiredTime}
+	app.Graph[graphNode4] = &RPLLink{ParentIP: graphNode3, ExpiredTime: expiredTime}
+	app.Graph[graphNode5] = &RPLLink{ParentIP: graphRoot, ExpiredTime: expiredTime.Add(linkTimeout)}
+	return &app
+}
+
+func expectChange(t *testing.T, app *ApplicationGraph, expected bool) {
+	t.Helper()
+	select {
+	case <-app.Changes():
+		if !expected {
+			t.Fatal("the graph signaled a change")
+		}
+	default:
+		if expected {
+			t.Fatal("the graph did not signal the change")
+		}
+	}
+}
+
+func expectChildren(t *testing.T, app *ApplicationGraph, expected ...addrtranslation.IPString) {
+	t.Helper()
+	if len(app.Graph) != len(expected) {
+		t.Fatalf("got the graph %v, expected the links of %v", app.Graph, expected)
+	}
+	for _, child := range expected {
+		if _, in := app.Graph[child]; !in {
+			t.Fatalf("got the graph %v, expected the links of %v", app.Graph, expected)
+		}
+	}
+}
+
+func TestApplicationGraphSweepRemovesTheExpiredLinks(t *testing.T) {
+	start := time.Now()
+	app := newTestApplicationGraph(start.Add(linkTimeout))
+	expired := make([]LinkEvent, 0)
+	app.OnLinkExpired(func(event LinkEvent) {
+		expired = append(expired, event)
+	})
+
+	// No link expired yet
+	if events := app.Sweep(start); len(events) != 0 {
+		t.Fatalf("the links %v expired before their lifetime", events)
+	}
+	expectChildren(t, app, graphNode2, graphNode3, graphNode4, graphNode5)
+	expectChange(t, app, false)
+
+	// The links of 2, 3 and 4 expire, the link of 5 is still alive
+	end := start.Add(linkTimeout)
+	events := app.Sweep(end)
+	if len(events) != 3 || len(expired) != 3 {
+		t.Fatalf("got the events %v and the handled events %v, expected the 3 expired links", events, expired)
+	}
+	parents := map[addrtranslation.IPString]addrtranslation.IPString{
+		graphNode2: graphRoot,
+		graphNode3: graphNode2,
+		graphNode4: graphNode3,
+	}
+	for _, event := range expired {
+		if parent, in := parents[event.ChildIP]; !in || event.ParentIP != parent || !event.Time.Equal(end) {
+			t.Fatalf("the event %v does not match an expired link", event)
+		}
+		delete(parents, event.ChildIP)
+	}
+	expectChildren(t, app, graphNode5)
+	expectChange(t, app, true)
+
+	// The expired links are removed only once
+	if events := app.Sweep(end); len(events) != 0 {
+		t.Fatalf("the links %v expired twice", events)
+	}
+	expectChange(t, app, false)
+}
+
+func TestApplicationGraphLinksWithoutLifetimeNeverExpire(t *testing.T) {
+	app := newTestApplicationGraph(time.Time{})
+	delete(app.Graph, graphNode5)
+	if events := app.Sweep(time.Now().Add(1000 * linkTimeout)); len(events) != 0 {
+		t.Fatalf("the links %v without lifetime expired", events)
+	}
+	expectChildren(t, app, graphNode2, graphNode3, graphNode4)
+}
+
+func TestApplicationGraphForgetRemovesTheLinksOfTheChildren(t *testing.T) {
+	app := newTestApplicationGraph(time.Now().Add(linkTimeout))
+
+	// 3 left: its link and the link of its child 4 are removed, the child
+	// adds its link back when it reports its new parent
+	app.Forget(graphNode3)
+	expectChildren(t, app, graphNode2, graphNode5)
+	expectChange(t, app, true)
+
+	// A node without any link is not a change
+	app.Forget(graphNode3)
+	expectChange(t, app, false)
+}
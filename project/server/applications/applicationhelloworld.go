@@ -18,7 +18,8 @@ func (app ApplicationHelloWorld) Type() AppType {
 	return AppTypeHelloWorld
 }
 
-func (app ApplicationHelloWorld) ProcessPacket(addr *net.UDPAddr, packet []byte) {
+func (app ApplicationHelloWorld) ProcessPacket(addr net.Addr, packet []byte) error {
 	addrIP := addrtranslation.AddrToIPString(addr)
 	log.Printf("Received an hello world packet from: %s with content: %+v", addrIP, packet)
+	return nil
 }
@@ -12,14 +12,16 @@ import (
 // ApplicationTopology gathers the topology of the network. The topology, in this case,
 // is the neighbors of the nodes.
 type ApplicationTopology struct {
+	ChangeNotifier
 	Topology Topology
 	nClient  uint
 }
 
 func NewApplicationTopology(nClients uint) ApplicationTopology {
 	return ApplicationTopology{
-		Topology: newTopology(),
-		nClient:  nClients,
+		ChangeNotifier: newChangeNotifier(),
+		Topology:       NewTopology(),
+		nClient:        nClients,
 	}
 }
 
@@ -27,22 +29,62 @@ func (app *ApplicationTopology) Type() AppType {
 	return AppTypeTopology
 }
 
-func (app *ApplicationTopology) ProcessPacket(addr *net.UDPAddr, packet []byte) {
+func (app *ApplicationTopology) ProcessPacket(addr net.Addr, packet []byte) error {
 	addrIP := addrtranslation.AddrToIPString(addr)
 	topologyPacket, err := decodeTopologyPacket(packet)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
-	app.Topology.SetNeighbors(addrIP, topologyPacket)
+	if app.Topology.SetNeighbors(addrIP, topologyPacket) {
+		app.notify()
+	}
+	return nil
+}
+
+func (app *ApplicationTopology) ProcessDecoded(addr net.Addr, decoded interface{}) error {
+	topologyPacket, ok := decoded.(*TopologyPacket)
+	if !ok {
+		return errors.New(fmt.Sprintf("a topology packet was expected instead of %T", decoded))
+	}
+	if app.Topology.SetNeighbors(addrtranslation.AddrToIPString(addr), topologyPacket) {
+		app.notify()
+	}
+	return nil
 }
 
 func (app *ApplicationTopology) Ready() bool {
+	app.Topology.lock.RLock()
+	defer app.Topology.lock.RUnlock()
 	return len(app.Topology.TopologyMap) == int(app.nClient)
 }
 
+// ReadyFor reports whether every node of `nodes` sent its neighbors.
+func (app *ApplicationTopology) ReadyFor(nodes []addrtranslation.IPString) bool {
+	app.Topology.lock.RLock()
+	defer app.Topology.lock.RUnlock()
+	for _, node := range nodes {
+		if _, in := app.Topology.TopologyMap[node]; !in {
+			return false
+		}
+	}
+	return true
+}
+
+// Forget removes the neighbors and the MAC address of a node that left the
+// network, so that the node can come back with another address.
+func (app *ApplicationTopology) Forget(addrIP addrtranslation.IPString) {
+	app.Topology.lock.Lock()
+	defer app.Topology.lock.Unlock()
+	app.Topology.MacIPTranslation.Remove(addrIP)
+	if _, in := app.Topology.TopologyMap[addrIP]; in {
+		delete(app.Topology.TopologyMap, addrIP)
+		app.notify()
+	}
+}
+
 func decodeTopologyPacket(packet []byte) (*TopologyPacket, error) {
 	const macSize = 8
-	if len(packet)%8 != 0 {
+	if len(packet) == 0 || len(packet)%8 != 0 {
 		return nil, errors.New(
 			fmt.Sprintf("the length of a Topology packet should be a multiple of %d"+
 				" since each MAC addr is represented with %d bytes, currently the length is %d", macSize, macSize, len(packet)))
@@ -69,7 +111,7 @@ type Topology struct {
 	lock             sync.RWMutex
 }
 
-func newTopology() Topology {
+func NewTopology() Topology {
 	return Topology{
 		TopologyMap:      map[addrtranslation.IPString][]*addrtranslation.MacAddr{},
 		MacIPTranslation: addrtranslation.NewMacIPTranslation(),
@@ -77,11 +119,51 @@ func newTopology() Topology {
 	}
 }
 
-func (topology *Topology) SetNeighbors(addrIP addrtranslation.IPString, packet *TopologyPacket) {
+// SetNeighbors records the neighbors reported by `addrIP` and returns whether
+// they differ from the neighbors previously reported.
+func (topology *Topology) SetNeighbors(addrIP addrtranslation.IPString, packet *TopologyPacket) bool {
 	topology.lock.Lock()
 	defer topology.lock.Unlock()
+	previous, in := topology.TopologyMap[addrIP]
 	topology.TopologyMap[addrIP] = packet.Neighbors
-	topology.MacIPTranslation.Add(packet.MoteAddr, addrIP)
+	if err := topology.MacIPTranslation.Add(*packet.MoteAddr, addrIP); err != nil {
+		log.Println("Conflicting addresses:", err)
+	}
+	return !in || !sameNeighbors(previous, packet.Neighbors)
+}
+
+// sameNeighbors compares two lists of neighbors regardless of their order.
+func sameNeighbors(a []*addrtranslation.MacAddr, b []*addrtranslation.MacAddr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[addrtranslation.MacAddr]int, len(a))
+	for _, neighbor := range a {
+		counts[*neighbor]++
+	}
+	for _, neighbor := range b {
+		counts[*neighbor]--
+		if counts[*neighbor] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Snapshot returns a copy of the topology, which is not affected by the next
+// reports. The MacIPTranslation is shared, it is safe for concurrent use.
+func (topology *Topology) Snapshot() Topology {
+	topology.lock.RLock()
+	defer topology.lock.RUnlock()
+	topologyMap := make(map[addrtranslation.IPString][]*addrtranslation.MacAddr, len(topology.TopologyMap))
+	for addrIP, neighbors := range topology.TopologyMap {
+		topologyMap[addrIP] = append([]*addrtranslation.MacAddr{}, neighbors...)
+	}
+	return Topology{
+		TopologyMap:      topologyMap,
+		MacIPTranslation: topology.MacIPTranslation,
+		lock:             sync.RWMutex{},
+	}
 }
 
 func (topology *Topology) ClearNeighbors(addrIP addrtranslation.IPString) {
@@ -0,0 +1,21 @@
+package applications
+
+import (
+	"scheduleupdater-server/addrtranslation"
+	"testing"
+)
+
+func TestApplicationTopologyForgetsTheAddresses(t *testing.T) {
+	app := NewApplicationTopology(1)
+	mac := addrtranslation.MacAddr{0, 2, 0, 2, 0, 2, 0, 2}
+	app.Topology.SetNeighbors("fd00::202:2:2:2", &TopologyPacket{MoteAddr: &mac})
+	app.Forget("fd00::202:2:2:2")
+	if ip, in := app.Topology.MacIPTranslation.Find(mac); in {
+		t.Fatalf("%v still has the address %s", mac, ip)
+	}
+	// The node comes back in another prefix
+	app.Topology.SetNeighbors("fd01::202:2:2:2", &TopologyPacket{MoteAddr: &mac})
+	if ip, _ := app.Topology.MacIPTranslation.Find(mac); ip != "fd01::202:2:2:2" {
+		t.Errorf("%v has the address %s, expected fd01::202:2:2:2", mac, ip)
+	}
+}
@@ -0,0 +1,26 @@
+package applications
+
+// ChangeNotifier signals the changes of the information gathered by an
+// application that may require a new schedule. The reports repeating the same
+// information are not changes.
+type ChangeNotifier struct {
+	changed chan struct{}
+}
+
+func newChangeNotifier() ChangeNotifier {
+	return ChangeNotifier{changed: make(chan struct{}, 1)}
+}
+
+func (notifier *ChangeNotifier) notify() {
+	select {
+	case notifier.changed <- struct{}{}:
+	default:
+		// A change is already pending, the changes are merged
+	}
+}
+
+// Changes returns the channel receiving a value after a change. The changes
+// happening before the value is received are merged into a single one.
+func (notifier *ChangeNotifier) Changes() <-chan struct{} {
+	return notifier.changed
+}
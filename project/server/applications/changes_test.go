@@ -0,0 +1,55 @@
+package applications
+
+import (
+	"net"
+	"testing"
+)
+
+func TestChangeNotifierMergesThePendingChanges(t *testing.T) {
+	notifier := newChangeNotifier()
+	select {
+	case <-notifier.Changes():
+		t.Fatal("a change was received before any notification")
+	default:
+	}
+	for i := 0; i < 3; i++ {
+		notifier.notify()
+	}
+	received := 0
+	for done := false; !done; {
+		select {
+		case <-notifier.Changes():
+			received++
+		default:
+			done = true
+		}
+	}
+	if received != 1 {
+		t.Fatalf("received %d changes for 3 merged notifications, expected 1", received)
+	}
+	notifier.notify()
+	select {
+	case <-notifier.Changes():
+	default:
+		t.Fatal("the change after the received one was lost")
+	}
+}
+
+func TestRepeatedReportsAreNotChanges(t *testing.T) {
+	app := NewApplicationBandwidth(1)
+	addr := &net.UDPAddr{IP: net.ParseIP("fd00::202:2:2:2")}
+	app.ProcessPacket(addr, []byte{2})
+	<-app.Changes()
+	app.ProcessPacket(addr, []byte{2})
+	select {
+	case <-app.Changes():
+		t.Fatal("the same bandwidth reported again is a change")
+	default:
+	}
+	app.ProcessPacket(addr, []byte{3})
+	select {
+	case <-app.Changes():
+	default:
+		t.Fatal("the new bandwidth is not a change")
+	}
+}
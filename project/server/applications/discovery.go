@@ -0,0 +1,157 @@
+package applications
+
+// Discovery: the server learns the nodes of the network from the packets they
+// send, instead of being given their addresses. A node joins when its first
+// packet is received and leaves when it has been silent for longer than the
+// liveness timeout.
+
+import (
+	"log"
+	"net"
+	"scheduleupdater-server/addrtranslation"
+	"sort"
+	"sync"
+	"time"
+)
+
+type NodeEventType int
+
+const (
+	NodeJoined NodeEventType = iota
+	NodeLeft
+)
+
+func (eventType NodeEventType) String() string {
+	if eventType == NodeJoined {
+		return "joined"
+	}
+	return "left"
+}
+
+// NodeEvent is the arrival or the departure of a node.
+type NodeEvent struct {
+	Type NodeEventType
+	IP   addrtranslation.IPString
+	Time time.Time
+}
+
+// Node is a node discovered from its packets.
+type Node struct {
+	IP        addrtranslation.IPString
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// Packets is the number of packets received from the node
+	Packets uint
+}
+
+// NodeDiscovery keeps track of the nodes sending packets to the server.
+type NodeDiscovery struct {
+	ChangeNotifier
+	nodes map[addrtranslation.IPString]*Node
+	// timeout is the silence after which a node leaves, 0 means that the
+	// nodes never leave
+	timeout  time.Duration
+	handlers []func(NodeEvent)
+	lock     sync.RWMutex
+}
+
+func NewNodeDiscovery(timeout time.Duration) *NodeDiscovery {
+	return &NodeDiscovery{
+		ChangeNotifier: newChangeNotifier(),
+		nodes:          make(map[addrtranslation.IPString]*Node),
+		timeout:        timeout,
+		lock:           sync.RWMutex{},
+	}
+}
+
+// OnEvent registers a function called on each NodeEvent. The functions must
+// be registered before the packets are observed.
+func (discovery *NodeDiscovery) OnEvent(handler func(NodeEvent)) *NodeDiscovery {
+	discovery.handlers = append(discovery.handlers, handler)
+	return discovery
+}
+
+// Observe returns a packet handler recording the source of each packet before
+// passing the packet to `handler`.
+func (discovery *NodeDiscovery) Observe(handler func(addr net.Addr, packet []byte)) func(addr net.Addr, packet []byte) {
+	return func(addr net.Addr, packet []byte) {
+		discovery.Seen(addrtranslation.AddrToIPString(addr), time.Now())
+		handler(addr, packet)
+	}
+}
+
+// Seen records a packet received from `addrIP` at `now`.
+func (discovery *NodeDiscovery) Seen(addrIP addrtranslation.IPString, now time.Time) {
+	discovery.lock.Lock()
+	node, in := discovery.nodes[addrIP]
+	if in {
+		node.LastSeen = now
+		node.Packets++
+		discovery.lock.Unlock()
+		return
+	}
+	discovery.nodes[addrIP] = &Node{IP: addrIP, FirstSeen: now, LastSeen: now, Packets: 1}
+	discovery.lock.Unlock()
+	discovery.emit(NodeEvent{Type: NodeJoined, IP: addrIP, Time: now})
+}
+
+// Sweep removes the nodes silent for longer than the timeout at `now` and
+// returns their NodeEvent.
+func (discovery *NodeDiscovery) Sweep(now time.Time) []NodeEvent {
+	events := make([]NodeEvent, 0)
+	if discovery.timeout == 0 {
+		return events
+	}
+	discovery.lock.Lock()
+	for addrIP, node := range discovery.nodes {
+		if now.Sub(node.LastSeen) > discovery.timeout {
+			delete(discovery.nodes, addrIP)
+			events = append(events, NodeEvent{Type: NodeLeft, IP: addrIP, Time: now})
+		}
+	}
+	discovery.lock.Unlock()
+	for _, event := range events {
+		discovery.emit(event)
+	}
+	return events
+}
+
+// RunSweeper sweeps the silent nodes every `interval`, it never returns.
+func (discovery *NodeDiscovery) RunSweeper(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		discovery.Sweep(now)
+	}
+}
+
+func (discovery *NodeDiscovery) emit(event NodeEvent) {
+	log.Println("Node", event.IP, event.Type)
+	for _, handler := range discovery.handlers {
+		handler(event)
+	}
+	discovery.notify()
+}
+
+// Nodes returns the nodes currently in the network, sorted by IP address.
+func (discovery *NodeDiscovery) Nodes() []Node {
+	discovery.lock.RLock()
+	defer discovery.lock.RUnlock()
+	nodes := make([]Node, 0, len(discovery.nodes))
+	for _, node := range discovery.nodes {
+		nodes = append(nodes, *node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].IP < nodes[j].IP
+	})
+	return nodes
+}
+
+// Addrs returns the IP addresses of the nodes currently in the network,
+// sorted.
+func (discovery *NodeDiscovery) Addrs() []addrtranslation.IPString {
+	nodes := discovery.Nodes()
+	addrs := make([]addrtranslation.IPString, len(nodes))
+	for i, node := range nodes {
+		addrs[i] = node.IP
+	}
+	return addrs
+}
@@ -0,0 +1,98 @@
+package applications
+
+import (
+	"net"
+	"scheduleupdater-server/addrtranslation"
+	"testing"
+	"time"
+)
+
+// recordEvents returns a discovery with the liveness `timeout` and the list
+// its events are appended to.
+func recordEvents(timeout time.Duration) (*NodeDiscovery, *[]NodeEvent) {
+	events := make([]NodeEvent, 0)
+	discovery := NewNodeDiscovery(timeout).OnEvent(func(event NodeEvent) {
+		events = append(events, event)
+	})
+	return discovery, &events
+}
+
+func expectEvents(t *testing.T, events []NodeEvent, expected ...NodeEventType) {
+	t.Helper()
+	if len(events) != len(expected) {
+		t.Fatalf("got the events %v, expected %v", events, expected)
+	}
+	for i, eventType := range expected {
+		if events[i].Type != eventType {
+			t.Fatalf("got the events %v, expected %v", events, expected)
+		}
+	}
+}
+
+func TestNodeDiscoveryJoinLeaveAndRejoin(t *testing.T) {
+	const timeout = time.Minute
+	const node = addrtranslation.IPString("fd00::202:2:2:2")
+	discovery, events := recordEvents(timeout)
+	start := time.Now()
+
+	// The node joins with its first packet
+	received := 0
+	observe := discovery.Observe(func(addr net.Addr, packet []byte) { received++ })
+	observe(&net.UDPAddr{IP: net.ParseIP(string(node))}, []byte{0})
+	expectEvents(t, *events, NodeJoined)
+	if (*events)[0].IP != node || received != 1 {
+		t.Fatalf("got the join %v and %d packets passed on, expected the join of %s and 1 packet", (*events)[0], received, node)
+	}
+	select {
+	case <-discovery.Changes():
+	default:
+		t.Fatal("the join is not a change")
+	}
+
+	// The next packets only keep it alive
+	discovery.Seen(node, start.Add(timeout/2))
+	expectEvents(t, *events, NodeJoined)
+	if nodes := discovery.Nodes(); len(nodes) != 1 || nodes[0].Packets != 2 || !nodes[0].LastSeen.Equal(start.Add(timeout/2)) {
+		t.Fatalf("got the nodes %+v, expected %s seen twice", nodes, node)
+	}
+	if left := discovery.Sweep(start.Add(timeout)); len(left) != 0 {
+		t.Fatalf("the nodes %v left before the timeout", left)
+	}
+
+	// The node leaves after being silent for longer than the timeout
+	left := discovery.Sweep(start.Add(timeout/2 + timeout + time.Second))
+	if len(left) != 1 || left[0].Type != NodeLeft || left[0].IP != node {
+		t.Fatalf("got the departures %v, expected the departure of %s", left, node)
+	}
+	expectEvents(t, *events, NodeJoined, NodeLeft)
+	if addrs := discovery.Addrs(); len(addrs) != 0 {
+		t.Fatalf("the nodes %v are still in the network", addrs)
+	}
+	select {
+	case <-discovery.Changes():
+	default:
+		t.Fatal("the departure is not a change")
+	}
+
+	// And joins again with its next packet
+	discovery.Seen(node, start.Add(2*timeout))
+	expectEvents(t, *events, NodeJoined, NodeLeft, NodeJoined)
+	if nodes := discovery.Nodes(); len(nodes) != 1 || nodes[0].Packets != 1 || !nodes[0].FirstSeen.Equal(start.Add(2*timeout)) {
+		t.Fatalf("got the nodes %+v, expected %s joining again", nodes, node)
+	}
+}
+
+func TestNodeDiscoveryWithoutTimeout(t *testing.T) {
+	discovery, events := recordEvents(0)
+	start := time.Now()
+	discovery.Seen("fd00::202:2:2:2", start)
+	discovery.Seen("fd00::203:3:3:3", start)
+	if left := discovery.Sweep(start.Add(24 * time.Hour)); len(left) != 0 {
+		t.Fatalf("the nodes %v left without liveness timeout", left)
+	}
+	expectEvents(t, *events, NodeJoined, NodeJoined)
+	addrs := discovery.Addrs()
+	if len(addrs) != 2 || addrs[0] != "fd00::202:2:2:2" || addrs[1] != "fd00::203:3:3:3" {
+		t.Fatalf("got the nodes %v, expected the 2 nodes sorted", addrs)
+	}
+}
@@ -0,0 +1,122 @@
+package applications
+
+// Registry: each AppType is registered with its name and the decoder of its
+// packets before applications can subscribe to it. The built-in AppTypes are
+// registered by NewAppDispatcher, the experiment specific applications
+// register theirs with AppDispatcher.Register.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"scheduleupdater-server/addrtranslation"
+	"sort"
+	"sync"
+)
+
+// MaxAppType is the largest AppType, the AppType is encoded in one byte.
+const MaxAppType AppType = 255
+
+// Decoder decodes a packet of an AppType received from `addr`. The packets
+// that cannot be decoded are rejected before being dispatched.
+type Decoder = func(addr net.Addr, packet []byte) (interface{}, error)
+
+// AppTypeInfo describes a registered AppType.
+type AppTypeInfo struct {
+	ID   AppType
+	Name string
+	// Decode is nil when the applications receive the raw packets
+	Decode Decoder
+}
+
+// DuplicateAppTypeError is returned when an AppType is registered twice.
+type DuplicateAppTypeError struct {
+	Registered AppTypeInfo
+	Duplicate  AppTypeInfo
+}
+
+func (err *DuplicateAppTypeError) Error() string {
+	if err.Registered.ID != err.Duplicate.ID {
+		return fmt.Sprintf("the name %s of the AppType %d is already used by the AppType %d", err.Duplicate.Name, err.Duplicate.ID, err.Registered.ID)
+	}
+	return fmt.Sprintf("the AppType %d of %s is already registered by %s", err.Duplicate.ID, err.Duplicate.Name, err.Registered.Name)
+}
+
+// AppTypeRegistry is the set of the registered AppTypes. It is safe for
+// concurrent use.
+type AppTypeRegistry struct {
+	types map[AppType]AppTypeInfo
+	lock  sync.RWMutex
+}
+
+func NewAppTypeRegistry() *AppTypeRegistry {
+	return &AppTypeRegistry{
+		types: make(map[AppType]AppTypeInfo),
+		lock:  sync.RWMutex{},
+	}
+}
+
+// Register adds an AppType, its ID and its name must not be registered yet.
+func (registry *AppTypeRegistry) Register(info AppTypeInfo) error {
+	if info.ID < 0 || info.ID > MaxAppType {
+		return errors.New(fmt.Sprintf("the AppType %d of %s does not fit in a byte", info.ID, info.Name))
+	}
+	if info.Name == "" {
+		return errors.New(fmt.Sprintf("the AppType %d has no name", info.ID))
+	}
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	for _, registered := range registry.types {
+		if registered.ID == info.ID || registered.Name == info.Name {
+			return &DuplicateAppTypeError{Registered: registered, Duplicate: info}
+		}
+	}
+	registry.types[info.ID] = info
+	return nil
+}
+
+// Lookup returns the AppTypeInfo of `appType`.
+func (registry *AppTypeRegistry) Lookup(appType AppType) (AppTypeInfo, bool) {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	info, in := registry.types[appType]
+	return info, in
+}
+
+// Name returns the name of `appType`, or its number when it is not registered.
+func (registry *AppTypeRegistry) Name(appType AppType) string {
+	if info, in := registry.Lookup(appType); in {
+		return info.Name
+	}
+	return fmt.Sprintf("AppType(%d)", int(appType))
+}
+
+// Types returns the registered AppTypes sorted by ID.
+func (registry *AppTypeRegistry) Types() []AppTypeInfo {
+	registry.lock.RLock()
+	types := make([]AppTypeInfo, 0, len(registry.types))
+	for _, info := range registry.types {
+		types = append(types, info)
+	}
+	registry.lock.RUnlock()
+	sort.Slice(types, func(i, j int) bool {
+		return types[i].ID < types[j].ID
+	})
+	return types
+}
+
+// builtinAppTypes are the AppTypes of common/application-type.h.
+func builtinAppTypes() []AppTypeInfo {
+	return []AppTypeInfo{
+		{ID: AppTypeGraph, Name: "AppTypeGraph", Decode: func(addr net.Addr, packet []byte) (interface{}, error) {
+			return decodeGraphUpdateData(addrtranslation.AddrToIPString(addr), packet)
+		}},
+		{ID: AppTypeTopology, Name: "AppTypeTopology", Decode: func(addr net.Addr, packet []byte) (interface{}, error) {
+			return decodeTopologyPacket(packet)
+		}},
+		{ID: AppTypeBandwidth, Name: "AppTypeBandwidth", Decode: func(addr net.Addr, packet []byte) (interface{}, error) {
+			return decodeBandwith(packet)
+		}},
+		{ID: AppTypeHelloWorld, Name: "AppTypeHelloWorld"},
+	}
+}
@@ -0,0 +1,39 @@
+package applications
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAppTypeRegistryRejectsDuplicates(t *testing.T) {
+	registry := NewAppTypeRegistry()
+	for _, info := range builtinAppTypes() {
+		if err := registry.Register(info); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name string
+		info AppTypeInfo
+	}{
+		{"duplicate ID", AppTypeInfo{ID: AppTypeBandwidth, Name: "AppTypeExperiment"}},
+		{"duplicate name", AppTypeInfo{ID: 42, Name: "AppTypeBandwidth"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var duplicate *DuplicateAppTypeError
+			if err := registry.Register(test.info); !errors.As(err, &duplicate) {
+				t.Fatalf("got the error %v, expected a DuplicateAppTypeError", err)
+			}
+			if duplicate.Registered.ID != AppTypeBandwidth || duplicate.Duplicate.ID != test.info.ID || duplicate.Duplicate.Name != test.info.Name {
+				t.Errorf("the error %v does not describe the AppTypes", duplicate)
+			}
+		})
+	}
+	if err := registry.Register(AppTypeInfo{ID: 42, Name: "AppTypeExperiment"}); err != nil {
+		t.Error(err)
+	}
+	if name := registry.Name(AppTypeBandwidth); name != "AppTypeBandwidth" {
+		t.Errorf("the AppTypeBandwidth is named %s", name)
+	}
+}
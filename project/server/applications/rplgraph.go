@@ -0,0 +1,343 @@
+package applications
+
+// RPLGraph: the links reported by the nodes toward their RPL parent. The
+// reports are not always consistent: the parents may form a cycle while RPL
+// repairs the DODAG, and a subtree may be cut from the root when a link
+// expires. The queries detect these cases and report them as a *GraphError.
+
+import (
+	"scheduleupdater-server/addrtranslation"
+	"sort"
+	"strings"
+	"time"
+)
+
+type RPLGraph map[addrtranslation.IPString]*RPLLink
+
+type RPLLink struct {
+	ParentIP addrtranslation.IPString
+	// ExpiredTime is the time at which the link expires, the zero time means
+	// that the link never expires
+	ExpiredTime time.Time
+}
+
+// Expired reports whether the link is expired at `now`.
+func (link *RPLLink) Expired(now time.Time) bool {
+	return !link.ExpiredTime.IsZero() && !now.Before(link.ExpiredTime)
+}
+
+type GraphErrorKind int
+
+const (
+	// The graph has no root, it is empty or all its nodes are in cycles
+	GraphErrorNoRoot GraphErrorKind = iota
+	// The parents of the nodes form a cycle
+	GraphErrorCycle
+	// The nodes do not reach the root
+	GraphErrorOrphan
+)
+
+func (kind GraphErrorKind) String() string {
+	return [...]string{"no root", "cycle", "orphan"}[kind]
+}
+
+// GraphError is an inconsistency of the RPL graph.
+type GraphError struct {
+	Kind GraphErrorKind
+	// Nodes are the nodes of the cycle in the parent order, or the orphan nodes
+	Nodes []addrtranslation.IPString
+}
+
+func (err *GraphError) Error() string {
+	nodes := make([]string, len(err.Nodes))
+	for i, node := range err.Nodes {
+		nodes[i] = string(node)
+	}
+	switch err.Kind {
+	case GraphErrorCycle:
+		return "the RPL graph contains a cycle: " + strings.Join(nodes, " -> ")
+	case GraphErrorOrphan:
+		return "the RPL graph contains nodes that do not reach the root: " + strings.Join(nodes, ", ")
+	}
+	return "the RPL graph has no root"
+}
+
+// graphAnalysis is the structure of an RPLGraph computed in a single pass.
+type graphAnalysis struct {
+	children map[addrtranslation.IPString][]addrtranslation.IPString
+	// top is the last ancestor of each node outside the cycles
+	top map[addrtranslation.IPString]addrtranslation.IPString
+	// depth is the number of hops from each node outside the cycles to its top
+	depth   map[addrtranslation.IPString]int
+	cycles  [][]addrtranslation.IPString
+	inCycle map[addrtranslation.IPString]bool
+}
+
+func (rplGraph RPLGraph) analyze() *graphAnalysis {
+	analysis := &graphAnalysis{
+		children: make(map[addrtranslation.IPString][]addrtranslation.IPString),
+		top:      make(map[addrtranslation.IPString]addrtranslation.IPString),
+		depth:    make(map[addrtranslation.IPString]int),
+		inCycle:  make(map[addrtranslation.IPString]bool),
+	}
+	for _, child := range rplGraph.nodesWithParent() {
+		parent := rplGraph[child].ParentIP
+		analysis.children[parent] = append(analysis.children[parent], child)
+	}
+	// Each node is walked once: the walk up from a node stops at the first
+	// node already analyzed, or in the walk itself when there is a cycle
+	inWalk := make(map[addrtranslation.IPString]int)
+	for _, start := range rplGraph.nodesWithParent() {
+		walk := make([]addrtranslation.IPString, 0)
+		node := start
+		for {
+			if _, done := analysis.depth[node]; done || analysis.inCycle[node] {
+				break
+			}
+			if index, in := inWalk[node]; in {
+				cycle := append([]addrtranslation.IPString{}, walk[index:]...)
+				for _, cycleNode := range cycle {
+					analysis.inCycle[cycleNode] = true
+					delete(inWalk, cycleNode)
+				}
+				analysis.cycles = append(analysis.cycles, cycle)
+				walk = walk[:index]
+				break
+			}
+			link, in := rplGraph[node]
+			if !in || link == nil {
+				analysis.top[node] = node
+				analysis.depth[node] = 0
+				break
+			}
+			inWalk[node] = len(walk)
+			walk = append(walk, node)
+			node = link.ParentIP
+		}
+		// The nodes of the walk hang below `node`, or below a cycle
+		for i := len(walk) - 1; i >= 0; i-- {
+			delete(inWalk, walk[i])
+			parent := rplGraph[walk[i]].ParentIP
+			if analysis.inCycle[parent] {
+				analysis.inCycle[walk[i]] = true
+				continue
+			}
+			analysis.top[walk[i]] = analysis.top[parent]
+			analysis.depth[walk[i]] = analysis.depth[parent] + 1
+		}
+	}
+	return analysis
+}
+
+// nodesWithParent returns the nodes that have a link, sorted.
+func (rplGraph RPLGraph) nodesWithParent() []addrtranslation.IPString {
+	nodes := make([]addrtranslation.IPString, 0, len(rplGraph))
+	for node, link := range rplGraph {
+		if link != nil {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i] < nodes[j] })
+	return nodes
+}
+
+// Roots returns the nodes that are the parent of a node but have no parent,
+// sorted. A consistent graph has a single root, the border router.
+func (rplGraph RPLGraph) Roots() []addrtranslation.IPString {
+	analysis := rplGraph.analyze()
+	return analysis.roots()
+}
+
+func (analysis *graphAnalysis) roots() []addrtranslation.IPString {
+	roots := make([]addrtranslation.IPString, 0)
+	for node, top := range analysis.top {
+		if node == top {
+			roots = append(roots, node)
+		}
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i] < roots[j] })
+	return roots
+}
+
+// Root returns the root of the graph. When some subtrees are cut from the
+// root, the root is the top of the largest tree.
+func (rplGraph RPLGraph) Root() (addrtranslation.IPString, error) {
+	return rplGraph.analyze().root()
+}
+
+func (analysis *graphAnalysis) root() (addrtranslation.IPString, error) {
+	sizes := make(map[addrtranslation.IPString]int)
+	for _, top := range analysis.top {
+		sizes[top]++
+	}
+	root := addrtranslation.IPString("")
+	for _, candidate := range analysis.roots() {
+		if root == "" || sizes[candidate] > sizes[root] {
+			root = candidate
+		}
+	}
+	if root == "" {
+		return "", &GraphError{Kind: GraphErrorNoRoot}
+	}
+	return root, nil
+}
+
+// IsRoot reports whether `node` is the root of the graph.
+func (rplGraph RPLGraph) IsRoot(node addrtranslation.IPString) bool {
+	root, err := rplGraph.Root()
+	return err == nil && root == node
+}
+
+// PathToRoot returns the nodes from `node` to the root, both included.
+func (rplGraph RPLGraph) PathToRoot(node addrtranslation.IPString) ([]addrtranslation.IPString, error) {
+	analysis := rplGraph.analyze()
+	if analysis.inCycle[node] {
+		return nil, analysis.cycleError(node, rplGraph)
+	}
+	path := []addrtranslation.IPString{node}
+	for link, in := rplGraph[node]; in && link != nil; link, in = rplGraph[link.ParentIP] {
+		path = append(path, link.ParentIP)
+	}
+	root, err := analysis.root()
+	if err != nil {
+		return nil, err
+	}
+	if path[len(path)-1] != root {
+		return nil, &GraphError{Kind: GraphErrorOrphan, Nodes: analysis.subtree(path[len(path)-1])}
+	}
+	return path, nil
+}
+
+// Depth returns the number of hops from `node` to the root.
+func (rplGraph RPLGraph) Depth(node addrtranslation.IPString) (int, error) {
+	path, err := rplGraph.PathToRoot(node)
+	if err != nil {
+		return 0, err
+	}
+	return len(path) - 1, nil
+}
+
+// cycleError returns the error of the cycle reached from `node`.
+func (analysis *graphAnalysis) cycleError(node addrtranslation.IPString, rplGraph RPLGraph) *GraphError {
+	for {
+		for _, cycle := range analysis.cycles {
+			for _, cycleNode := range cycle {
+				if cycleNode == node {
+					return &GraphError{Kind: GraphErrorCycle, Nodes: cycle}
+				}
+			}
+		}
+		node = rplGraph[node].ParentIP
+	}
+}
+
+// Children returns the nodes whose parent is `node`, sorted.
+func (rplGraph RPLGraph) Children(node addrtranslation.IPString) []addrtranslation.IPString {
+	children := make([]addrtranslation.IPString, 0)
+	for _, child := range rplGraph.nodesWithParent() {
+		if rplGraph[child].ParentIP == node {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+// Subtree returns `node` and its descendants, sorted.
+func (rplGraph RPLGraph) Subtree(node addrtranslation.IPString) []addrtranslation.IPString {
+	return rplGraph.analyze().subtree(node)
+}
+
+func (analysis *graphAnalysis) subtree(node addrtranslation.IPString) []addrtranslation.IPString {
+	subtree := []addrtranslation.IPString{node}
+	visited := map[addrtranslation.IPString]bool{node: true}
+	for i := 0; i < len(subtree); i++ {
+		for _, child := range analysis.children[subtree[i]] {
+			if !visited[child] {
+				visited[child] = true
+				subtree = append(subtree, child)
+			}
+		}
+	}
+	sort.Slice(subtree, func(i, j int) bool { return subtree[i] < subtree[j] })
+	return subtree
+}
+
+// DescendantsCount returns the number of nodes below `node`.
+func (rplGraph RPLGraph) DescendantsCount(node addrtranslation.IPString) int {
+	return len(rplGraph.Subtree(node)) - 1
+}
+
+// CheckCycles returns a *GraphError when the parents form a cycle.
+func (rplGraph RPLGraph) CheckCycles() error {
+	analysis := rplGraph.analyze()
+	if len(analysis.cycles) > 0 {
+		return &GraphError{Kind: GraphErrorCycle, Nodes: analysis.cycles[0]}
+	}
+	return nil
+}
+
+// Check returns a *GraphError when the parents form a cycle or when some
+// nodes do not reach the root.
+func (rplGraph RPLGraph) Check() error {
+	analysis := rplGraph.analyze()
+	if len(analysis.cycles) > 0 {
+		return &GraphError{Kind: GraphErrorCycle, Nodes: analysis.cycles[0]}
+	}
+	root, err := analysis.root()
+	if err != nil {
+		if len(rplGraph) == 0 {
+			return nil
+		}
+		return err
+	}
+	orphans := make([]addrtranslation.IPString, 0)
+	for node, top := range analysis.top {
+		if top != root {
+			orphans = append(orphans, node)
+		}
+	}
+	if len(orphans) > 0 {
+		sort.Slice(orphans, func(i, j int) bool { return orphans[i] < orphans[j] })
+		return &GraphError{Kind: GraphErrorOrphan, Nodes: orphans}
+	}
+	return nil
+}
+
+// Active returns a copy of the graph without the links expired at `now`.
+func (rplGraph RPLGraph) Active(now time.Time) RPLGraph {
+	graph := make(RPLGraph, len(rplGraph))
+	for childIP, link := range rplGraph {
+		if link != nil && !link.Expired(now) {
+			linkCopy := *link
+			graph[childIP] = &linkCopy
+		}
+	}
+	return graph
+}
+
+// LeavesToRootOrder returns an ordered list of IP addresses. The list is ordered in a way
+// that the leaves are first and then the following addresses are their ancestors up to the root
+// of the RPL tree. The expired links are ignored, and the nodes in a cycle,
+// which have no such order, come last.
+func (rplGraph RPLGraph) LeavesToRootOrder() []addrtranslation.IPString {
+	rplGraph = rplGraph.Active(time.Now())
+	analysis := rplGraph.analyze()
+	order := make([]addrtranslation.IPString, 0, len(analysis.depth)+len(analysis.inCycle))
+	for node := range analysis.depth {
+		order = append(order, node)
+	}
+	// The deepest nodes first, each node comes after all its descendants
+	sort.Slice(order, func(i, j int) bool {
+		if analysis.depth[order[i]] != analysis.depth[order[j]] {
+			return analysis.depth[order[i]] > analysis.depth[order[j]]
+		}
+		return order[i] < order[j]
+	})
+	inCycle := make([]addrtranslation.IPString, 0, len(analysis.inCycle))
+	for node := range analysis.inCycle {
+		inCycle = append(inCycle, node)
+	}
+	sort.Slice(inCycle, func(i, j int) bool { return inCycle[i] < inCycle[j] })
+	order = append(order, inCycle...)
+	return order
+}
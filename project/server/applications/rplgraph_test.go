@@ -0,0 +1,138 @@
+package applications
+
+import (
+	"errors"
+	"reflect"
+	"scheduleupdater-server/addrtranslation"
+	"strings"
+	"testing"
+)
+
+// newTestGraph returns the RPLGraph of the links `child:parent`.
+func newTestGraph(links ...string) RPLGraph {
+	graph := make(RPLGraph)
+	for _, link := range links {
+		nodes := strings.Split(link, ":")
+		graph[addrtranslation.IPString(nodes[0])] = &RPLLink{ParentIP: addrtranslation.IPString(nodes[1])}
+	}
+	return graph
+}
+
+func testNodes(nodes ...string) []addrtranslation.IPString {
+	ips := make([]addrtranslation.IPString, len(nodes))
+	for i, node := range nodes {
+		ips[i] = addrtranslation.IPString(node)
+	}
+	return ips
+}
+
+// The tree a <- b <- {c <- e, d}, with the cycle x -> y -> z -> x and w below
+// it, and the orphan subtree p <- o.
+var treeLinks = []string{"b:a", "c:b", "d:b", "e:c"}
+var cycleLinks = []string{"x:y", "y:z", "z:x", "w:x"}
+var orphanLinks = []string{"o:p"}
+
+func TestRPLGraphPathToRoot(t *testing.T) {
+	tests := []struct {
+		name  string
+		links []string
+		node  string
+		path  []addrtranslation.IPString
+		kind  GraphErrorKind
+		nodes []addrtranslation.IPString
+	}{
+		{"leaf", treeLinks, "e", testNodes("e", "c", "b", "a"), 0, nil},
+		{"root", treeLinks, "a", testNodes("a"), 0, nil},
+		{"below a cycle", append(treeLinks, cycleLinks...), "w", nil, GraphErrorCycle, testNodes("x", "y", "z")},
+		{"in a cycle", append(treeLinks, cycleLinks...), "y", nil, GraphErrorCycle, testNodes("x", "y", "z")},
+		{"orphan", append(treeLinks, orphanLinks...), "o", nil, GraphErrorOrphan, testNodes("o", "p")},
+		{"beside an orphan", append(treeLinks, orphanLinks...), "d", testNodes("d", "b", "a"), 0, nil},
+		{"only a cycle", cycleLinks[:3], "x", nil, GraphErrorCycle, testNodes("x", "y", "z")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			graph := newTestGraph(test.links...)
+			path, err := graph.PathToRoot(addrtranslation.IPString(test.node))
+			if test.path != nil {
+				if err != nil || !reflect.DeepEqual(path, test.path) {
+					t.Errorf("got the path %v and the error %v, expected the path %v", path, err, test.path)
+				}
+				depth, err := graph.Depth(addrtranslation.IPString(test.node))
+				if err != nil || depth != len(test.path)-1 {
+					t.Errorf("got the depth %d and the error %v, expected the depth %d", depth, err, len(test.path)-1)
+				}
+				return
+			}
+			var graphErr *GraphError
+			if !errors.As(err, &graphErr) || graphErr.Kind != test.kind || !reflect.DeepEqual(graphErr.Nodes, test.nodes) {
+				t.Errorf("got the path %v and the error %v, expected a %s error on %v", path, err, test.kind, test.nodes)
+			}
+		})
+	}
+}
+
+func TestRPLGraphCheck(t *testing.T) {
+	tests := []struct {
+		name  string
+		links []string
+		err   *GraphError
+	}{
+		{"empty", nil, nil},
+		{"tree", treeLinks, nil},
+		{"cycle", append(treeLinks, cycleLinks...), &GraphError{Kind: GraphErrorCycle, Nodes: testNodes("x", "y", "z")}},
+		{"orphan", append(treeLinks, orphanLinks...), &GraphError{Kind: GraphErrorOrphan, Nodes: testNodes("o", "p")}},
+		{"cycle and orphan", append(append(treeLinks, orphanLinks...), cycleLinks...), &GraphError{Kind: GraphErrorCycle, Nodes: testNodes("x", "y", "z")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := newTestGraph(test.links...).Check()
+			if test.err == nil {
+				if err != nil {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+			if !reflect.DeepEqual(err, test.err) {
+				t.Errorf("got the error %v, expected %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestRPLGraphSubtree(t *testing.T) {
+	graph := newTestGraph(append(append(treeLinks, orphanLinks...), cycleLinks...)...)
+	tests := []struct {
+		node    string
+		subtree []addrtranslation.IPString
+	}{
+		{"a", testNodes("a", "b", "c", "d", "e")},
+		{"b", testNodes("b", "c", "d", "e")},
+		{"e", testNodes("e")},
+		{"p", testNodes("o", "p")},
+		{"x", testNodes("w", "x", "y", "z")},
+	}
+	for _, test := range tests {
+		subtree := graph.Subtree(addrtranslation.IPString(test.node))
+		if !reflect.DeepEqual(subtree, test.subtree) {
+			t.Errorf("the subtree of %s is %v, expected %v", test.node, subtree, test.subtree)
+		}
+		if count := graph.DescendantsCount(addrtranslation.IPString(test.node)); count != len(test.subtree)-1 {
+			t.Errorf("%s has %d descendants, expected %d", test.node, count, len(test.subtree)-1)
+		}
+	}
+	if root, err := graph.Root(); err != nil || root != "a" {
+		t.Errorf("got the root %s and the error %v, expected a", root, err)
+	}
+	if roots := graph.Roots(); !reflect.DeepEqual(roots, testNodes("a", "p")) {
+		t.Errorf("got the roots %v, expected [a p]", roots)
+	}
+}
+
+func TestRPLGraphLeavesToRootOrder(t *testing.T) {
+	graph := newTestGraph(append(append(treeLinks, orphanLinks...), cycleLinks...)...)
+	order := graph.LeavesToRootOrder()
+	expected := testNodes("e", "c", "d", "b", "o", "a", "p", "w", "x", "y", "z")
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("got the order %v, expected %v", order, expected)
+	}
+}
@@ -0,0 +1,343 @@
+package emulator
+
+import (
+	"errors"
+	"math"
+	"net"
+	"os"
+	"reflect"
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/applications"
+	"scheduleupdater-server/scheduleupdater"
+	"scheduleupdater-server/udpack"
+	"scheduleupdater-server/utils"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	utils.NewLogger(utils.LogLevelError, utils.WHITE)
+	os.Exit(m.Run())
+}
+
+// scheduleOneCellPerLink gives each mote one TX cell toward its RPL parent on
+// the channel offset `channel`.
+func scheduleOneCellPerLink(graph *applications.RPLGraph, topology *applications.Topology, channel uint16) (scheduleupdater.Schedule, error) {
+	schedule := scheduleupdater.NewSchedule(scheduleupdater.NewDefaultSlotframeGeometry())
+	timeslot := uint16(1)
+	for mote, link := range *graph {
+		moteMac, ok := topology.MacIPTranslation.FindMac(mote)
+		if !ok {
+			return scheduleupdater.Schedule{}, os.ErrNotExist
+		}
+		parentMac, ok := topology.MacIPTranslation.FindMac(link.ParentIP)
+		if !ok {
+			return scheduleupdater.Schedule{}, os.ErrNotExist
+		}
+		schedule.AddCell(mote, parentMac, &scheduleupdater.Cell{LinkOptions: scheduleupdater.LinkOptionTX, TimeSlot: timeslot, Channel: channel})
+		schedule.AddCell(link.ParentIP, moteMac, &scheduleupdater.Cell{LinkOptions: scheduleupdater.LinkOptionRX, TimeSlot: timeslot, Channel: channel})
+		timeslot++
+	}
+	return schedule, nil
+}
+
+// testEmulation is a server receiving the reports of motes in a line through
+// the applications, as the main program does.
+type testEmulation struct {
+	motes    []*Mote
+	addrs    []addrtranslation.IPString
+	server   *udpack.UDPAckConn
+	graph    applications.RPLGraph
+	topology applications.Topology
+}
+
+// startTestEmulation starts `motesCount` motes in a line and waits until the
+// applications know the whole network. The connection of the server is
+// wrapped with `wrapConn` when it is not nil.
+func startTestEmulation(t *testing.T, network *Network, motesCount uint, config *udpack.UDPAckConnSendConfig, wrapConn func(net.PacketConn) net.PacketConn) *testEmulation {
+	serverAddr := &net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 3000}
+	motes := LinearTopology(network, motesCount, 1, serverAddr, 2)
+
+	var conn net.PacketConn = network.Listen(serverAddr)
+	if wrapConn != nil {
+		conn = wrapConn(conn)
+	}
+	server := udpack.NewUDPAckServer(conn, config)
+	t.Cleanup(func() { _ = server.Close() })
+	appGraph := applications.NewApplicationGraph(motesCount)
+	appBandwidth := applications.NewApplicationBandwidth(motesCount)
+	appTopology := applications.NewApplicationTopology(motesCount)
+	appDispatcher := applications.NewAppDispatcher().
+		Subscribe(&appGraph).
+		Subscribe(&appBandwidth).
+		Subscribe(&appTopology)
+	go func() { _ = server.Serve(appDispatcher.Handler) }()
+
+	addrs := make([]addrtranslation.IPString, 0, motesCount)
+	for _, mote := range motes {
+		mote.Start(20 * time.Millisecond)
+		t.Cleanup(mote.Stop)
+		addrs = append(addrs, mote.IP)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !(appGraph.Ready() && appBandwidth.Ready() && appTopology.Ready()) {
+		if time.Now().After(deadline) {
+			t.Fatal("the applications never became ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The motes keep reporting during the update, the test works on snapshots
+	return &testEmulation{
+		motes:    motes,
+		addrs:    addrs,
+		server:   server,
+		graph:    appGraph.Snapshot(),
+		topology: appTopology.Topology.Snapshot(),
+	}
+}
+
+func TestScheduleUpdateOverLossyNetwork(t *testing.T) {
+	network := NewNetwork(42, LinkConfig{
+		Loss:         0.1,
+		Duplication:  0.05,
+		Reordering:   0.1,
+		Delay:        time.Millisecond,
+		Jitter:       2 * time.Millisecond,
+		ReorderDelay: 5 * time.Millisecond,
+	})
+	emulation := startTestEmulation(t, network, 6, &udpack.UDPAckConnSendConfig{
+		MaxRetries:          50,
+		TimesBetweenRetries: time.Millisecond,
+		Timeout:             200 * time.Millisecond,
+		MinTimeout:          20 * time.Millisecond,
+		WindowSize:          4,
+	}, nil)
+
+	schedule, err := scheduleOneCellPerLink(&emulation.graph, &emulation.topology, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updater := scheduleupdater.NewUpdater(emulation.server, emulation.addrs, nil)
+	if err := updater.UpdateClients(&schedule, &emulation.graph); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mote := range emulation.motes {
+		if mote.CompletedUpdates() != 1 {
+			t.Errorf("mote %d completed %d updates, expected 1", mote.ID, mote.CompletedUpdates())
+		}
+		if err := mote.Client.CheckSchedule(schedule, mote.IP); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// packetFilter drops the data packets sent to `to` for which `drop` returns true.
+type packetFilter struct {
+	net.PacketConn
+	to   net.Addr
+	drop func(payload []byte) bool
+}
+
+func (filter *packetFilter) WriteTo(packet []byte, addr net.Addr) (int, error) {
+	if len(packet) > 0 && addr.String() == filter.to.String() {
+		header, payload := udpack.RemoveHeaderFromPacket(packet)
+		if udpack.DecodePacketType(header) == udpack.PacketTypeData && filter.drop(payload) {
+			return len(packet), nil
+		}
+	}
+	return filter.PacketConn.WriteTo(packet, addr)
+}
+
+func TestCommitFailureRollsBack(t *testing.T) {
+	network := NewNetwork(42, LinkConfig{Delay: time.Millisecond})
+	// The confirmation of the second update never reaches the mote 2: the
+	// commit stops at the mote 2, after the motes 4 and 3 and before the border
+	// router. No epoch fits in 32 bits until the second update starts.
+	failedEpoch := uint32(math.MaxUint32)
+	wrapConn := func(conn net.PacketConn) net.PacketConn {
+		return &packetFilter{
+			PacketConn: conn,
+			to:         scheduleupdater.UDPPeerAddr(CoojaIP(2)),
+			drop: func(payload []byte) bool {
+				return len(payload) > 0 && scheduleupdater.PktType(payload[0]) == scheduleupdater.PktTypeUpdateConfirmation &&
+					uint32(scheduleupdater.PktEpoch(payload)) == atomic.LoadUint32(&failedEpoch)
+			},
+		}
+	}
+	emulation := startTestEmulation(t, network, 4, &udpack.UDPAckConnSendConfig{
+		MaxRetries:          5,
+		TimesBetweenRetries: time.Millisecond,
+		Timeout:             20 * time.Millisecond,
+		MinTimeout:          20 * time.Millisecond,
+		WindowSize:          4,
+	}, wrapConn)
+
+	first, err := scheduleOneCellPerLink(&emulation.graph, &emulation.topology, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := scheduleOneCellPerLink(&emulation.graph, &emulation.topology, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updater := scheduleupdater.NewUpdater(emulation.server, emulation.addrs, nil)
+	if err := updater.UpdateClients(&first, &emulation.graph); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreUint32(&failedEpoch, uint32(updater.Epoch()+1))
+	err = updater.UpdateClients(&second, &emulation.graph)
+
+	var commitErr *scheduleupdater.CommitError
+	if !errors.As(err, &commitErr) {
+		t.Fatalf("got the error %v, expected a *CommitError", err)
+	}
+	if !commitErr.RolledBack {
+		t.Errorf("the previous schedule was not reinstalled: %v", commitErr.RollbackErr)
+	}
+	expectedSwapped := []addrtranslation.IPString{CoojaIP(4), CoojaIP(3)}
+	if !reflect.DeepEqual(commitErr.Swapped, expectedSwapped) {
+		t.Errorf("got the swapped motes %v, expected %v", commitErr.Swapped, expectedSwapped)
+	}
+	// The motes 4 and 3 switched to the second schedule and back to the first
+	// one, the mote 2 skipped the second schedule and switched to the
+	// reinstalled first one, the border router was aborted
+	expectedUpdates := map[uint]int{1: 1, 2: 2, 3: 3, 4: 3}
+	for _, mote := range emulation.motes {
+		if mote.CompletedUpdates() != expectedUpdates[mote.ID] {
+			t.Errorf("mote %d completed %d updates, expected %d", mote.ID, mote.CompletedUpdates(), expectedUpdates[mote.ID])
+		}
+		expectedAborts := 0
+		if mote.ID == 1 {
+			expectedAborts = 1
+		}
+		if mote.Client.AbortedUpdates() != expectedAborts {
+			t.Errorf("mote %d aborted %d updates, expected %d", mote.ID, mote.Client.AbortedUpdates(), expectedAborts)
+		}
+		if err := mote.Client.CheckSchedule(first, mote.IP); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// dropConfirmationsTo drops the confirmations sent to the mote `id` until the
+// returned function is called.
+func dropConfirmationsTo(id uint) (func(net.PacketConn) net.PacketConn, func()) {
+	dropping := int32(1)
+	wrapConn := func(conn net.PacketConn) net.PacketConn {
+		return &packetFilter{
+			PacketConn: conn,
+			to:         scheduleupdater.UDPPeerAddr(CoojaIP(id)),
+			drop: func(payload []byte) bool {
+				return len(payload) > 0 && scheduleupdater.PktType(payload[0]) == scheduleupdater.PktTypeUpdateConfirmation &&
+					atomic.LoadInt32(&dropping) == 1
+			},
+		}
+	}
+	return wrapConn, func() { atomic.StoreInt32(&dropping, 0) }
+}
+
+func TestCommitTimeoutBoundsTheCommitPhase(t *testing.T) {
+	network := NewNetwork(42, LinkConfig{Delay: time.Millisecond})
+	wrapConn, _ := dropConfirmationsTo(2)
+	// Without the timeout, the confirmation of the mote 2 would be sent again
+	// for 100 * 20ms
+	emulation := startTestEmulation(t, network, 4, &udpack.UDPAckConnSendConfig{
+		MaxRetries:          100,
+		TimesBetweenRetries: time.Millisecond,
+		Timeout:             20 * time.Millisecond,
+		MinTimeout:          20 * time.Millisecond,
+		WindowSize:          4,
+	}, wrapConn)
+	schedule, err := scheduleOneCellPerLink(&emulation.graph, &emulation.topology, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updater := scheduleupdater.NewUpdater(emulation.server, emulation.addrs, nil)
+	const commitTimeout = 100 * time.Millisecond
+	updater.SetCommitPolicy(scheduleupdater.CommitPolicy{Timeout: commitTimeout, Rollback: false})
+
+	start := time.Now()
+	err = updater.UpdateClients(&schedule, &emulation.graph)
+	elapsed := time.Since(start)
+
+	var commitErr *scheduleupdater.CommitError
+	if !errors.As(err, &commitErr) {
+		t.Fatalf("got the error %v, expected a *CommitError", err)
+	}
+	if elapsed > commitTimeout+500*time.Millisecond {
+		t.Errorf("UpdateClients returned after %v with a commit timeout of %v", elapsed, commitTimeout)
+	}
+	expectedSwapped := []addrtranslation.IPString{CoojaIP(4), CoojaIP(3)}
+	if !reflect.DeepEqual(commitErr.Swapped, expectedSwapped) {
+		t.Errorf("got the swapped motes %v, expected %v", commitErr.Swapped, expectedSwapped)
+	}
+}
+
+func TestFirstCommitFailureIsNotRolledBack(t *testing.T) {
+	network := NewNetwork(42, LinkConfig{Delay: time.Millisecond})
+	wrapConn, stopDropping := dropConfirmationsTo(2)
+	emulation := startTestEmulation(t, network, 4, &udpack.UDPAckConnSendConfig{
+		MaxRetries:          5,
+		TimesBetweenRetries: time.Millisecond,
+		Timeout:             20 * time.Millisecond,
+		MinTimeout:          20 * time.Millisecond,
+		WindowSize:          4,
+	}, wrapConn)
+	first, err := scheduleOneCellPerLink(&emulation.graph, &emulation.topology, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := scheduleOneCellPerLink(&emulation.graph, &emulation.topology, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updater := scheduleupdater.NewUpdater(emulation.server, emulation.addrs, nil)
+
+	// No schedule was installed before, there is nothing to reinstall
+	err = updater.UpdateClients(&first, &emulation.graph)
+	var commitErr *scheduleupdater.CommitError
+	if !errors.As(err, &commitErr) {
+		t.Fatalf("got the error %v, expected a *CommitError", err)
+	}
+	if commitErr.RolledBack {
+		t.Error("the first update was rolled back")
+	}
+	expectedSwapped := []addrtranslation.IPString{CoojaIP(4), CoojaIP(3)}
+	if !reflect.DeepEqual(commitErr.Swapped, expectedSwapped) {
+		t.Errorf("got the swapped motes %v, expected %v", commitErr.Swapped, expectedSwapped)
+	}
+	// The motes 4 and 3 keep the first schedule, the motes 2 and 1 were
+	// aborted and have no schedule, none of them got an empty schedule
+	for _, mote := range emulation.motes {
+		expectedUpdates, expectedAborts := 1, 0
+		if mote.ID <= 2 {
+			expectedUpdates, expectedAborts = 0, 1
+		}
+		if mote.CompletedUpdates() != expectedUpdates {
+			t.Errorf("mote %d completed %d updates, expected %d", mote.ID, mote.CompletedUpdates(), expectedUpdates)
+		}
+		if mote.Client.AbortedUpdates() != expectedAborts {
+			t.Errorf("mote %d aborted %d updates, expected %d", mote.ID, mote.Client.AbortedUpdates(), expectedAborts)
+		}
+		if expectedUpdates > 0 {
+			if err := mote.Client.CheckSchedule(first, mote.IP); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	// The next update installs a whole schedule on every mote
+	stopDropping()
+	if err := updater.UpdateClients(&second, &emulation.graph); err != nil {
+		t.Fatal(err)
+	}
+	for _, mote := range emulation.motes {
+		if err := mote.Client.CheckSchedule(second, mote.IP); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package emulator
+
+import (
+	"fmt"
+	"net"
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/applications"
+	"scheduleupdater-server/moteclient"
+	"scheduleupdater-server/scheduleupdater"
+	"sync"
+	"time"
+)
+
+// CoojaIP returns the global IPv6 address that Cooja gives to the mote `id`.
+// The interface identifier is the MAC address with the universal/local bit flipped.
+func CoojaIP(id uint) addrtranslation.IPString {
+	return addrtranslation.IPString(fmt.Sprintf("fd00::%x:%x:%x:%x", id^0x200, id, id, id))
+}
+
+// CoojaLinkLocalIP returns the link local IPv6 address of the mote `id`.
+func CoojaLinkLocalIP(id uint) addrtranslation.IPString {
+	return addrtranslation.IPString(fmt.Sprintf("fe80::%x:%x:%x:%x", id^0x200, id, id, id))
+}
+
+// CoojaMac returns the link layer address that Cooja gives to the mote `id`,
+// the 16 bits id repeated four times.
+func CoojaMac(id uint) addrtranslation.MacAddr {
+	high, low := byte(id>>8), byte(id)
+	return addrtranslation.MacAddr{high, low, high, low, high, low, high, low}
+}
+
+// Mote emulates a Contiki-NG node running the client application: it
+// periodically reports its bandwidth, neighbors and RPL parent to the server
+// and installs the schedule sent by the server with a moteclient.Client.
+type Mote struct {
+	ID        uint
+	IP        addrtranslation.IPString
+	Mac       addrtranslation.MacAddr
+	Parent    *Mote // nil for the border router
+	Neighbors []*Mote
+	Bandwidth uint8
+	Client    *moteclient.Client
+
+	endpoint *Endpoint
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewMote attaches a new mote with the Cooja addresses of `id` to the network.
+func NewMote(network *Network, id uint, serverAddr net.Addr, bandwidth uint8) *Mote {
+	ip := CoojaIP(id)
+	mac := CoojaMac(id)
+	endpoint := network.Listen(scheduleupdater.UDPPeerAddr(ip))
+	return &Mote{
+		ID:        id,
+		IP:        ip,
+		Mac:       mac,
+		Bandwidth: bandwidth,
+		Client:    moteclient.NewClient(endpoint, serverAddr, mac, nil),
+		endpoint:  endpoint,
+		stop:      make(chan struct{}),
+	}
+}
+
+// LinearTopology creates `count` motes in a line, the first one being the
+// border router and each following mote having the previous one as RPL parent.
+func LinearTopology(network *Network, count uint, firstMoteID uint, serverAddr net.Addr, bandwidth uint8) []*Mote {
+	motes := make([]*Mote, count)
+	for i := uint(0); i < count; i++ {
+		motes[i] = NewMote(network, firstMoteID+i, serverAddr, bandwidth)
+		if i > 0 {
+			motes[i].Parent = motes[i-1]
+			motes[i].Neighbors = append(motes[i].Neighbors, motes[i-1])
+			motes[i-1].Neighbors = append(motes[i-1].Neighbors, motes[i])
+		}
+	}
+	return motes
+}
+
+// Start sends the reports of the mote every `reportInterval` and handles the
+// packets received from the server until Stop is called. The neighbors of the
+// mote are its neighbor table: the cells toward another node are declined.
+func (mote *Mote) Start(reportInterval time.Duration) {
+	neighbors := make([]addrtranslation.MacAddr, len(mote.Neighbors))
+	for i, neighbor := range mote.Neighbors {
+		neighbors[i] = neighbor.Mac
+	}
+	mote.Client.SetNeighbors(neighbors)
+	mote.wg.Add(2)
+	go func() {
+		defer mote.wg.Done()
+		_ = mote.Client.Serve()
+	}()
+	go func() {
+		defer mote.wg.Done()
+		ticker := time.NewTicker(reportInterval)
+		defer ticker.Stop()
+		for {
+			mote.sendReports()
+			select {
+			case <-mote.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (mote *Mote) Stop() {
+	close(mote.stop)
+	_ = mote.endpoint.Close()
+	mote.wg.Wait()
+}
+
+// InstalledCells returns the cells of the schedule the mote switched to with
+// the last update confirmation.
+func (mote *Mote) InstalledCells() map[addrtranslation.MacAddr][]scheduleupdater.Cell {
+	return mote.Client.InstalledCells()
+}
+
+// CompletedUpdates returns the number of update confirmations processed.
+func (mote *Mote) CompletedUpdates() int {
+	return mote.Client.CompletedUpdates()
+}
+
+// sendReports mirrors the bandwidth, topology and graph applications which
+// send their reports without ACK. The border router does not have a RPL parent
+// and therefore sends no graph report.
+func (mote *Mote) sendReports() {
+	_ = mote.Client.SendNoAck(applications.AppTypeBandwidth, []byte{mote.Bandwidth})
+
+	topology := append([]byte(nil), mote.Mac[:]...)
+	for _, neighbor := range mote.Neighbors {
+		topology = append(topology, neighbor.Mac[:]...)
+	}
+	_ = mote.Client.SendNoAck(applications.AppTypeTopology, topology)
+
+	if mote.Parent != nil {
+		parentIP := net.ParseIP(string(CoojaLinkLocalIP(mote.Parent.ID)))
+		_ = mote.Client.SendNoAck(applications.AppTypeGraph, parentIP.To16())
+	}
+}
@@ -0,0 +1,227 @@
+package emulator
+
+// Emulator: an in-memory network of motes speaking the same wire protocol as
+// the Contiki-NG nodes (common/udpack-server.c and the graph, topology and
+// bandwidth applications). Each link can lose, delay, duplicate and reorder
+// packets so that the server can be exercised end to end with `go test`,
+// without booting Cooja.
+// The random decisions of a link only depend on the seed of the network and on
+// the order of the packets sent on this link.
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// LinkConfig describes the behaviour of a link between two endpoints.
+type LinkConfig struct {
+	Loss         float64       // probability that a packet is lost
+	Duplication  float64       // probability that a packet is delivered twice
+	Reordering   float64       // probability that a packet is held back by ReorderDelay
+	Delay        time.Duration // minimum delivery delay
+	Jitter       time.Duration // maximum random delay added to Delay
+	ReorderDelay time.Duration // extra delay of a reordered packet
+}
+
+type linkKey struct {
+	from string
+	to   string
+}
+
+type link struct {
+	config LinkConfig
+	random *rand.Rand
+}
+
+// Network connects endpoints with each other. All the endpoints can reach each
+// other, the links use the default LinkConfig unless overridden with SetLink.
+type Network struct {
+	seed        int64
+	defaultLink LinkConfig
+	links       map[linkKey]*link
+	endpoints   map[string]*Endpoint
+	lock        sync.Mutex
+}
+
+func NewNetwork(seed int64, defaultLink LinkConfig) *Network {
+	return &Network{
+		seed:        seed,
+		defaultLink: defaultLink,
+		links:       make(map[linkKey]*link),
+		endpoints:   make(map[string]*Endpoint),
+		lock:        sync.Mutex{},
+	}
+}
+
+// SetLink overrides the configuration of the link going from `from` to `to`.
+func (network *Network) SetLink(from net.Addr, to net.Addr, config LinkConfig) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	network.link(from, to).config = config
+}
+
+// Listen creates an endpoint reachable at `addr`.
+func (network *Network) Listen(addr net.Addr) *Endpoint {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	endpoint := &Endpoint{
+		network: network,
+		addr:    addr,
+		inbox:   make(chan datagram, endpointInboxSize),
+		closed:  make(chan struct{}),
+	}
+	network.endpoints[addr.String()] = endpoint
+	return endpoint
+}
+
+// link returns the link between `from` and `to`, the caller must hold the lock.
+func (network *Network) link(from net.Addr, to net.Addr) *link {
+	key := linkKey{from: from.String(), to: to.String()}
+	l, in := network.links[key]
+	if !in {
+		hash := fnv.New64a()
+		_, _ = hash.Write([]byte(key.from + "->" + key.to))
+		l = &link{
+			config: network.defaultLink,
+			random: rand.New(rand.NewSource(network.seed ^ int64(hash.Sum64()))),
+		}
+		network.links[key] = l
+	}
+	return l
+}
+
+// send delivers `packet` to `to` according to the configuration of the link.
+// As with UDP, a packet sent to an unknown address is silently dropped.
+func (network *Network) send(from net.Addr, to net.Addr, packet []byte) {
+	network.lock.Lock()
+	destination, in := network.endpoints[to.String()]
+	if !in {
+		network.lock.Unlock()
+		return
+	}
+	l := network.link(from, to)
+	copies := 1
+	if l.random.Float64() < l.config.Duplication {
+		copies = 2
+	}
+	delays := make([]time.Duration, 0, copies)
+	for i := 0; i < copies; i++ {
+		if l.random.Float64() < l.config.Loss {
+			continue
+		}
+		delay := l.config.Delay
+		if l.config.Jitter > 0 {
+			delay += time.Duration(l.random.Int63n(int64(l.config.Jitter)))
+		}
+		if l.random.Float64() < l.config.Reordering {
+			delay += l.config.ReorderDelay
+		}
+		delays = append(delays, delay)
+	}
+	network.lock.Unlock()
+
+	for _, delay := range delays {
+		d := datagram{from: from, packet: append([]byte(nil), packet...)}
+		time.AfterFunc(delay, func() { destination.deliver(d) })
+	}
+}
+
+const endpointInboxSize = 4096
+
+type datagram struct {
+	from   net.Addr
+	packet []byte
+}
+
+// Endpoint is a net.PacketConn attached to a Network.
+type Endpoint struct {
+	network      *Network
+	addr         net.Addr
+	inbox        chan datagram
+	closed       chan struct{}
+	closeOnce    sync.Once
+	readDeadline time.Time
+	lock         sync.RWMutex
+}
+
+var errClosed = errors.New("use of closed emulated endpoint")
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func (endpoint *Endpoint) deliver(d datagram) {
+	select {
+	case <-endpoint.closed:
+	case endpoint.inbox <- d:
+	default:
+		// The receiver does not keep up, the packet is dropped as a full
+		// socket buffer would do.
+	}
+}
+
+func (endpoint *Endpoint) ReadFrom(buffer []byte) (int, net.Addr, error) {
+	endpoint.lock.RLock()
+	deadline := endpoint.readDeadline
+	endpoint.lock.RUnlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case d := <-endpoint.inbox:
+		return copy(buffer, d.packet), d.from, nil
+	case <-endpoint.closed:
+		return 0, nil, errClosed
+	case <-timeout:
+		return 0, nil, timeoutError{}
+	}
+}
+
+func (endpoint *Endpoint) WriteTo(packet []byte, addr net.Addr) (int, error) {
+	select {
+	case <-endpoint.closed:
+		return 0, errClosed
+	default:
+	}
+	endpoint.network.send(endpoint.addr, addr, packet)
+	return len(packet), nil
+}
+
+func (endpoint *Endpoint) Close() error {
+	endpoint.closeOnce.Do(func() {
+		close(endpoint.closed)
+		endpoint.network.lock.Lock()
+		delete(endpoint.network.endpoints, endpoint.addr.String())
+		endpoint.network.lock.Unlock()
+	})
+	return nil
+}
+
+func (endpoint *Endpoint) LocalAddr() net.Addr {
+	return endpoint.addr
+}
+
+func (endpoint *Endpoint) SetDeadline(t time.Time) error {
+	return endpoint.SetReadDeadline(t)
+}
+
+func (endpoint *Endpoint) SetReadDeadline(t time.Time) error {
+	endpoint.lock.Lock()
+	defer endpoint.lock.Unlock()
+	endpoint.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline does nothing since writing to an endpoint never blocks.
+func (endpoint *Endpoint) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -1,27 +1,32 @@
 package main
 
 // Server main application.
-// This application waits for a number of nodes to connect to the server.
+// This application waits for a number of nodes to connect to the server,
+// the nodes are discovered from the packets they send.
 // The nodes are responsible to send three information:
 // 1. Their bandwidth need
 // 2. Their neighbors
 // 3. Thei RPL parent
 //
 // When all these three information have been sent to the server,
-// the server generate a new schedule based on a greedy algorithm.
+// the server generate a new schedule based on the selected scheduler (greedy by default).
 // This newly generated schedule is then sent to the node based on the protocole
 // described in the master's thesis PDF.
-// As the goal was only to install a new schedule once for the simulation,
-// the server stops when the schedule was correctly sent to the nodes.
+// The server then keeps listening to the nodes and sends a new schedule each
+// time their information changes (see rescheduler.go), unless it is started
+// with -once.
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"os"
 	"scheduleupdater-server/addrtranslation"
 	"scheduleupdater-server/applications"
+	"scheduleupdater-server/scheduler"
 	"scheduleupdater-server/scheduleupdater"
 	"scheduleupdater-server/stats"
 	"scheduleupdater-server/udpack"
@@ -31,22 +36,101 @@ import (
 )
 
 func printHelp() {
-	fmt.Println("server [#MOTES] [FIRST_MOTE_ID] [PORT]")
-	fmt.Println("   - #MOTES the number of motes in the simulation including the border router")
-	fmt.Println("   - FIRST_MOTE_ID the id of the first mote which is the border router")
+	fmt.Println("server [OPTIONS] [#MOTES] [PORT] [TIMEOUT]")
+	fmt.Println("   - #MOTES the number of motes including the border router to discover before sending the first schedule")
 	fmt.Println("   - PORT the server port")
+	fmt.Println("   - TIMEOUT the initial and maximum time in seconds before resending a packet that was not acknowledged")
+	fmt.Println("server [OPTIONS] validate SNAPSHOT")
+	fmt.Println("   - SNAPSHOT a JSON file describing the network and optionally its schedule (see validate.go),")
+	fmt.Println("     the schedule is computed with the selected scheduler when missing")
+	fmt.Println("OPTIONS:")
+	flag.PrintDefaults()
 }
 
 func main() {
 	utils.NewLogger(utils.LogLevelInfo, utils.WHITE)
 
-	nClients, firstMoteID, port, timeout, err := parseArgs()
+	windowSize := flag.Int("window", 1, "number of packets in flight toward the same mote (1 means stop-and-wait)")
+	schedulerName := flag.String("scheduler", "greedy", fmt.Sprintf("scheduling algorithm, one of %v", scheduler.Names()))
+	reuseDistance := flag.Uint("reuse-distance", scheduler.DefaultReuseDistance, "minimal number of hops between two links sharing a cell (0 disables the reuse)")
+	defaultGeometry := scheduleupdater.NewDefaultSlotframeGeometry()
+	slotframeHandle := flag.Uint("slotframe-handle", uint(defaultGeometry.Handle), "handle of the slotframe of the schedule, the motes alternate between this handle and the next one")
+	slotframeLength := flag.Uint("slotframe-length", uint(defaultGeometry.Length), "number of timeslots of the slotframe of the schedule")
+	firstChannel := flag.Uint("first-channel", uint(defaultGeometry.FirstChannel), "first channel offset usable by the schedule")
+	lastChannel := flag.Uint("last-channel", uint(defaultGeometry.LastChannel), "last channel offset usable by the schedule")
+	validationConfig := scheduleupdater.NewDefaultValidationConfig()
+	hoppingSequenceLength := flag.Uint("hopping-sequence-length", uint(validationConfig.HoppingSequenceLength), "number of channels of the hopping sequence of the motes, used by validate")
+	commitTimeout := flag.Duration("commit-timeout", 0, "maximal duration of the commit phase of an update, 0 disables the timeout")
+	rollback := flag.Bool("rollback", true, "reinstall the previous schedule on the motes that already switched when the commit phase fails")
+	debounce := flag.Duration("debounce", 5*time.Second, "time without changes of the network waited before sending a new schedule")
+	once := flag.Bool("once", false, "stop the server after the first schedule was sent to the motes")
+	prefixes := flag.String("prefixes", addrtranslation.DefaultGlobalPrefix.String(), "comma separated /64 prefixes of the global addresses of the motes, the first one is used to derive their addresses")
+	defaultDispatcher := applications.NewDefaultDispatcherConfig()
+	dispatchWorkers := flag.Int("dispatch-workers", defaultDispatcher.Workers, "number of packets of the motes processed concurrently")
+	dispatchQueue := flag.Int("dispatch-queue", defaultDispatcher.QueueSize, "number of packets waiting for each worker before the packets are dropped")
+	linkLifetime := flag.Duration("link-lifetime", 5*time.Minute, "time a RPL link is kept after the last report of the child, 0 disables the expiry")
+	nodeTimeout := flag.Duration("node-timeout", 5*time.Minute, "time without packets after which a mote leaves the network, 0 disables the departures")
+	flag.Usage = printHelp
+	flag.Parse()
+	for _, geometryFlag := range []struct {
+		name  string
+		value uint
+	}{
+		{"slotframe-handle", *slotframeHandle},
+		{"slotframe-length", *slotframeLength},
+		{"first-channel", *firstChannel},
+		{"last-channel", *lastChannel},
+		{"hopping-sequence-length", *hoppingSequenceLength},
+	} {
+		if geometryFlag.value > math.MaxUint16 {
+			fmt.Printf("The value %d of -%s does not fit in 16 bits\n", geometryFlag.value, geometryFlag.name)
+			printHelp()
+			os.Exit(1)
+		}
+	}
+	geometry := scheduleupdater.SlotframeGeometry{
+		Handle:       uint16(*slotframeHandle),
+		Length:       uint16(*slotframeLength),
+		FirstChannel: uint16(*firstChannel),
+		LastChannel:  uint16(*lastChannel),
+	}
+	networkScheduler, err := scheduler.New(*schedulerName, geometry, scheduler.Interference{ReuseDistance: *reuseDistance})
+	if err != nil {
+		fmt.Println(err)
+		printHelp()
+		os.Exit(1)
+	}
+	globalPrefixes, err := addrtranslation.ParsePrefixes(*prefixes)
+	if err == nil {
+		err = addrtranslation.SetGlobalPrefixes(globalPrefixes...)
+	}
+	if err != nil {
+		fmt.Println(err)
+		printHelp()
+		os.Exit(1)
+	}
+	if flag.Arg(0) == "validate" {
+		if flag.NArg() != 2 {
+			printHelp()
+			os.Exit(1)
+		}
+		validationConfig.HoppingSequenceLength = uint16(*hoppingSequenceLength)
+		problems, err := runValidate(flag.Arg(1), networkScheduler, geometry, validationConfig)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if problems > 0 {
+			os.Exit(2)
+		}
+		os.Exit(0)
+	}
+	nClients, port, timeout, err := parseArgs(flag.Args())
 	if err != nil {
 		fmt.Println(err)
 		printHelp()
 		os.Exit(1)
 	}
-	stats.SimulationStats.Nclients = nClients
 
 	addr := &net.UDPAddr{
 		Port: port,
@@ -63,6 +147,9 @@ func main() {
 		MaxRetries:          100,
 		TimesBetweenRetries: 1,
 		Timeout:             time.Duration(timeout) * time.Second,
+		MinTimeout:          time.Second,
+		WindowSize:          *windowSize,
+		AckPayloadSize:      scheduleupdater.AckPayloadSize,
 	}
 	server := udpack.NewUDPAckServer(conn, &config)
 	stats.SimulationStats.Timeout = server.Config.Timeout.Seconds()
@@ -70,43 +157,54 @@ func main() {
 	// Create the three application, when a node send a packet,
 	// it is correctly dispatch to the application based on the ApplicationType
 	appGraph := applications.NewApplicationGraph(nClients)
+	appGraph.SetLinkLifetime(*linkLifetime)
+	// The graph signals its change after the expired links are removed, the
+	// next round schedules the network without them
+	appGraph.OnLinkExpired(func(event applications.LinkEvent) {
+		utils.Log.WarningPrintln("The RPL link from ", event.ChildIP, " to ", event.ParentIP, " expired, rescheduling without it")
+	})
+	if *linkLifetime > 0 {
+		go appGraph.RunSweeper(*linkLifetime / 4)
+	}
 	appBandwidth := applications.NewApplicationBandwidth(nClients)
 	appTopology := applications.NewApplicationTopology(nClients)
-	appDispatcher := applications.NewAppDispatcher().
+	appDispatcher := applications.NewAppDispatcherWithConfig(applications.DispatcherConfig{
+		Workers:        *dispatchWorkers,
+		QueueSize:      *dispatchQueue,
+		EnqueueTimeout: defaultDispatcher.EnqueueTimeout,
+	}).
 		Subscribe(&appGraph).
 		Subscribe(&appBandwidth).
 		Subscribe(applications.NewApplicationHelloWorld()).
 		Subscribe(&appTopology)
 
-	// We assume that we know the address of all the nodes in the network.
-	// However, we could also ask the server to keep in memory the last addresses
-	// from which we received a packet.
-	addrs := initializeClientsAddrs(nClients, firstMoteID)
-	go func() {
-		for {
-			// Wait till all applications are ready
-			appGraphReady := appGraph.Ready()
-			appBandwidthReady := appBandwidth.Ready()
-			appTopologyReady := appTopology.Ready()
-			if appGraphReady && appBandwidthReady && appTopologyReady {
-				break
-			}
-			if !appGraphReady {
-				utils.Log.WarningPrintln("App Graph is not ready yet...")
-			}
-			if !appBandwidthReady {
-				utils.Log.WarningPrintln("App Bandwidth is not ready yet...")
+	// The nodes are learned from the packets they send, the applications
+	// forget the information of the nodes that left
+	discovery := applications.NewNodeDiscovery(*nodeTimeout).
+		OnEvent(func(event applications.NodeEvent) {
+			if event.Type == applications.NodeLeft {
+				appGraph.Forget(event.IP)
+				appBandwidth.Forget(event.IP)
+				appTopology.Forget(event.IP)
 			}
-			if !appTopologyReady {
-				utils.Log.WarningPrintln("App Topology is not ready yet...")
-			}
-			time.Sleep(time.Second * 4)
-		}
-		// Generate a new schedule and send it to the nodes
-		schedule := generateSchedule(&appGraph.Graph, &appBandwidth.Bandwith, &appTopology.Topology)
-		updater := scheduleupdater.NewUpdater(server, addrs)
-		updater.UpdateClients(&schedule, &appGraph.Graph)
-	}()
+		})
+	if *nodeTimeout > 0 {
+		go discovery.RunSweeper(*nodeTimeout / 4)
+	}
+	updater := scheduleupdater.NewUpdater(server, nil, nil)
+	updater.SetCommitPolicy(scheduleupdater.CommitPolicy{Timeout: *commitTimeout, Rollback: *rollback})
+	rescheduler := rescheduler{
+		scheduler:    networkScheduler,
+		updater:      &updater,
+		appGraph:     &appGraph,
+		appBandwidth: &appBandwidth,
+		appTopology:  &appTopology,
+		discovery:    discovery,
+		minNodes:     nClients,
+		debounce:     *debounce,
+		once:         *once,
+	}
+	go rescheduler.run()
 
 	defer func(server *udpack.UDPAckConn) {
 		err := server.Close()
@@ -115,106 +213,26 @@ func main() {
 		}
 	}(server)
 	fmt.Println("server listening on port ", port, "...")
-	log.Panic(server.Serve(appDispatcher.Handler))
+	log.Panic(server.Serve(discovery.Observe(appDispatcher.Handler)))
 }
 
 // -- INTERNAL --
-// The functions below are helper to generate a new schedule based on a greedy algorithm.
-// In a real use case, a good centralized scheduler like TASA should be used.
-
-func initializeClientsAddrs(clientCount uint, firstMoteID uint) []addrtranslation.IPString {
-	addrs := make([]addrtranslation.IPString, clientCount)
-	for i := firstMoteID; i < firstMoteID+clientCount; i++ {
-		fmt.Printf("Adding fd00::%x:%x:%x:%x\n", 512+i, i, i, i)
-		addrs[i-firstMoteID] = addrtranslation.IPString(fmt.Sprintf("fd00::%x:%x:%x:%x", 512+i, i, i, i))
-	}
-	return addrs
-}
-
-func generateSchedule(graph *applications.RPLGraph, bandwidthMap *applications.BandwidthMap, topology *applications.Topology) scheduleupdater.Schedule {
-	schedule := scheduleupdater.NewSchedule()
-	for mote, bandwidth := range *bandwidthMap {
-		rplLink, in := (*graph)[mote]
-		if !in {
-			utils.Log.ErrorPrintln("Couldn't found the RPL Link associated with mote ", mote)
-			continue
-		}
-		// Add the descending cell to join the node from the server
-		err := addOneCell(&schedule, rplLink.ParentIP, mote, topology)
-		if err != nil {
-			log.Panic(err)
-		}
-		for i := uint(0); i < bandwidth; i++ {
-			err := addOneCell(&schedule, mote, rplLink.ParentIP, topology)
-			if err != nil {
-				log.Panic(err)
-			}
-		}
-	}
-	return schedule
-}
-
-func addOneCell(schedule *scheduleupdater.Schedule, mote addrtranslation.IPString, neighbor addrtranslation.IPString, topology *applications.Topology) error {
-	rxCell := scheduleupdater.Cell{
-		LinkOptions: scheduleupdater.LinkOptionRX,
-		TimeSlot:    0,
-		Channel:     0,
-	}
-	txCell := scheduleupdater.Cell{
-		LinkOptions: scheduleupdater.LinkOptionTX,
-		TimeSlot:    0,
-		Channel:     0,
-	}
-	for channel := uint16(1); channel < 16; channel++ {
-		for timeslot := uint16(1); timeslot < 101; timeslot++ {
-			rxCell.TimeSlot = timeslot
-			rxCell.Channel = channel
-			txCell.TimeSlot = timeslot
-			txCell.Channel = channel
-
-			cellIsFree := true
-			for _, macNeighbor := range topology.TopologyMap[mote] {
-				if schedule.IsCellUsed(mote, macNeighbor, &txCell) {
-					cellIsFree = false
-				}
-			}
-			macNeighbor, ok := topology.MacIPTranslation.FindMac(neighbor)
-			if !ok {
-				return errors.New("could not find the mac address associated with the neighbor")
-			}
-			macMote, ok := topology.MacIPTranslation.FindMac(mote)
-			if !ok {
-				return errors.New("could not find the mac address associated with the current mote")
-			}
-			if cellIsFree {
-				schedule.AddCell(mote, macNeighbor, &txCell)
-				schedule.AddCell(neighbor, macMote, &rxCell)
-				return nil
-			}
-		}
-	}
-	return errors.New("no available cell left")
-}
 
-func parseArgs() (uint, uint, int, int, error) {
-	if len(os.Args) != 5 {
-		return 0, 0, 0, 0, errors.New("wrong command line usage")
-	}
-	nClients, err := strconv.Atoi(os.Args[1])
-	if err != nil {
-		return 0, 0, 0, 0, err
+func parseArgs(args []string) (uint, int, int, error) {
+	if len(args) != 3 {
+		return 0, 0, 0, errors.New("wrong command line usage")
 	}
-	firstMoteID, err := strconv.Atoi(os.Args[2])
+	nClients, err := strconv.Atoi(args[0])
 	if err != nil {
-		return 0, 0, 0, 0, err
+		return 0, 0, 0, err
 	}
-	port, err := strconv.Atoi(os.Args[3])
+	port, err := strconv.Atoi(args[1])
 	if err != nil {
-		return 0, 0, 0, 0, err
+		return 0, 0, 0, err
 	}
-	timeout, err := strconv.Atoi(os.Args[4])
+	timeout, err := strconv.Atoi(args[2])
 	if err != nil {
-		return 0, 0, 0, 0, err
+		return 0, 0, 0, err
 	}
-	return uint(nClients), uint(firstMoteID), port, timeout, nil
+	return uint(nClients), port, timeout, nil
 }
@@ -0,0 +1,491 @@
+package moteclient
+
+// Mote client: the client side of the protocol as implemented by the Contiki-NG
+// nodes in common/. A Client sends the graph, topology and bandwidth reports to
+// the server, acknowledges the packets of the schedule updater and keeps a model
+// of the TSCH schedule that the node would install. This allows to load test the
+// server with many virtual nodes and to check the schedule they end up with.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/applications"
+	"scheduleupdater-server/scheduleupdater"
+	"scheduleupdater-server/udpack"
+	"scheduleupdater-server/utils"
+	"sync"
+	"time"
+)
+
+// receiveWindow mirrors `UDPACK_RECEIVE_WINDOW`: the number of packets ahead of
+// the expected sequence number that the node keeps until the gap is filled.
+const receiveWindow = 8
+
+type ClientConfig struct {
+	// Timeout before resending a report that was not acknowledged
+	Timeout time.Duration
+	// MaxRetries number of times a report is resent before giving up
+	MaxRetries int
+}
+
+// newDefaultClientConfig returns the values used by `udpack_process`.
+func newDefaultClientConfig() *ClientConfig {
+	return &ClientConfig{
+		Timeout:    10 * time.Second,
+		MaxRetries: 4,
+	}
+}
+
+type Client struct {
+	Mac        addrtranslation.MacAddr
+	conn       net.PacketConn
+	serverAddr net.Addr
+	config     *ClientConfig
+
+	// Sending side (udpack_process): one report in flight at a time
+	sendLock       sync.Mutex
+	sequenceNumber uint8
+	acks           chan uint8
+
+	// Receiving side (udp_rx_callback and update_pkt_dispatch)
+	expectedSequenceNumber uint8
+	receiveBuffer          [receiveWindow][]byte
+	tsch                   *TSCHSchedule
+	geometry               scheduleupdater.SlotframeGeometry
+	updateSlotframeHandle  uint16
+	installedHandle        uint16
+	inUpdate               bool
+	incremental            bool
+	updateSlotframe        *Slotframe
+	completedUpdates       int
+	// updateEpoch and installedEpoch mirror `update_epoch` and `installed_epoch`
+	updateEpoch    scheduleupdater.Epoch
+	installedEpoch scheduleupdater.Epoch
+	abortedUpdates int
+	addLinkErrors  int
+	// neighbors is the neighbor table of the node, nil when every neighbor is known
+	neighbors map[addrtranslation.MacAddr]bool
+	// The result of each packet, the ACK of a duplicate carries the same confirmation
+	declineReasons [udpack.SequenceNumberSpace]scheduleupdater.DeclineReason
+	failedCells    [udpack.SequenceNumberSpace]uint8
+	lock           sync.RWMutex
+}
+
+func NewClient(conn net.PacketConn, serverAddr net.Addr, mac addrtranslation.MacAddr, config *ClientConfig) *Client {
+	if config == nil {
+		config = newDefaultClientConfig()
+	}
+	return &Client{
+		Mac:                    mac,
+		conn:                   conn,
+		serverAddr:             serverAddr,
+		config:                 config,
+		sequenceNumber:         1,
+		acks:                   make(chan uint8, 16),
+		expectedSequenceNumber: 1,
+		tsch:                   NewTSCHSchedule(),
+		geometry:               scheduleupdater.NewDefaultSlotframeGeometry(),
+		updateSlotframeHandle:  scheduleupdater.NewDefaultSlotframeGeometry().Handle,
+	}
+}
+
+// Serve handles the packets received from the server until the connection is closed.
+func (client *Client) Serve() error {
+	buffer := make([]byte, 2048)
+	for {
+		n, addr, err := client.conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+		client.handlePacket(addr, append([]byte(nil), buffer[:n]...))
+	}
+}
+
+// ReportGraph sends the link local address of the RPL parent (graph-application.c).
+func (client *Client) ReportGraph(parentIP net.IP) error {
+	return client.Send(applications.AppTypeGraph, parentIP.To16())
+}
+
+// ReportTopology sends the MAC address of the node followed by the MAC
+// addresses of its neighbors (topology-application.c).
+func (client *Client) ReportTopology(neighbors []addrtranslation.MacAddr) error {
+	return client.Send(applications.AppTypeTopology, encodeTopology(client.Mac, neighbors))
+}
+
+// ReportBandwidth sends the number of packets the node wants to send in a
+// single slotframe (bandwidth-application.c).
+func (client *Client) ReportBandwidth(bandwidth uint8) error {
+	return client.Send(applications.AppTypeBandwidth, []byte{bandwidth})
+}
+
+func encodeTopology(mac addrtranslation.MacAddr, neighbors []addrtranslation.MacAddr) []byte {
+	packet := append([]byte(nil), mac[:]...)
+	for _, neighbor := range neighbors {
+		packet = append(packet, neighbor[:]...)
+	}
+	return packet
+}
+
+// Send sends a PacketTypeData packet of the application `appType` and waits for
+// the ACK of the server as `udpack_process` does.
+func (client *Client) Send(appType applications.AppType, payload []byte) error {
+	client.sendLock.Lock()
+	defer client.sendLock.Unlock()
+	if client.sequenceNumber >= udpack.SequenceNumberSpace {
+		client.sequenceNumber = 0
+	}
+	sequenceNumber := client.sequenceNumber
+	packet, err := udpack.NewDataPacket(sequenceNumber, append([]byte{byte(appType)}, payload...))
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i <= client.config.MaxRetries; i++ {
+		if _, err := client.conn.WriteTo(packet, client.serverAddr); err != nil {
+			return err
+		}
+		timeout := time.After(client.config.Timeout)
+	waitAck:
+		for {
+			select {
+			case ackSequenceNumber := <-client.acks:
+				if ackSequenceNumber == sequenceNumber {
+					client.sequenceNumber++
+					return nil
+				}
+				// Stale ACK of a previous report
+			case <-timeout:
+				break waitAck
+			}
+		}
+	}
+	return errors.New(fmt.Sprintf("the report was not acknowledged after %d retries", client.config.MaxRetries))
+}
+
+// SendNoAck sends a PacketTypeDataNoACK packet of the application `appType` as
+// `send_server` does.
+func (client *Client) SendNoAck(appType applications.AppType, payload []byte) error {
+	packet := append([]byte{byte(appType)}, payload...)
+	_, err := client.conn.WriteTo(udpack.NewDataNoACKPacket(packet), client.serverAddr)
+	return err
+}
+
+// handlePacket mirrors `ack_middleware` and `udp_rx_callback` in
+// common/udpack-server.c: the data packets are processed in the order of their
+// sequence numbers, a packet ahead of the expected one is kept in the receive
+// buffer until the gap is filled. Each packet is acknowledged once processed,
+// and a duplicate gets the ACK of the packet processed.
+func (client *Client) handlePacket(addr net.Addr, packet []byte) {
+	if len(packet) < 1 {
+		return
+	}
+	header, payload := udpack.RemoveHeaderFromPacket(packet)
+	sequenceNumber := udpack.DecodeSequenceNumber(header)
+	if udpack.DecodePacketType(header) == udpack.PacketTypeAck {
+		select {
+		case client.acks <- sequenceNumber:
+		default:
+		}
+		return
+	}
+	if len(packet) < 2 {
+		return
+	}
+	client.lock.Lock()
+	var acks [][]byte
+	distance := (int(sequenceNumber) - int(client.expectedSequenceNumber) + udpack.SequenceNumberSpace) % udpack.SequenceNumberSpace
+	switch {
+	case distance > udpack.SequenceNumberSpace/2:
+		// Already processed, only the ACK is sent again
+		acks = append(acks, client.ackPacket(sequenceNumber))
+	case distance >= receiveWindow:
+		// Not acknowledged, the server sends the packet again later
+	default:
+		slot := sequenceNumber % receiveWindow
+		if client.receiveBuffer[slot] == nil {
+			client.receiveBuffer[slot] = payload
+		}
+		// Process the packets that follow the last one processed without gap
+		for slot = client.expectedSequenceNumber % receiveWindow; client.receiveBuffer[slot] != nil; slot = client.expectedSequenceNumber % receiveWindow {
+			expected := client.expectedSequenceNumber
+			client.declineReasons[expected], client.failedCells[expected] = client.dispatch(client.receiveBuffer[slot])
+			client.receiveBuffer[slot] = nil
+			acks = append(acks, client.ackPacket(expected))
+			client.expectedSequenceNumber = (expected + 1) % udpack.SequenceNumberSpace
+		}
+	}
+	client.lock.Unlock()
+
+	for _, ack := range acks {
+		_, _ = client.conn.WriteTo(ack, addr)
+	}
+}
+
+// ackPacket mirrors `send_ack`: the ACK carries the result of the packet and the
+// epochs held by the node. The caller must hold the lock.
+func (client *Client) ackPacket(sequenceNumber uint8) []byte {
+	const ackSize = 10
+	ack, _ := udpack.NewAckPacket(sequenceNumber)
+	reason := client.declineReasons[sequenceNumber]
+	if reason == scheduleupdater.DeclineReasonNone {
+		ack = append(ack, scheduleupdater.AckPacketConfirmationOK)
+	} else {
+		ack = append(ack, scheduleupdater.AckPacketConfirmationDecline)
+	}
+	ack = append(ack, byte(reason), client.failedCells[sequenceNumber])
+	ack = utils.AppendLittleEndianUint16(ack, uint16(client.updateEpoch))
+	ack = utils.AppendLittleEndianUint16(ack, uint16(client.installedEpoch))
+	return append(ack, make([]byte, ackSize-len(ack))...)
+}
+
+// SetNeighbors sets the neighbor table of the node: the cells toward any other
+// node are declined with DeclineReasonUnknownNeighbor.
+func (client *Client) SetNeighbors(neighbors []addrtranslation.MacAddr) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	client.neighbors = make(map[addrtranslation.MacAddr]bool, len(neighbors))
+	for _, neighbor := range neighbors {
+		client.neighbors[neighbor] = true
+	}
+}
+
+// otherSlotframeHandle mirrors `other_slotframe_handle`: handle -> handle + 1
+// and any other handle -> handle.
+func otherSlotframeHandle(geometry *scheduleupdater.SlotframeGeometry, handle uint16) uint16 {
+	if handle == geometry.Handle {
+		return geometry.Handle + 1
+	}
+	return geometry.Handle
+}
+
+// dispatch mirrors `update_pkt_dispatch` in common/schedule_updater.c: the cells
+// are installed in a shadow slotframe which replaces the current one when the
+// update is confirmed. It returns the reason why the packet was declined and
+// the number of cells that could not be installed. The caller must hold the lock.
+func (client *Client) dispatch(pkt []byte) (scheduleupdater.DeclineReason, uint8) {
+	if len(pkt) < scheduleupdater.PktPrefixSize {
+		return scheduleupdater.DeclineReasonNone, 0
+	}
+	// A delayed packet of an earlier update must not modify the slotframe of
+	// the update in progress
+	epoch := scheduleupdater.PktEpoch(pkt)
+	switch scheduleupdater.PktType(pkt[0]) {
+	case scheduleupdater.PktTypeScheduleHeader:
+		if client.updateEpoch != 0 && epoch.Older(client.updateEpoch) {
+			return scheduleupdater.DeclineReasonStaleEpoch, 0
+		}
+	case scheduleupdater.PktTypeEpochQuery:
+	default:
+		if epoch != client.updateEpoch {
+			if scheduleupdater.PktType(pkt[0]) == scheduleupdater.PktTypeUpdateRequest {
+				_, cells, _ := scheduleupdater.DecodeUpdateRequest(pkt)
+				return scheduleupdater.DeclineReasonStaleEpoch, uint8(len(cells))
+			}
+			return scheduleupdater.DeclineReasonStaleEpoch, 0
+		}
+	}
+	switch scheduleupdater.PktType(pkt[0]) {
+	case scheduleupdater.PktTypeScheduleHeader:
+		geometry, incremental, err := decodeScheduleHeader(pkt)
+		if err != nil {
+			return scheduleupdater.DeclineReasonNone, 0
+		}
+		// A new update starts, the slotframe of an unfinished update is dropped
+		client.dropUpdateSlotframe()
+		client.updateEpoch = epoch
+		client.geometry = geometry
+		client.incremental = incremental
+		client.updateSlotframeHandle = otherSlotframeHandle(&client.geometry, client.installedHandle)
+	case scheduleupdater.PktTypeUpdateRequest:
+		neighbor, cells, err := scheduleupdater.DecodeUpdateRequest(pkt)
+		if err != nil {
+			return scheduleupdater.DeclineReasonNone, 0
+		}
+		if client.neighbors != nil && !client.neighbors[neighbor] {
+			return scheduleupdater.DeclineReasonUnknownNeighbor, uint8(len(cells))
+		}
+		if client.startUpdate() == nil {
+			return scheduleupdater.DeclineReasonSlotframeBusy, uint8(len(cells))
+		}
+		failedCells := uint8(0)
+		for _, cell := range cells {
+			if cell.TimeSlot >= client.geometry.Length ||
+				cell.Channel < client.geometry.FirstChannel || cell.Channel > client.geometry.LastChannel {
+				client.addLinkErrors++
+				failedCells++
+				continue
+			}
+			if client.tsch.AddLink(client.updateSlotframe, cell.LinkOptions, neighbor, cell.TimeSlot, cell.Channel) != nil {
+				client.addLinkErrors++
+				failedCells++
+			}
+		}
+		if failedCells > 0 {
+			return scheduleupdater.DeclineReasonLinkMemory, failedCells
+		}
+	case scheduleupdater.PktTypeRemoveRequest:
+		_, cells, err := scheduleupdater.DecodeUpdateRequest(pkt)
+		if err != nil {
+			return scheduleupdater.DeclineReasonNone, 0
+		}
+		if client.startUpdate() == nil {
+			return scheduleupdater.DeclineReasonSlotframeBusy, 0
+		}
+		for _, cell := range cells {
+			client.tsch.RemoveLink(client.updateSlotframe, cell.TimeSlot, cell.Channel)
+		}
+	case scheduleupdater.PktTypeUpdateConfirmation:
+		// The slotframe of an update without cells is created here
+		if client.startUpdate() == nil {
+			return scheduleupdater.DeclineReasonSlotframeBusy, 0
+		}
+		// 0 is the handle of the 6TiSCH minimal slotframe: no schedule installed yet
+		if client.installedHandle != 0 && client.installedHandle != client.updateSlotframeHandle {
+			if oldSlotframe := client.tsch.Slotframe(client.installedHandle); oldSlotframe != nil {
+				client.tsch.RemoveSlotframe(oldSlotframe)
+			}
+		}
+		client.installedHandle = client.updateSlotframeHandle
+		client.updateSlotframeHandle = otherSlotframeHandle(&client.geometry, client.installedHandle)
+		client.inUpdate = false
+		client.installedEpoch = epoch
+		client.completedUpdates++
+	case scheduleupdater.PktTypeAbortRequest:
+		client.dropUpdateSlotframe()
+		client.updateSlotframeHandle = otherSlotframeHandle(&client.geometry, client.installedHandle)
+		client.abortedUpdates++
+	}
+	return scheduleupdater.DeclineReasonNone, 0
+}
+
+// dropUpdateSlotframe mirrors `drop_update_slotframe`: the slotframe of an
+// unfinished update is removed, the installed one stays in use.
+func (client *Client) dropUpdateSlotframe() {
+	if client.inUpdate && client.updateSlotframe != nil {
+		client.tsch.RemoveSlotframe(client.updateSlotframe)
+	}
+	client.inUpdate = false
+	client.updateSlotframe = nil
+}
+
+// startUpdate mirrors `update_slotframe`: the first packet of an update creates
+// the new slotframe, a copy of the installed one for an incremental update.
+func (client *Client) startUpdate() *Slotframe {
+	if client.inUpdate {
+		return client.updateSlotframe
+	}
+	client.inUpdate = true
+	client.updateSlotframe, _ = client.tsch.AddSlotframe(client.updateSlotframeHandle, client.geometry.Length)
+	if client.updateSlotframe == nil || !client.incremental {
+		return client.updateSlotframe
+	}
+	if installed := client.tsch.Slotframe(client.installedHandle); installed != nil && client.installedHandle != 0 {
+		for _, link := range installed.Links {
+			if client.tsch.AddLink(client.updateSlotframe, link.LinkOptions, link.Neighbor, link.TimeSlot, link.Channel) != nil {
+				client.addLinkErrors++
+			}
+		}
+	}
+	return client.updateSlotframe
+}
+
+func decodeScheduleHeader(pkt []byte) (scheduleupdater.SlotframeGeometry, bool, error) {
+	const offset = scheduleupdater.PktPrefixSize
+	const headerSize = offset + 4*2 + 1
+	if len(pkt) < headerSize {
+		return scheduleupdater.SlotframeGeometry{}, false, errors.New("the schedule header is too short")
+	}
+	return scheduleupdater.SlotframeGeometry{
+		Handle:       binary.LittleEndian.Uint16(pkt[offset:]),
+		Length:       binary.LittleEndian.Uint16(pkt[offset+2:]),
+		FirstChannel: binary.LittleEndian.Uint16(pkt[offset+4:]),
+		LastChannel:  binary.LittleEndian.Uint16(pkt[offset+6:]),
+	}, pkt[offset+8]&scheduleupdater.ScheduleHeaderFlagIncremental != 0, nil
+}
+
+// InstalledCells returns the cells of the slotframe installed by the last
+// confirmed update, grouped by neighbor.
+func (client *Client) InstalledCells() map[addrtranslation.MacAddr][]scheduleupdater.Cell {
+	client.lock.RLock()
+	defer client.lock.RUnlock()
+	cells := make(map[addrtranslation.MacAddr][]scheduleupdater.Cell)
+	if client.completedUpdates == 0 {
+		return cells
+	}
+	installed := client.tsch.Slotframe(client.installedHandle)
+	if installed == nil {
+		return cells
+	}
+	for _, link := range installed.Links {
+		cells[link.Neighbor] = append(cells[link.Neighbor], link.Cell())
+	}
+	return cells
+}
+
+// CompletedUpdates returns the number of update confirmations processed.
+func (client *Client) CompletedUpdates() int {
+	client.lock.RLock()
+	defer client.lock.RUnlock()
+	return client.completedUpdates
+}
+
+// Epochs returns the epoch of the update in progress and of the installed schedule.
+func (client *Client) Epochs() scheduleupdater.NodeEpoch {
+	client.lock.RLock()
+	defer client.lock.RUnlock()
+	return scheduleupdater.NodeEpoch{Update: client.updateEpoch, Installed: client.installedEpoch}
+}
+
+// AbortedUpdates returns the number of abort requests processed.
+func (client *Client) AbortedUpdates() int {
+	client.lock.RLock()
+	defer client.lock.RUnlock()
+	return client.abortedUpdates
+}
+
+// AddLinkErrors returns the number of cells the node could not install, where
+// `tsch_schedule_add_link` would have failed.
+func (client *Client) AddLinkErrors() int {
+	client.lock.RLock()
+	defer client.lock.RUnlock()
+	return client.addLinkErrors
+}
+
+// CheckSchedule verifies that the cells installed by the node are the cells
+// the server computed for the node `clientIP` in `schedule`.
+func (client *Client) CheckSchedule(schedule scheduleupdater.Schedule, clientIP addrtranslation.IPString) error {
+	installed := client.InstalledCells()
+	expected := schedule.Cells[clientIP]
+	for neighbor, cells := range expected {
+		if !sameCells(installed[neighbor], cells) {
+			return errors.New(fmt.Sprintf("%s installed %+v toward %v instead of %+v", clientIP, installed[neighbor], neighbor, cells))
+		}
+	}
+	for neighbor, cells := range installed {
+		if _, in := expected[neighbor]; !in {
+			return errors.New(fmt.Sprintf("%s installed %+v toward %v which is not in the schedule", clientIP, cells, neighbor))
+		}
+	}
+	return nil
+}
+
+// sameCells compares two lists of cells regardless of their order.
+func sameCells(a []scheduleupdater.Cell, b []scheduleupdater.Cell) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[scheduleupdater.Cell]int)
+	for _, cell := range a {
+		counts[cell]++
+	}
+	for _, cell := range b {
+		counts[cell]--
+		if counts[cell] < 0 {
+			return false
+		}
+	}
+	return true
+}
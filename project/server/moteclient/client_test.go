@@ -0,0 +1,210 @@
+package moteclient
+
+import (
+	"net"
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/scheduleupdater"
+	"scheduleupdater-server/udpack"
+	"testing"
+	"time"
+)
+
+// recordingConn is a net.PacketConn keeping the packets written by the client,
+// the packets are given to the client with `handlePacket`.
+type recordingConn struct {
+	written [][]byte
+}
+
+func (conn *recordingConn) ReadFrom(p []byte) (int, net.Addr, error) { return 0, nil, net.ErrClosed }
+func (conn *recordingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	conn.written = append(conn.written, append([]byte(nil), p...))
+	return len(p), nil
+}
+func (conn *recordingConn) Close() error                       { return nil }
+func (conn *recordingConn) LocalAddr() net.Addr                { return &net.UDPAddr{} }
+func (conn *recordingConn) SetDeadline(t time.Time) error      { return nil }
+func (conn *recordingConn) SetReadDeadline(t time.Time) error  { return nil }
+func (conn *recordingConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// ack is the decoded ACK of a packet sent by the client.
+type ack struct {
+	sequenceNumber uint8
+	reason         scheduleupdater.DeclineReason
+	failedCells    uint8
+}
+
+var serverAddr = &net.UDPAddr{IP: net.ParseIP("fd00::1"), Port: 8765}
+var parentMac = addrtranslation.MacAddr{0, 1, 0, 1, 0, 1, 0, 1}
+
+func newTestClient() (*Client, *recordingConn) {
+	conn := &recordingConn{}
+	return NewClient(conn, serverAddr, addrtranslation.MacAddr{0, 2, 0, 2, 0, 2, 0, 2}, nil), conn
+}
+
+// deliver hands the packet `pkt` with the sequence number `sequenceNumber` to
+// the client and returns the ACKs it sent in response.
+func deliver(t *testing.T, client *Client, conn *recordingConn, sequenceNumber uint8, pkt []byte) []ack {
+	packet, err := udpack.NewDataPacket(sequenceNumber, pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.written = nil
+	client.handlePacket(serverAddr, packet)
+	acks := make([]ack, 0, len(conn.written))
+	for _, written := range conn.written {
+		header, payload := udpack.RemoveHeaderFromPacket(written)
+		if udpack.DecodePacketType(header) != udpack.PacketTypeAck {
+			t.Fatalf("expected an ACK, got packet type %d", udpack.DecodePacketType(header))
+		}
+		acks = append(acks, ack{
+			sequenceNumber: udpack.DecodeSequenceNumber(header),
+			reason:         scheduleupdater.DeclineReason(payload[1]),
+			failedCells:    payload[2],
+		})
+	}
+	return acks
+}
+
+func expectAcks(t *testing.T, acks []ack, sequenceNumbers ...uint8) {
+	t.Helper()
+	if len(acks) != len(sequenceNumbers) {
+		t.Fatalf("expected the ACKs %v, got %v", sequenceNumbers, acks)
+	}
+	for i, sequenceNumber := range sequenceNumbers {
+		if acks[i].sequenceNumber != sequenceNumber {
+			t.Fatalf("expected the ACKs %v, got %v", sequenceNumbers, acks)
+		}
+	}
+}
+
+func updatePackets(epoch scheduleupdater.Epoch, cells []scheduleupdater.Cell) [][]byte {
+	return [][]byte{
+		(&scheduleupdater.ScheduleHeader{Epoch: epoch, Geometry: scheduleupdater.NewDefaultSlotframeGeometry()}).Encode(),
+		(&scheduleupdater.UpdateRequest{Epoch: epoch, NeighborAddr: parentMac, Cells: cells}).Encode(),
+		(&scheduleupdater.UpdateConfirmation{Epoch: epoch}).Encode(),
+	}
+}
+
+func TestReceiveProcessesThePacketsInOrder(t *testing.T) {
+	client, conn := newTestClient()
+	cell := scheduleupdater.Cell{LinkOptions: scheduleupdater.LinkOptionTX, TimeSlot: 1, Channel: 1}
+	pkts := updatePackets(1, []scheduleupdater.Cell{cell})
+
+	// The confirmation and the cells arrive before the header: they are kept
+	// until the header arrives, otherwise the update would be confirmed empty
+	expectAcks(t, deliver(t, client, conn, 3, pkts[2]))
+	expectAcks(t, deliver(t, client, conn, 2, pkts[1]))
+	if client.CompletedUpdates() != 0 {
+		t.Fatalf("the confirmation was processed before the header")
+	}
+	expectAcks(t, deliver(t, client, conn, 1, pkts[0]), 1, 2, 3)
+
+	if client.CompletedUpdates() != 1 {
+		t.Fatalf("expected 1 completed update, got %d", client.CompletedUpdates())
+	}
+	if cells := client.InstalledCells()[parentMac]; len(cells) != 1 || !cells[0].Equals(&cell) {
+		t.Fatalf("expected the installed cell %v, got %v", cell, cells)
+	}
+}
+
+func TestReceiveAcknowledgesTheDuplicatesWithoutProcessingThem(t *testing.T) {
+	client, conn := newTestClient()
+	pkts := updatePackets(1, []scheduleupdater.Cell{{LinkOptions: scheduleupdater.LinkOptionTX, TimeSlot: 1, Channel: 1}})
+	for i, pkt := range pkts {
+		expectAcks(t, deliver(t, client, conn, uint8(i+1), pkt), uint8(i+1))
+	}
+
+	// The ACK of the confirmation was lost and the server sends it again
+	expectAcks(t, deliver(t, client, conn, 3, pkts[2]), 3)
+	if client.CompletedUpdates() != 1 {
+		t.Fatalf("the duplicate confirmation was processed, %d completed updates", client.CompletedUpdates())
+	}
+}
+
+func TestReceiveDropsThePacketsBeyondTheWindow(t *testing.T) {
+	client, conn := newTestClient()
+	query := (&scheduleupdater.EpochQuery{}).Encode()
+
+	// Not acknowledged nor buffered: the server sends it again later
+	expectAcks(t, deliver(t, client, conn, 1+receiveWindow, query))
+	for sequenceNumber := uint8(1); sequenceNumber < 1+receiveWindow; sequenceNumber++ {
+		expectAcks(t, deliver(t, client, conn, sequenceNumber, query), sequenceNumber)
+	}
+	expectAcks(t, deliver(t, client, conn, 1+receiveWindow, query), 1+receiveWindow)
+}
+
+func TestReceiveThroughWrapAround(t *testing.T) {
+	client, conn := newTestClient()
+	query := (&scheduleupdater.EpochQuery{}).Encode()
+	sequenceNumber := uint8(1)
+	// Each pair of packets arrives swapped
+	for i := 0; i < 3*udpack.SequenceNumberSpace/2; i++ {
+		next := (sequenceNumber + 1) % udpack.SequenceNumberSpace
+		expectAcks(t, deliver(t, client, conn, next, query))
+		expectAcks(t, deliver(t, client, conn, sequenceNumber, query), sequenceNumber, next)
+		sequenceNumber = (next + 1) % udpack.SequenceNumberSpace
+	}
+}
+
+func TestStaleEpochPacketsAreDeclined(t *testing.T) {
+	client, conn := newTestClient()
+	cells := []scheduleupdater.Cell{
+		{LinkOptions: scheduleupdater.LinkOptionTX, TimeSlot: 1, Channel: 1},
+		{LinkOptions: scheduleupdater.LinkOptionTX, TimeSlot: 2, Channel: 1},
+	}
+	first, second := updatePackets(1, cells[:1]), updatePackets(2, cells)
+	expectAcks(t, deliver(t, client, conn, 1, first[0]), 1)
+	expectAcks(t, deliver(t, client, conn, 2, second[0]), 2)
+
+	// The cells and the header of the epoch 1 arrive after the header of the
+	// epoch 2: they must not modify the slotframe of the epoch 2
+	acks := deliver(t, client, conn, 3, first[1])
+	expectAcks(t, acks, 3)
+	if acks[0].reason != scheduleupdater.DeclineReasonStaleEpoch || acks[0].failedCells != 1 {
+		t.Fatalf("expected a stale epoch decline of 1 cell, got %v with %d failed cells", acks[0].reason, acks[0].failedCells)
+	}
+	acks = deliver(t, client, conn, 4, first[0])
+	expectAcks(t, acks, 4)
+	if acks[0].reason != scheduleupdater.DeclineReasonStaleEpoch {
+		t.Fatalf("expected a stale epoch decline of the header, got %v", acks[0].reason)
+	}
+
+	expectAcks(t, deliver(t, client, conn, 5, second[1]), 5)
+	acks = deliver(t, client, conn, 6, second[2])
+	expectAcks(t, acks, 6)
+	if acks[0].reason != scheduleupdater.DeclineReasonNone {
+		t.Fatalf("the confirmation of the epoch 2 was declined: %v", acks[0].reason)
+	}
+	if epochs := client.Epochs(); epochs.Installed != 2 {
+		t.Fatalf("expected the epoch 2 to be installed, got %v", epochs)
+	}
+	if installed := client.InstalledCells()[parentMac]; len(installed) != len(cells) {
+		t.Fatalf("expected the %d cells of the epoch 2, got %v", len(cells), installed)
+	}
+}
+
+func TestConfirmationWithoutCellsInstallsAnEmptySlotframe(t *testing.T) {
+	client, conn := newTestClient()
+	first := updatePackets(1, []scheduleupdater.Cell{{LinkOptions: scheduleupdater.LinkOptionTX, TimeSlot: 1, Channel: 1}})
+	for i, pkt := range first {
+		expectAcks(t, deliver(t, client, conn, uint8(i+1), pkt), uint8(i+1))
+	}
+
+	// The node has no cell anymore: the update only holds the header and the confirmation
+	second := updatePackets(2, nil)
+	expectAcks(t, deliver(t, client, conn, 4, second[0]), 4)
+	acks := deliver(t, client, conn, 5, second[2])
+	expectAcks(t, acks, 5)
+	if acks[0].reason != scheduleupdater.DeclineReasonNone {
+		t.Fatalf("the confirmation of the empty update was declined: %v", acks[0].reason)
+	}
+	if client.CompletedUpdates() != 2 {
+		t.Fatalf("expected 2 completed updates, got %d", client.CompletedUpdates())
+	}
+	if installed := client.tsch.Slotframe(client.installedHandle); installed == nil || len(installed.Links) != 0 {
+		t.Fatalf("expected an empty installed slotframe, got %v", installed)
+	}
+	if cells := client.InstalledCells(); len(cells) != 0 {
+		t.Fatalf("expected no installed cell, got %v", cells)
+	}
+}
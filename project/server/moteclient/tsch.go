@@ -0,0 +1,127 @@
+package moteclient
+
+// TSCH: a model of the TSCH schedule of a Contiki-NG node (os/net/mac/tsch/tsch-schedule.c).
+// Only the behaviours that matter to the schedule updater are modelled: the
+// slotframes, the links and the limits on their number.
+
+import (
+	"errors"
+	"fmt"
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/scheduleupdater"
+)
+
+const (
+	// MaxSlotframes is TSCH_SCHEDULE_MAX_SLOTFRAMES
+	MaxSlotframes = 5
+	// MaxLinks is TSCH_SCHEDULE_MAX_LINKS, the links of all the slotframes share this pool
+	MaxLinks = 32
+	// DefaultSlotframeLength is TSCH_SCHEDULE_CONF_DEFAULT_LENGTH in client/project-conf.h
+	DefaultSlotframeLength = 21
+)
+
+// Link is a cell installed in a slotframe toward a neighbor.
+type Link struct {
+	LinkOptions scheduleupdater.LinkOptions
+	Neighbor    addrtranslation.MacAddr
+	TimeSlot    uint16
+	Channel     uint16
+}
+
+func (link *Link) Cell() scheduleupdater.Cell {
+	return scheduleupdater.Cell{
+		LinkOptions: link.LinkOptions,
+		TimeSlot:    link.TimeSlot,
+		Channel:     link.Channel,
+	}
+}
+
+type Slotframe struct {
+	Handle uint16
+	Size   uint16
+	Links  []Link
+}
+
+// TSCHSchedule is the set of slotframes of a node. This struct is not thread safe.
+type TSCHSchedule struct {
+	slotframes []*Slotframe
+	linksCount int
+}
+
+// NewTSCHSchedule returns a schedule containing the 6TiSCH minimal slotframe
+// as created by `tsch_schedule_create_minimal`.
+func NewTSCHSchedule() *TSCHSchedule {
+	schedule := &TSCHSchedule{}
+	minimal, _ := schedule.AddSlotframe(0, DefaultSlotframeLength)
+	_ = schedule.AddLink(minimal, scheduleupdater.LinkOptionRX|scheduleupdater.LinkOptionTX|
+		scheduleupdater.LinkOptionShared|scheduleupdater.LinkOptionTimeKeeping,
+		addrtranslation.MacAddr{}, 0, 0)
+	return schedule
+}
+
+func (schedule *TSCHSchedule) AddSlotframe(handle uint16, size uint16) (*Slotframe, error) {
+	if size == 0 {
+		return nil, errors.New("the slotframe size must be greater than 0")
+	}
+	if schedule.Slotframe(handle) != nil {
+		return nil, errors.New(fmt.Sprintf("a slotframe with the handle %d already exists", handle))
+	}
+	if len(schedule.slotframes) >= MaxSlotframes {
+		return nil, errors.New("no slotframe left")
+	}
+	slotframe := &Slotframe{Handle: handle, Size: size}
+	schedule.slotframes = append(schedule.slotframes, slotframe)
+	return slotframe, nil
+}
+
+func (schedule *TSCHSchedule) Slotframe(handle uint16) *Slotframe {
+	for _, slotframe := range schedule.slotframes {
+		if slotframe.Handle == handle {
+			return slotframe
+		}
+	}
+	return nil
+}
+
+func (schedule *TSCHSchedule) RemoveSlotframe(slotframe *Slotframe) {
+	for i, s := range schedule.slotframes {
+		if s == slotframe {
+			schedule.linksCount -= len(slotframe.Links)
+			schedule.slotframes = append(schedule.slotframes[:i], schedule.slotframes[i+1:]...)
+			return
+		}
+	}
+}
+
+// AddLink mirrors `tsch_schedule_add_link` called with `do_remove`: the link
+// already installed at the same timeslot and channel offset is replaced.
+func (schedule *TSCHSchedule) AddLink(slotframe *Slotframe, linkOptions scheduleupdater.LinkOptions, neighbor addrtranslation.MacAddr, timeslot uint16, channel uint16) error {
+	if timeslot > slotframe.Size-1 {
+		return errors.New(fmt.Sprintf("invalid timeslot %d for a slotframe of size %d", timeslot, slotframe.Size))
+	}
+	schedule.RemoveLink(slotframe, timeslot, channel)
+	if schedule.linksCount >= MaxLinks {
+		return errors.New("no link left")
+	}
+	slotframe.Links = append(slotframe.Links, Link{
+		LinkOptions: linkOptions,
+		Neighbor:    neighbor,
+		TimeSlot:    timeslot,
+		Channel:     channel,
+	})
+	schedule.linksCount++
+	return nil
+}
+
+// RemoveLink removes the links installed at `timeslot` and `channel`.
+func (schedule *TSCHSchedule) RemoveLink(slotframe *Slotframe, timeslot uint16, channel uint16) {
+	links := slotframe.Links[:0]
+	for _, link := range slotframe.Links {
+		if link.TimeSlot == timeslot && link.Channel == channel {
+			schedule.linksCount--
+			continue
+		}
+		links = append(links, link)
+	}
+	slotframe.Links = links
+}
@@ -0,0 +1,185 @@
+package main
+
+// Rescheduler: the server keeps running after the first schedule is installed.
+// The applications signal when the information sent by the nodes changes, the
+// changes are gathered until the network is quiet for the debounce delay, and
+// a new schedule is then computed and sent to the nodes. Each round writes its
+// own stats file.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"scheduleupdater-server/applications"
+	"scheduleupdater-server/scheduler"
+	"scheduleupdater-server/scheduleupdater"
+	"scheduleupdater-server/stats"
+	"scheduleupdater-server/utils"
+	"strings"
+	"time"
+)
+
+// maxDebounceFactor bounds the time a round is delayed by changes that keep
+// coming: the round starts at the latest this number of debounce delays after
+// the first change.
+const maxDebounceFactor = 4
+
+// readyPollInterval is the time waited before checking again whether the
+// applications are ready for the first round.
+var readyPollInterval = 4 * time.Second
+
+type rescheduler struct {
+	scheduler    scheduler.Scheduler
+	updater      *scheduleupdater.Updater
+	appGraph     *applications.ApplicationGraph
+	appBandwidth *applications.ApplicationBandwidth
+	appTopology  *applications.ApplicationTopology
+	discovery    *applications.NodeDiscovery
+	// minNodes is the number of nodes discovered before the first round
+	minNodes uint
+	// debounce is the time without changes waited before a new round
+	debounce time.Duration
+	// once stops the server after the first round, as before the rescheduling
+	once  bool
+	round uint
+}
+
+// run installs a first schedule when all the applications are ready, then a
+// new one after each change of the network.
+func (r *rescheduler) run() {
+	r.waitReady()
+	// The changes received before the applications were ready are part of
+	// the first schedule
+	r.pendingChanges()
+	err := r.schedule([]string{"ready"})
+	if r.once {
+		if err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	for {
+		r.schedule(r.waitChanges())
+	}
+}
+
+func (r *rescheduler) waitReady() {
+	for {
+		// Wait till enough nodes joined and all applications are ready for them
+		nodes := r.discovery.Addrs()
+		appGraphReady := r.appGraph.ReadyFor(nodes)
+		appBandwidthReady := r.appBandwidth.ReadyFor(nodes)
+		appTopologyReady := r.appTopology.ReadyFor(nodes)
+		if uint(len(nodes)) >= r.minNodes && appGraphReady && appBandwidthReady && appTopologyReady {
+			return
+		}
+		if uint(len(nodes)) < r.minNodes {
+			utils.Log.WarningPrintln("Discovered ", len(nodes), " of ", r.minNodes, " nodes...")
+		}
+		if !appGraphReady {
+			utils.Log.WarningPrintln("App Graph is not ready yet...")
+		}
+		if !appBandwidthReady {
+			utils.Log.WarningPrintln("App Bandwidth is not ready yet...")
+		}
+		if !appTopologyReady {
+			utils.Log.WarningPrintln("App Topology is not ready yet...")
+		}
+		time.Sleep(readyPollInterval)
+	}
+}
+
+// pendingChanges consumes the changes already signaled by the applications
+// and returns the names of the applications that changed.
+func (r *rescheduler) pendingChanges() []string {
+	changed := make([]string, 0)
+	for {
+		select {
+		case <-r.appGraph.Changes():
+			changed = addTrigger(changed, "graph")
+		case <-r.appBandwidth.Changes():
+			changed = addTrigger(changed, "bandwidth")
+		case <-r.appTopology.Changes():
+			changed = addTrigger(changed, "topology")
+		case <-r.discovery.Changes():
+			changed = addTrigger(changed, "nodes")
+		default:
+			return changed
+		}
+	}
+}
+
+// waitChanges blocks until an application changes and no other change
+// happened during the debounce delay, and returns the names of the
+// applications that changed.
+func (r *rescheduler) waitChanges() []string {
+	changed := make([]string, 0)
+	var quiet, deadline <-chan time.Time
+	for {
+		select {
+		case <-r.appGraph.Changes():
+			changed = addTrigger(changed, "graph")
+		case <-r.appBandwidth.Changes():
+			changed = addTrigger(changed, "bandwidth")
+		case <-r.appTopology.Changes():
+			changed = addTrigger(changed, "topology")
+		case <-r.discovery.Changes():
+			changed = addTrigger(changed, "nodes")
+		case <-quiet:
+			return changed
+		case <-deadline:
+			utils.Log.WarningPrintln("The network keeps changing, scheduling anyway")
+			return changed
+		}
+		if deadline == nil {
+			deadline = time.After(maxDebounceFactor * r.debounce)
+		}
+		quiet = time.After(r.debounce)
+	}
+}
+
+func addTrigger(triggers []string, name string) []string {
+	for _, trigger := range triggers {
+		if trigger == name {
+			return triggers
+		}
+	}
+	return append(triggers, name)
+}
+
+// schedule computes a new schedule and sends it to the nodes, the stats of
+// the round are written to their own file.
+func (r *rescheduler) schedule(trigger []string) error {
+	r.round++
+	log.Printf("Scheduling round %d after changes of %s\n", r.round, strings.Join(trigger, ", "))
+	stats.SimulationStats.NewRound(r.round, trigger)
+	clients := r.discovery.Addrs()
+	stats.SimulationStats.Nclients = uint(len(clients))
+	r.updater.SetClients(clients)
+	err := r.updateClients()
+	if err != nil {
+		utils.Log.ErrorPrintln("Scheduling round ", r.round, " failed: ", err)
+		stats.SimulationStats.Error = err.Error()
+	}
+	stats.SimulationStats.Epoch = uint16(r.updater.Epoch())
+	stats.SimulationStats.WriteToFile(fmt.Sprintf("stats-round%d-", r.round))
+	return err
+}
+
+// updateClients schedules a snapshot of the information of the applications,
+// which keep being updated by the nodes during the round.
+func (r *rescheduler) updateClients() error {
+	graph := r.appGraph.Snapshot()
+	bandwidthMap := r.appBandwidth.Snapshot()
+	topology := r.appTopology.Topology.Snapshot()
+	if err := graph.Check(); err != nil {
+		utils.Log.WarningPrintln("Scheduling an inconsistent RPL graph: ", err)
+	}
+	schedule, err := r.scheduler.Schedule(&graph, &bandwidthMap, &topology)
+	if err != nil {
+		return err
+	}
+	renegotiator := scheduler.NewRenegotiator(r.scheduler, &graph, &bandwidthMap, &topology)
+	r.updater.SetRenegotiation(renegotiator.Renegotiate)
+	return r.updater.UpdateClients(&schedule, &graph)
+}
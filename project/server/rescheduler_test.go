@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net"
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/applications"
+	"testing"
+	"time"
+)
+
+func newTestRescheduler(debounce time.Duration) *rescheduler {
+	appGraph := applications.NewApplicationGraph(1)
+	appBandwidth := applications.NewApplicationBandwidth(1)
+	appTopology := applications.NewApplicationTopology(1)
+	return &rescheduler{
+		appGraph:     &appGraph,
+		appBandwidth: &appBandwidth,
+		appTopology:  &appTopology,
+		discovery:    applications.NewNodeDiscovery(0),
+		debounce:     debounce,
+	}
+}
+
+var testNodeAddr = &net.UDPAddr{IP: net.ParseIP("fd00::202:2:2:2"), Port: 8765}
+
+// changeBandwidth makes the node report the bandwidth `bandwidth`.
+func changeBandwidth(r *rescheduler, bandwidth byte) {
+	r.appBandwidth.ProcessPacket(testNodeAddr, []byte{bandwidth})
+}
+
+// changeTopology makes the node report its MAC address without neighbors.
+func changeTopology(r *rescheduler) {
+	r.appTopology.ProcessPacket(testNodeAddr, []byte{0, 2, 0, 2, 0, 2, 0, 2})
+}
+
+// startWaitChanges calls waitChanges in the background, the returned channel
+// receives its result.
+func startWaitChanges(r *rescheduler) <-chan []string {
+	result := make(chan []string, 1)
+	go func() { result <- r.waitChanges() }()
+	return result
+}
+
+func TestWaitChangesCoalescesABurst(t *testing.T) {
+	const debounce = 50 * time.Millisecond
+	r := newTestRescheduler(debounce)
+	result := startWaitChanges(r)
+	start := time.Now()
+	for bandwidth := byte(1); bandwidth <= 5; bandwidth++ {
+		changeBandwidth(r, bandwidth)
+		time.Sleep(debounce / 5)
+	}
+	changeTopology(r)
+	lastChange := time.Now()
+
+	triggers := <-result
+	if time.Since(lastChange) < debounce {
+		t.Errorf("the round started %v after the last change, before the debounce delay %v", time.Since(lastChange), debounce)
+	}
+	if len(triggers) != 2 || triggers[0] != "bandwidth" || triggers[1] != "topology" {
+		t.Errorf("got the triggers %v, expected [bandwidth topology]", triggers)
+	}
+	if time.Since(start) > maxDebounceFactor*debounce {
+		t.Errorf("the burst took %v, longer than the cap of the debounce", time.Since(start))
+	}
+	// The whole burst is a single round
+	select {
+	case triggers := <-startWaitChanges(r):
+		t.Errorf("a second round started after the changes of %v", triggers)
+	case <-time.After(3 * debounce):
+	}
+}
+
+func TestWaitChangesIsCappedByMaxDebounceFactor(t *testing.T) {
+	const debounce = 50 * time.Millisecond
+	r := newTestRescheduler(debounce)
+	stop := make(chan struct{})
+	defer close(stop)
+	// The changes keep coming faster than the debounce delay
+	go func() {
+		for bandwidth := byte(0); ; bandwidth++ {
+			select {
+			case <-stop:
+				return
+			case <-time.After(debounce / 5):
+				changeBandwidth(r, bandwidth)
+			}
+		}
+	}()
+
+	start := time.Now()
+	select {
+	case <-startWaitChanges(r):
+		elapsed := time.Since(start)
+		if elapsed < maxDebounceFactor*debounce {
+			t.Errorf("the round started after %v, before the cap %v", elapsed, maxDebounceFactor*debounce)
+		}
+	case <-time.After(2 * maxDebounceFactor * debounce):
+		t.Fatalf("no round started after %v of changes", 2*maxDebounceFactor*debounce)
+	}
+}
+
+func TestPendingChangesConsumesTheChanges(t *testing.T) {
+	r := newTestRescheduler(time.Second)
+	if triggers := r.pendingChanges(); len(triggers) != 0 {
+		t.Fatalf("got the triggers %v without changes", triggers)
+	}
+	changeBandwidth(r, 1)
+	changeBandwidth(r, 2)
+	changeTopology(r)
+	triggers := r.pendingChanges()
+	if len(triggers) != 2 || triggers[0] == triggers[1] {
+		t.Fatalf("got the triggers %v, expected bandwidth and topology", triggers)
+	}
+	if triggers := r.pendingChanges(); len(triggers) != 0 {
+		t.Fatalf("the triggers %v were consumed twice", triggers)
+	}
+}
+
+func TestWaitReadyReturnsOnceTheApplicationsAreReady(t *testing.T) {
+	defer func(interval time.Duration) { readyPollInterval = interval }(readyPollInterval)
+	readyPollInterval = 10 * time.Millisecond
+	r := newTestRescheduler(time.Second)
+	r.minNodes = 1
+	r.discovery.Seen(addrtranslation.AddrToIPString(testNodeAddr), time.Now())
+
+	ready := make(chan struct{})
+	go func() {
+		r.waitReady()
+		close(ready)
+	}()
+	changeBandwidth(r, 1)
+	select {
+	case <-ready:
+		t.Fatal("the applications were ready without the topology")
+	case <-time.After(10 * readyPollInterval):
+	}
+	changeTopology(r)
+	select {
+	case <-ready:
+	case <-time.After(100 * readyPollInterval):
+		t.Fatal("the applications are still not ready")
+	}
+}
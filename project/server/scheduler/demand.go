@@ -0,0 +1,47 @@
+package scheduler
+
+import (
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/applications"
+	"sort"
+)
+
+// linkDemand is the number of cells needed on the link between a node and its
+// RPL parent. A node does not only send its own packets to its parent, it also
+// forwards the packets of its whole subtree.
+type linkDemand struct {
+	child  addrtranslation.IPString
+	parent addrtranslation.IPString
+	// upstream is the bandwidth of the child plus the bandwidth of its subtree
+	upstream uint
+	// downstream is one cell for the child and for each node of its subtree, so
+	// that the server can reach every node
+	downstream uint
+}
+
+// linkDemands returns the demand of each link of the RPL graph, sorted by child address.
+func linkDemands(graph *applications.RPLGraph, bandwidthMap *applications.BandwidthMap) ([]*linkDemand, error) {
+	// The subtrees cut from the root are scheduled, but a cycle has no root
+	if err := graph.CheckCycles(); err != nil {
+		return nil, err
+	}
+	demands := make(map[addrtranslation.IPString]*linkDemand, len(*graph))
+	for child, rplLink := range *graph {
+		demands[child] = &linkDemand{child: child, parent: rplLink.ParentIP}
+	}
+	// The packets of each node go through all the links up to the root
+	for mote := range demands {
+		bandwidth := (*bandwidthMap)[mote]
+		for demand, in := demands[mote]; in; demand, in = demands[demand.parent] {
+			demand.upstream += bandwidth
+			demand.downstream++
+		}
+	}
+
+	sorted := make([]*linkDemand, 0, len(demands))
+	for _, demand := range demands {
+		sorted = append(sorted, demand)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].child < sorted[j].child })
+	return sorted, nil
+}
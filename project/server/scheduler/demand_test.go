@@ -0,0 +1,68 @@
+package scheduler
+
+import (
+	"scheduleupdater-server/applications"
+	"testing"
+)
+
+func TestLinkDemandsAggregateTheSubtrees(t *testing.T) {
+	// 1 is the root, 3 and 4 forward their packets through 2
+	graph, bandwidthMap, _ := newTestNetwork(map[byte]byte{2: 1, 3: 2, 4: 2, 5: 1}, 0)
+	bandwidths := map[byte]uint{2: 1, 3: 2, 4: 3, 5: 4}
+	for id, bandwidth := range bandwidths {
+		_, ip := testMote(id)
+		bandwidthMap[ip] = bandwidth
+	}
+
+	demands, err := linkDemands(&graph, &bandwidthMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[byte]linkDemand{
+		2: {upstream: 1 + 2 + 3, downstream: 3},
+		3: {upstream: 2, downstream: 1},
+		4: {upstream: 3, downstream: 1},
+		5: {upstream: 4, downstream: 1},
+	}
+	if len(demands) != len(expected) {
+		t.Fatalf("expected %d link demands, got %d", len(expected), len(demands))
+	}
+	for i, demand := range demands {
+		if i > 0 && demands[i-1].child >= demand.child {
+			t.Errorf("the demands are not sorted by child: %s before %s", demands[i-1].child, demand.child)
+		}
+	}
+	for id, want := range expected {
+		_, childIP := testMote(id)
+		var demand *linkDemand
+		for _, d := range demands {
+			if d.child == childIP {
+				demand = d
+			}
+		}
+		if demand == nil {
+			t.Errorf("no demand for the link of %d", id)
+			continue
+		}
+		if demand.parent != graph[childIP].ParentIP {
+			t.Errorf("the link of %d goes to %s, expected its parent %s", id, demand.parent, graph[childIP].ParentIP)
+		}
+		if demand.upstream != want.upstream || demand.downstream != want.downstream {
+			t.Errorf("the link of %d needs %d up and %d down, expected %d up and %d down",
+				id, demand.upstream, demand.downstream, want.upstream, want.downstream)
+		}
+	}
+}
+
+func TestLinkDemandsRejectCycles(t *testing.T) {
+	_, ip1 := testMote(1)
+	_, ip2 := testMote(2)
+	graph := applications.RPLGraph{
+		ip1: &applications.RPLLink{ParentIP: ip2},
+		ip2: &applications.RPLLink{ParentIP: ip1},
+	}
+	bandwidthMap := applications.BandwidthMap{ip1: 1, ip2: 1}
+	if _, err := linkDemands(&graph, &bandwidthMap); err == nil {
+		t.Fatal("expected an error for the cycle between 1 and 2")
+	}
+}
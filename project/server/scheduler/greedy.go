@@ -0,0 +1,80 @@
+package scheduler
+
+import (
+	"errors"
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/applications"
+	"scheduleupdater-server/scheduleupdater"
+)
+
+// Greedy allocates to each link of the RPL graph the first free cells, scanning
+// the channels and then the timeslots of the slotframe geometry. Each link gets enough cells
+// to carry the traffic of the child and of its subtree in both directions.
+// In a real use case, a good centralized scheduler like TASA should be used.
+type Greedy struct {
+	geometry     scheduleupdater.SlotframeGeometry
+	interference Interference
+}
+
+func NewGreedy(geometry scheduleupdater.SlotframeGeometry, interference Interference) *Greedy {
+	return &Greedy{geometry: geometry, interference: interference}
+}
+
+func (greedy *Greedy) Schedule(graph *applications.RPLGraph, bandwidthMap *applications.BandwidthMap, topology *applications.Topology) (scheduleupdater.Schedule, error) {
+	demands, err := linkDemands(graph, bandwidthMap)
+	if err != nil {
+		return scheduleupdater.Schedule{}, err
+	}
+	schedule := scheduleupdater.NewSchedule(greedy.geometry)
+	model := newConflictModel(topology, greedy.interference)
+	for _, demand := range demands {
+		// Add the descending cells to join the node and its subtree from the server
+		for i := uint(0); i < demand.downstream; i++ {
+			err := addOneCell(&schedule, model, demand.parent, demand.child, topology)
+			if err != nil {
+				return scheduleupdater.Schedule{}, err
+			}
+		}
+		for i := uint(0); i < demand.upstream; i++ {
+			err := addOneCell(&schedule, model, demand.child, demand.parent, topology)
+			if err != nil {
+				return scheduleupdater.Schedule{}, err
+			}
+		}
+	}
+	return schedule, nil
+}
+
+// addOneCell allocates to the link from `mote` to `neighbor` the first cell
+// that does not conflict with the cells already allocated.
+func addOneCell(schedule *scheduleupdater.Schedule, model *conflictModel, mote addrtranslation.IPString, neighbor addrtranslation.IPString, topology *applications.Topology) error {
+	macNeighbor, ok := topology.MacIPTranslation.FindMac(neighbor)
+	if !ok {
+		return errors.New("could not find the mac address associated with the neighbor")
+	}
+	macMote, ok := topology.MacIPTranslation.FindMac(mote)
+	if !ok {
+		return errors.New("could not find the mac address associated with the current mote")
+	}
+	geometry := &schedule.Geometry
+	for channel := geometry.FirstChannel; channel <= geometry.LastChannel; channel++ {
+		for timeslot := uint16(firstTimeslot); timeslot < geometry.Length; timeslot++ {
+			if !model.isFree(mote, neighbor, timeslot, channel) {
+				continue
+			}
+			model.reserve(mote, neighbor, timeslot, channel)
+			schedule.AddCell(mote, macNeighbor, &scheduleupdater.Cell{
+				LinkOptions: scheduleupdater.LinkOptionTX,
+				TimeSlot:    timeslot,
+				Channel:     channel,
+			})
+			schedule.AddCell(neighbor, macMote, &scheduleupdater.Cell{
+				LinkOptions: scheduleupdater.LinkOptionRX,
+				TimeSlot:    timeslot,
+				Channel:     channel,
+			})
+			return nil
+		}
+	}
+	return errors.New("no available cell left")
+}
@@ -0,0 +1,60 @@
+package scheduler
+
+import (
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/applications"
+	"scheduleupdater-server/scheduleupdater"
+	"testing"
+)
+
+// testMote returns the MAC address and the IP address of the Cooja mote `id`.
+func testMote(id byte) (addrtranslation.MacAddr, addrtranslation.IPString) {
+	mac := addrtranslation.MacAddr{0, id, 0, id, 0, id, 0, id}
+	return mac, mac.GlobalIP()
+}
+
+// newTestNetwork returns the inputs of a scheduler for the RPL tree `parents`
+// (child id to parent id), where each mote hears its parent and its children,
+// and sends `bandwidth` packets.
+func newTestNetwork(parents map[byte]byte, bandwidth uint) (applications.RPLGraph, applications.BandwidthMap, *applications.Topology) {
+	graph := make(applications.RPLGraph)
+	bandwidthMap := make(applications.BandwidthMap)
+	neighbors := make(map[byte][]*addrtranslation.MacAddr)
+	for child, parent := range parents {
+		childMac, childIP := testMote(child)
+		parentMac, parentIP := testMote(parent)
+		graph[childIP] = &applications.RPLLink{ParentIP: parentIP}
+		bandwidthMap[childIP] = bandwidth
+		neighbors[child] = append(neighbors[child], &parentMac)
+		neighbors[parent] = append(neighbors[parent], &childMac)
+	}
+	topology := applications.NewTopology()
+	for id, moteNeighbors := range neighbors {
+		mac, ip := testMote(id)
+		topology.SetNeighbors(ip, &applications.TopologyPacket{MoteAddr: &mac, Neighbors: moteNeighbors})
+	}
+	return graph, bandwidthMap, &topology
+}
+
+// countCells returns the number of cells of `node` toward all its neighbors.
+func countCells(schedule *scheduleupdater.Schedule, node addrtranslation.IPString) int {
+	cells := 0
+	for _, neighborCells := range schedule.Cells[node] {
+		cells += len(neighborCells)
+	}
+	return cells
+}
+
+// newTestRenegotiator returns a Renegotiator of the TASA schedule of a small
+// tree, and this schedule.
+func newTestRenegotiator(t *testing.T) (*Renegotiator, *scheduleupdater.Schedule) {
+	geometry := scheduleupdater.NewDefaultSlotframeGeometry()
+	geometry.Length = 101
+	tasa := NewTASA(geometry, NewDefaultInterference())
+	graph, bandwidthMap, topology := newTestNetwork(map[byte]byte{2: 1, 3: 2, 4: 2}, 2)
+	schedule, err := tasa.Schedule(&graph, &bandwidthMap, topology)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewRenegotiator(tasa, &graph, &bandwidthMap, topology), &schedule
+}
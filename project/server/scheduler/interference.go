@@ -0,0 +1,138 @@
+package scheduler
+
+// Interference: the conflict model shared by the schedulers. A node can take
+// part in a single link per timeslot (half-duplex), and a cell (timeslot,
+// channel offset) can only be reused by links far enough from the links
+// already using it. With the default reuse distance of 2 hops, a cell is
+// forbidden to a link as soon as the transmitter, the receiver or any of their
+// neighbors is active on it, which covers the two-hop neighborhood of the link
+// and therefore the hidden terminals.
+
+import (
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/applications"
+)
+
+const DefaultReuseDistance = 2
+
+type Interference struct {
+	// ReuseDistance is the minimal number of hops between the nodes of two
+	// links sharing a cell. 0 disables the reuse: a cell is used by one link only.
+	ReuseDistance uint
+}
+
+func NewDefaultInterference() Interference {
+	return Interference{ReuseDistance: DefaultReuseDistance}
+}
+
+type cellKey struct {
+	timeslot uint16
+	channel  uint16
+}
+
+// conflictModel keeps track of the cells allocated while a schedule is computed.
+type conflictModel struct {
+	interference Interference
+	neighbors    map[addrtranslation.IPString]map[addrtranslation.IPString]bool
+	// busy are the nodes taking part in a link for each timeslot
+	busy map[uint16]map[addrtranslation.IPString]bool
+	// active are the nodes taking part in a link for each cell
+	active map[cellKey][]addrtranslation.IPString
+	// distances caches the hop distances computed from a node
+	distances map[addrtranslation.IPString]map[addrtranslation.IPString]uint
+}
+
+func newConflictModel(topology *applications.Topology, interference Interference) *conflictModel {
+	return &conflictModel{
+		interference: interference,
+		neighbors:    neighborsIPs(topology),
+		busy:         make(map[uint16]map[addrtranslation.IPString]bool),
+		active:       make(map[cellKey][]addrtranslation.IPString),
+		distances:    make(map[addrtranslation.IPString]map[addrtranslation.IPString]uint),
+	}
+}
+
+// isFree reports whether the link from `transmitter` to `receiver` can use the
+// cell without interfering with the links already allocated.
+func (model *conflictModel) isFree(transmitter addrtranslation.IPString, receiver addrtranslation.IPString, timeslot uint16, channel uint16) bool {
+	if model.busy[timeslot][transmitter] || model.busy[timeslot][receiver] {
+		return false
+	}
+	for _, node := range model.active[cellKey{timeslot, channel}] {
+		if model.interference.ReuseDistance == 0 {
+			return false
+		}
+		if model.isWithinReuseDistance(transmitter, node) || model.isWithinReuseDistance(receiver, node) {
+			return false
+		}
+	}
+	return true
+}
+
+// reserve marks the cell as used by the link from `transmitter` to `receiver`.
+func (model *conflictModel) reserve(transmitter addrtranslation.IPString, receiver addrtranslation.IPString, timeslot uint16, channel uint16) {
+	busy, in := model.busy[timeslot]
+	if !in {
+		busy = make(map[addrtranslation.IPString]bool)
+		model.busy[timeslot] = busy
+	}
+	busy[transmitter] = true
+	busy[receiver] = true
+	key := cellKey{timeslot, channel}
+	model.active[key] = append(model.active[key], transmitter, receiver)
+}
+
+func (model *conflictModel) isWithinReuseDistance(from addrtranslation.IPString, to addrtranslation.IPString) bool {
+	distances, in := model.distances[from]
+	if !in {
+		distances = model.hopDistances(from)
+		model.distances[from] = distances
+	}
+	_, in = distances[to]
+	return in
+}
+
+// hopDistances returns the nodes closer than the reuse distance to `from` with
+// their distance in hops (breadth-first search).
+func (model *conflictModel) hopDistances(from addrtranslation.IPString) map[addrtranslation.IPString]uint {
+	distances := map[addrtranslation.IPString]uint{from: 0}
+	frontier := []addrtranslation.IPString{from}
+	for hops := uint(1); hops < model.interference.ReuseDistance && len(frontier) > 0; hops++ {
+		next := make([]addrtranslation.IPString, 0)
+		for _, node := range frontier {
+			for neighbor := range model.neighbors[node] {
+				if _, in := distances[neighbor]; !in {
+					distances[neighbor] = hops
+					next = append(next, neighbor)
+				}
+			}
+		}
+		frontier = next
+	}
+	return distances
+}
+
+// neighborsIPs returns, for each node, the set of the IP addresses of its
+// neighbors. The relation is made symmetric since a node reporting a neighbor
+// can be heard by this neighbor. A neighbor that did not report its MAC
+// address yet has the address derived from it (EUI-64).
+func neighborsIPs(topology *applications.Topology) map[addrtranslation.IPString]map[addrtranslation.IPString]bool {
+	neighbors := make(map[addrtranslation.IPString]map[addrtranslation.IPString]bool)
+	add := func(a addrtranslation.IPString, b addrtranslation.IPString) {
+		if neighbors[a] == nil {
+			neighbors[a] = make(map[addrtranslation.IPString]bool)
+		}
+		neighbors[a][b] = true
+	}
+	for mote, macNeighbors := range topology.TopologyMap {
+		for _, macNeighbor := range macNeighbors {
+			neighbor, ok := topology.MacIPTranslation.Find(*macNeighbor)
+			if !ok {
+				neighbor = macNeighbor.GlobalIP()
+			}
+			add(mote, neighbor)
+			add(neighbor, mote)
+		}
+	}
+	return neighbors
+}
@@ -0,0 +1,54 @@
+package scheduler
+
+import (
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/applications"
+	"testing"
+)
+
+func TestConflictModelReuseDistance(t *testing.T) {
+	// The chain 6 -> 5 -> 4 -> 3 -> 2 -> 1, where the link 6 -> 5 uses the cell (1, 1)
+	_, _, topology := newTestNetwork(map[byte]byte{2: 1, 3: 2, 4: 3, 5: 4, 6: 5}, 1)
+	tests := []struct {
+		name                  string
+		reuseDistance         uint
+		transmitter, receiver byte
+		timeslot              uint16
+		channel               uint16
+		free                  bool
+	}{
+		{"2 hops away with the default distance", DefaultReuseDistance, 3, 2, 1, 1, true},
+		{"a neighbor of the transmitter is active", DefaultReuseDistance, 4, 3, 1, 1, false},
+		{"a neighbor of the receiver is active", DefaultReuseDistance, 3, 4, 1, 1, false},
+		{"another channel of the timeslot", DefaultReuseDistance, 4, 3, 1, 2, true},
+		{"a node of the link is busy in the timeslot", DefaultReuseDistance, 5, 4, 1, 2, false},
+		{"another timeslot", DefaultReuseDistance, 5, 4, 2, 1, true},
+		{"no reuse", 0, 2, 1, 1, 1, false},
+		{"2 hops away with a distance of 3", 3, 3, 2, 1, 1, false},
+		{"3 hops away with a distance of 3", 3, 2, 1, 1, 1, true},
+	}
+	for _, test := range tests {
+		model := newConflictModel(topology, Interference{ReuseDistance: test.reuseDistance})
+		_, ip6 := testMote(6)
+		_, ip5 := testMote(5)
+		model.reserve(ip6, ip5, 1, 1)
+		_, transmitter := testMote(test.transmitter)
+		_, receiver := testMote(test.receiver)
+		if got := model.isFree(transmitter, receiver, test.timeslot, test.channel); got != test.free {
+			t.Errorf("%s: isFree = %t, expected %t", test.name, got, test.free)
+		}
+	}
+}
+
+func TestNeighborsOfUnreportedNodes(t *testing.T) {
+	// The mote 3 reports the mote 2, which did not send its topology yet
+	mac2, ip2 := testMote(2)
+	mac3, ip3 := testMote(3)
+	topology := applications.NewTopology()
+	topology.SetNeighbors(ip3, &applications.TopologyPacket{MoteAddr: &mac3, Neighbors: []*addrtranslation.MacAddr{&mac2}})
+
+	neighbors := neighborsIPs(&topology)
+	if !neighbors[ip3][ip2] || !neighbors[ip2][ip3] {
+		t.Fatalf("got the neighbors %v, expected %s and %s to be neighbors", neighbors, ip2, ip3)
+	}
+}
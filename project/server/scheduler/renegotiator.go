@@ -0,0 +1,183 @@
+package scheduler
+
+// Renegotiation: when nodes decline their cells, the schedule is computed again
+// under the constraints learned from the declines. The constraints are applied
+// to the inputs of the scheduler rather than to its output so that the revised
+// schedule stays consistent along the RPL paths: a node short of link memory
+// gets less bandwidth in its subtree, and a node not knowing its RPL parent is
+// left out of the schedule with its subtree until the RPL graph changes.
+
+import (
+	"errors"
+	"fmt"
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/applications"
+	"scheduleupdater-server/scheduleupdater"
+	"sort"
+)
+
+type rplLinkKey struct {
+	child  addrtranslation.IPString
+	parent addrtranslation.IPString
+}
+
+// Constraints are the limits reported by the nodes that declined a schedule.
+type Constraints struct {
+	// maxCells is the number of cells a node can install
+	maxCells map[addrtranslation.IPString]int
+	// excluded are the RPL links between nodes that do not know each other
+	excluded map[rplLinkKey]bool
+}
+
+func NewConstraints() *Constraints {
+	return &Constraints{
+		maxCells: make(map[addrtranslation.IPString]int),
+		excluded: make(map[rplLinkKey]bool),
+	}
+}
+
+// LimitCells sets the number of cells `node` can install, a lower limit
+// already known is kept.
+func (constraints *Constraints) LimitCells(node addrtranslation.IPString, maxCells int) {
+	if maxCells < 0 {
+		maxCells = 0
+	}
+	if limit, in := constraints.maxCells[node]; !in || maxCells < limit {
+		constraints.maxCells[node] = maxCells
+	}
+}
+
+// ExcludeLink forbids the cells between `a` and `b`.
+func (constraints *Constraints) ExcludeLink(a addrtranslation.IPString, b addrtranslation.IPString) {
+	constraints.excluded[rplLinkKey{a, b}] = true
+	constraints.excluded[rplLinkKey{b, a}] = true
+}
+
+// Apply returns the RPL graph and the bandwidth needs the scheduler must use to
+// satisfy the constraints.
+func (constraints *Constraints) Apply(graph *applications.RPLGraph, bandwidthMap *applications.BandwidthMap) (applications.RPLGraph, applications.BandwidthMap, error) {
+	constrainedGraph := make(applications.RPLGraph, len(*graph))
+	for child, rplLink := range *graph {
+		constrainedGraph[child] = rplLink
+	}
+	// The subtree of an excluded link cannot reach the root anymore
+	for child, rplLink := range *graph {
+		if rplLink != nil && constraints.excluded[rplLinkKey{child, rplLink.ParentIP}] {
+			for _, node := range graph.Subtree(child) {
+				delete(constrainedGraph, node)
+			}
+		}
+	}
+	constrainedBandwidth := make(applications.BandwidthMap, len(*bandwidthMap))
+	for node, bandwidth := range *bandwidthMap {
+		constrainedBandwidth[node] = bandwidth
+	}
+
+	limited := make([]addrtranslation.IPString, 0, len(constraints.maxCells))
+	for node := range constraints.maxCells {
+		limited = append(limited, node)
+	}
+	sort.Slice(limited, func(i, j int) bool { return limited[i] < limited[j] })
+	for _, node := range limited {
+		if err := constraints.limitSubtreeBandwidth(node, &constrainedGraph, &constrainedBandwidth); err != nil {
+			return nil, nil, err
+		}
+	}
+	return constrainedGraph, constrainedBandwidth, nil
+}
+
+// limitSubtreeBandwidth lowers the bandwidth of the nodes of the subtree of
+// `node`, the highest first, until `node` needs at most its limit of cells. Lowering
+// the bandwidth never increases the cells of another node.
+func (constraints *Constraints) limitSubtreeBandwidth(node addrtranslation.IPString, graph *applications.RPLGraph, bandwidthMap *applications.BandwidthMap) error {
+	subtree := graph.Subtree(node)
+	for {
+		demands, err := linkDemands(graph, bandwidthMap)
+		if err != nil {
+			return err
+		}
+		if nodeCells(demands, node) <= constraints.maxCells[node] {
+			return nil
+		}
+		highest := addrtranslation.IPString("")
+		for _, mote := range subtree {
+			if (*bandwidthMap)[mote] > (*bandwidthMap)[highest] {
+				highest = mote
+			}
+		}
+		if (*bandwidthMap)[highest] == 0 {
+			return errors.New(fmt.Sprintf("%s cannot hold the cells reaching its subtree with %d cells", node, constraints.maxCells[node]))
+		}
+		(*bandwidthMap)[highest]--
+	}
+}
+
+// nodeCells returns the number of cells of `node` for the demands of the links
+// toward its parent and its children.
+func nodeCells(demands []*linkDemand, node addrtranslation.IPString) int {
+	cells := 0
+	for _, demand := range demands {
+		if demand.child == node || demand.parent == node {
+			cells += int(demand.upstream + demand.downstream)
+		}
+	}
+	return cells
+}
+
+// Renegotiator computes revised schedules for the Updater with the scheduler
+// and the inputs of the declined schedule. The constraints are kept from one
+// renegotiation to the next.
+type Renegotiator struct {
+	scheduler    Scheduler
+	graph        *applications.RPLGraph
+	bandwidthMap *applications.BandwidthMap
+	topology     *applications.Topology
+	constraints  *Constraints
+}
+
+func NewRenegotiator(scheduler Scheduler, graph *applications.RPLGraph, bandwidthMap *applications.BandwidthMap, topology *applications.Topology) *Renegotiator {
+	return &Renegotiator{
+		scheduler:    scheduler,
+		graph:        graph,
+		bandwidthMap: bandwidthMap,
+		topology:     topology,
+		constraints:  NewConstraints(),
+	}
+}
+
+// Renegotiate is a scheduleupdater.Renegotiate: it adds the constraints of the
+// `declines` of `schedule` and computes the schedule again.
+func (renegotiator *Renegotiator) Renegotiate(schedule *scheduleupdater.Schedule, declines []scheduleupdater.Decline) (*scheduleupdater.Schedule, error) {
+	failedCells := make(map[addrtranslation.IPString]int)
+	for _, decline := range declines {
+		switch decline.Reason {
+		case scheduleupdater.DeclineReasonLinkMemory:
+			failedCells[decline.ClientIP] += decline.FailedCells
+		case scheduleupdater.DeclineReasonUnknownNeighbor:
+			neighborIP, ok := renegotiator.topology.MacIPTranslation.Find(decline.Neighbor)
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("could not find the ip address associated with %v", decline.Neighbor))
+			}
+			renegotiator.constraints.ExcludeLink(decline.ClientIP, neighborIP)
+		case scheduleupdater.DeclineReasonSlotframeBusy:
+			// Nothing to change in the schedule, the node gets it again
+		}
+	}
+	for node, failed := range failedCells {
+		cells := 0
+		for _, neighborCells := range schedule.Cells[node] {
+			cells += len(neighborCells)
+		}
+		renegotiator.constraints.LimitCells(node, cells-failed)
+	}
+
+	graph, bandwidthMap, err := renegotiator.constraints.Apply(renegotiator.graph, renegotiator.bandwidthMap)
+	if err != nil {
+		return nil, err
+	}
+	revised, err := renegotiator.scheduler.Schedule(&graph, &bandwidthMap, renegotiator.topology)
+	if err != nil {
+		return nil, err
+	}
+	return &revised, nil
+}
@@ -0,0 +1,79 @@
+package scheduler
+
+import (
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/scheduleupdater"
+	"testing"
+)
+
+func TestRenegotiateLinkMemory(t *testing.T) {
+	renegotiator, schedule := newTestRenegotiator(t)
+	_, node := testMote(2)
+	parentMac, _ := testMote(1)
+	cells := countCells(schedule, node)
+
+	revised, err := renegotiator.Renegotiate(schedule, []scheduleupdater.Decline{
+		{ClientIP: node, Reason: scheduleupdater.DeclineReasonLinkMemory, Neighbor: parentMac, FailedCells: 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revisedCells := countCells(revised, node); revisedCells > cells-3 {
+		t.Errorf("%s has %d cells in the revised schedule while it can hold %d", node, revisedCells, cells-3)
+	}
+	if _, in := scheduleupdater.Diff(schedule, revised)[node]; !in {
+		t.Errorf("no new request for %s", node)
+	}
+	for _, diagnostic := range scheduleupdater.Validate(*revised, renegotiator.graph, renegotiator.topology) {
+		t.Error(diagnostic)
+	}
+
+	// The limit is kept when another node declines afterwards
+	_, otherNode := testMote(3)
+	revised, err = renegotiator.Renegotiate(revised, []scheduleupdater.Decline{
+		{ClientIP: otherNode, Reason: scheduleupdater.DeclineReasonSlotframeBusy},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revisedCells := countCells(revised, node); revisedCells > cells-3 {
+		t.Errorf("%s has %d cells after the second renegotiation while it can hold %d", node, revisedCells, cells-3)
+	}
+}
+
+func TestRenegotiateUnknownNeighbor(t *testing.T) {
+	renegotiator, schedule := newTestRenegotiator(t)
+	_, node := testMote(4)
+	parentMac, parent := testMote(2)
+	nodeMac, _ := testMote(4)
+	_, sibling := testMote(3)
+
+	revised, err := renegotiator.Renegotiate(schedule, []scheduleupdater.Decline{
+		{ClientIP: node, Reason: scheduleupdater.DeclineReasonUnknownNeighbor, Neighbor: parentMac, FailedCells: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cells := countCells(revised, node); cells != 0 {
+		t.Errorf("%s has %d cells toward a parent it does not know", node, cells)
+	}
+	if cells := len(revised.Cells[parent][nodeMac]); cells != 0 {
+		t.Errorf("%s has %d cells toward %s", parent, cells, node)
+	}
+	if countCells(revised, sibling) == 0 {
+		t.Errorf("%s lost its cells", sibling)
+	}
+	if _, in := scheduleupdater.Diff(schedule, revised)[parent]; !in {
+		t.Errorf("no new request for %s", parent)
+	}
+	if _, in := (*renegotiator.graph)[node]; !in {
+		t.Errorf("the renegotiation changed the RPL graph of the applications")
+	}
+
+	unknownMac := addrtranslation.MacAddr{0, 9, 0, 9, 0, 9, 0, 9}
+	if _, err := renegotiator.Renegotiate(schedule, []scheduleupdater.Decline{
+		{ClientIP: node, Reason: scheduleupdater.DeclineReasonUnknownNeighbor, Neighbor: unknownMac},
+	}); err == nil {
+		t.Errorf("no error for a neighbor without ip address")
+	}
+}
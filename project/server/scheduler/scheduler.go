@@ -0,0 +1,56 @@
+package scheduler
+
+// Scheduler: the algorithms computing a TSCH schedule from the information
+// gathered by the applications (RPL graph, bandwidth needs and neighbors).
+// Each algorithm is registered under a name so that it can be selected from
+// the command line and compared on the same inputs.
+
+import (
+	"errors"
+	"fmt"
+	"scheduleupdater-server/applications"
+	"scheduleupdater-server/scheduleupdater"
+	"sort"
+)
+
+// The cells allocated by the schedulers are within the slotframe geometry. The
+// timeslot 0 is left to the 6TiSCH minimal cell.
+const firstTimeslot = 1
+
+// Scheduler computes a schedule for the network described by the RPL `graph`,
+// the bandwidth needs of the nodes and their neighbors.
+type Scheduler interface {
+	Schedule(graph *applications.RPLGraph, bandwidthMap *applications.BandwidthMap, topology *applications.Topology) (scheduleupdater.Schedule, error)
+}
+
+var schedulers = map[string]func(scheduleupdater.SlotframeGeometry, Interference) Scheduler{
+	"greedy": func(geometry scheduleupdater.SlotframeGeometry, interference Interference) Scheduler {
+		return NewGreedy(geometry, interference)
+	},
+	"tasa": func(geometry scheduleupdater.SlotframeGeometry, interference Interference) Scheduler {
+		return NewTASA(geometry, interference)
+	},
+}
+
+// New returns the scheduler registered under `name` allocating the cells in
+// `geometry` with the conflict model `interference`.
+func New(name string, geometry scheduleupdater.SlotframeGeometry, interference Interference) (Scheduler, error) {
+	newScheduler, in := schedulers[name]
+	if !in {
+		return nil, errors.New(fmt.Sprintf("unknown scheduler %q, available schedulers: %v", name, Names()))
+	}
+	if err := geometry.Validate(); err != nil {
+		return nil, err
+	}
+	return newScheduler(geometry, interference), nil
+}
+
+// Names returns the names of the registered schedulers.
+func Names() []string {
+	names := make([]string, 0, len(schedulers))
+	for name := range schedulers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,199 @@
+package scheduler
+
+// TASA: Traffic-Aware Scheduling Algorithm (Palattella et al., "Traffic Aware
+// Scheduling Algorithm for Reliable Low-Power Multi-Hop IEEE 802.15.4e
+// Networks", PIMRC 2012).
+// TASA schedules a convergecast toward the root of the RPL tree, and the
+// packets of the server toward every node. The load of a link is the number of
+// packets generated by the child and by all the nodes of its subtree, and one
+// packet for the child and each node of its subtree in the downstream
+// direction. The timeslots are filled one after the other: first a matching
+// selects links without any node in common (half-duplex), giving priority to
+// the links with the highest remaining load, then a coloring gives a channel
+// offset to each selected link so that links whose nodes can hear each other
+// never use the same channel in the same timeslot (see Interference).
+
+import (
+	"errors"
+	"fmt"
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/applications"
+	"scheduleupdater-server/scheduleupdater"
+	"sort"
+)
+
+type TASA struct {
+	geometry     scheduleupdater.SlotframeGeometry
+	interference Interference
+}
+
+func NewTASA(geometry scheduleupdater.SlotframeGeometry, interference Interference) *TASA {
+	return &TASA{geometry: geometry, interference: interference}
+}
+
+// tasaLink is a directed link between a node and its RPL parent, upstream
+// from the child to the parent or downstream from the parent to the child.
+type tasaLink struct {
+	transmitter    addrtranslation.IPString
+	receiver       addrtranslation.IPString
+	transmitterMac addrtranslation.MacAddr
+	receiverMac    addrtranslation.MacAddr
+	remaining      uint // packets that still need a cell on this link
+	queue          uint // packets the transmitter holds for this link and can forward right now
+	// next is the link the receiver forwards the packets to (upstream only)
+	next *tasaLink
+	// children are the downstream links of the receiver toward its children,
+	// routed the number of packets given to a link out of its demand
+	children []*tasaLink
+	routed   uint
+	demand   uint
+}
+
+func (tasa *TASA) Schedule(graph *applications.RPLGraph, bandwidthMap *applications.BandwidthMap, topology *applications.Topology) (scheduleupdater.Schedule, error) {
+	links, err := tasaLinks(graph, bandwidthMap, topology)
+	if err != nil {
+		return scheduleupdater.Schedule{}, err
+	}
+	model := newConflictModel(topology, tasa.interference)
+
+	schedule := scheduleupdater.NewSchedule(tasa.geometry)
+	for timeslot := uint16(firstTimeslot); pendingLinks(links); timeslot++ {
+		if timeslot >= tasa.geometry.Length {
+			return scheduleupdater.Schedule{}, errors.New(fmt.Sprintf("TASA needs more than %d timeslots to schedule the traffic", tasa.geometry.Length-firstTimeslot))
+		}
+		// Links with the highest remaining load are scheduled first
+		candidates := make([]*tasaLink, 0, len(links))
+		for _, link := range links {
+			if link.remaining > 0 && link.queue > 0 {
+				candidates = append(candidates, link)
+			}
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].remaining > candidates[j].remaining
+		})
+
+		// Matching: a node is part of at most one link in a timeslot.
+		// Coloring: two links sharing a channel must not interfere.
+		// The selected links keep the order of the candidates so that the same
+		// inputs always give the same schedule.
+		selected := make([]*tasaLink, 0, len(candidates))
+		channels := make(map[*tasaLink]uint16)
+		for _, link := range candidates {
+			channel, ok := tasaChannel(link, timeslot, &tasa.geometry, model)
+			if !ok {
+				continue
+			}
+			model.reserve(link.transmitter, link.receiver, timeslot, channel)
+			selected = append(selected, link)
+			channels[link] = channel
+		}
+
+		for _, link := range selected {
+			channel := channels[link]
+			schedule.AddCell(link.transmitter, link.receiverMac, &scheduleupdater.Cell{
+				LinkOptions: scheduleupdater.LinkOptionTX,
+				TimeSlot:    timeslot,
+				Channel:     channel,
+			})
+			schedule.AddCell(link.receiver, link.transmitterMac, &scheduleupdater.Cell{
+				LinkOptions: scheduleupdater.LinkOptionRX,
+				TimeSlot:    timeslot,
+				Channel:     channel,
+			})
+			link.remaining--
+			link.queue--
+			link.forward()
+		}
+	}
+	return schedule, nil
+}
+
+// forward gives the packet received on the link to the next link it goes
+// through. Downstream, the receiver first serves its subtree and keeps the
+// last packet for itself.
+func (link *tasaLink) forward() {
+	if link.next != nil {
+		link.next.queue++
+		return
+	}
+	for _, child := range link.children {
+		if child.routed < child.demand {
+			child.routed++
+			child.queue++
+			return
+		}
+	}
+}
+
+// tasaLinks returns the upstream and downstream links of the RPL graph with
+// their load, see linkDemands.
+func tasaLinks(graph *applications.RPLGraph, bandwidthMap *applications.BandwidthMap, topology *applications.Topology) ([]*tasaLink, error) {
+	demands, err := linkDemands(graph, bandwidthMap)
+	if err != nil {
+		return nil, err
+	}
+	upstream := make(map[addrtranslation.IPString]*tasaLink, len(demands))
+	downstream := make(map[addrtranslation.IPString]*tasaLink, len(demands))
+	links := make([]*tasaLink, 0, 2*len(demands))
+	for _, demand := range demands {
+		childMac, ok := topology.MacIPTranslation.FindMac(demand.child)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("could not find the mac address associated with %s", demand.child))
+		}
+		parentMac, ok := topology.MacIPTranslation.FindMac(demand.parent)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("could not find the mac address associated with %s", demand.parent))
+		}
+		upstream[demand.child] = &tasaLink{
+			transmitter:    demand.child,
+			receiver:       demand.parent,
+			transmitterMac: childMac,
+			receiverMac:    parentMac,
+			remaining:      demand.upstream,
+			queue:          (*bandwidthMap)[demand.child],
+		}
+		downstream[demand.child] = &tasaLink{
+			transmitter:    demand.parent,
+			receiver:       demand.child,
+			transmitterMac: parentMac,
+			receiverMac:    childMac,
+			remaining:      demand.downstream,
+			demand:         demand.downstream,
+		}
+		links = append(links, upstream[demand.child], downstream[demand.child])
+	}
+	for _, demand := range demands {
+		if parentLink, in := upstream[demand.parent]; in {
+			upstream[demand.child].next = parentLink
+		}
+		link := downstream[demand.child]
+		if parentLink, in := downstream[demand.parent]; in {
+			parentLink.children = append(parentLink.children, link)
+		} else {
+			// The root holds the packets of the server from the start
+			link.queue = link.remaining
+			link.routed = link.remaining
+		}
+	}
+	return links, nil
+}
+
+func pendingLinks(links []*tasaLink) bool {
+	for _, link := range links {
+		if link.remaining > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// tasaChannel returns the lowest channel offset that `link` can use in the
+// timeslot according to the conflict model.
+func tasaChannel(link *tasaLink, timeslot uint16, geometry *scheduleupdater.SlotframeGeometry, model *conflictModel) (uint16, bool) {
+	for channel := geometry.FirstChannel; channel <= geometry.LastChannel; channel++ {
+		if model.isFree(link.transmitter, link.receiver, timeslot, channel) {
+			return channel, true
+		}
+	}
+	return 0, false
+}
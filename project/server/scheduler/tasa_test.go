@@ -0,0 +1,35 @@
+package scheduler
+
+import (
+	"reflect"
+	"scheduleupdater-server/scheduleupdater"
+	"testing"
+)
+
+func TestTASAScheduleIsValidAndDeterministic(t *testing.T) {
+	parents := map[byte]byte{2: 1, 3: 1, 4: 2, 5: 2, 6: 3, 7: 4}
+	geometry := scheduleupdater.NewDefaultSlotframeGeometry()
+	geometry.Length = 101
+	tasa := NewTASA(geometry, NewDefaultInterference())
+
+	var first scheduleupdater.Schedule
+	for run := 0; run < 20; run++ {
+		graph, bandwidthMap, topology := newTestNetwork(parents, 2)
+		schedule, err := tasa.Schedule(&graph, &bandwidthMap, topology)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if run == 0 {
+			first = schedule
+			config := scheduleupdater.NewDefaultValidationConfig()
+			config.MaxCells = 1000
+			for _, diagnostic := range scheduleupdater.ValidateWithConfig(schedule, &graph, topology, config) {
+				t.Error(diagnostic)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(schedule, first) {
+			t.Fatalf("run %d gave another schedule for the same inputs", run)
+		}
+	}
+}
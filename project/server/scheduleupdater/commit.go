@@ -0,0 +1,195 @@
+package scheduleupdater
+
+// Two-phase commit: the cells are first prepared in a shadow slotframe of
+// every node, then the UpdateConfirmation makes each node switch to it, from
+// the leaves to the root. When the prepare phase fails, the nodes are told to
+// drop their shadow slotframe with an AbortRequest. When the commit phase
+// fails, the nodes that did not switch yet are aborted and the nodes that
+// already switched get the previous schedule back, so that a failed update
+// never leaves the network with a mix of old and new slotframes.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/utils"
+	"strings"
+	"time"
+)
+
+type CommitPolicy struct {
+	// Timeout is the maximal duration of the commit phase, 0 disables the timeout
+	Timeout time.Duration
+	// Rollback reinstalls the previous schedule on the nodes that already
+	// switched when the commit phase fails
+	Rollback bool
+}
+
+func NewDefaultCommitPolicy() CommitPolicy {
+	return CommitPolicy{
+		Timeout:  0,
+		Rollback: true,
+	}
+}
+
+// CommitError is returned by UpdateClients when the commit phase failed.
+type CommitError struct {
+	Cause error
+	// Swapped are the nodes that switched to the new schedule before the failure
+	Swapped []addrtranslation.IPString
+	// RolledBack is true when the previous schedule is installed again on every node
+	RolledBack bool
+	// RollbackErr is the reason why the rollback failed
+	RollbackErr error
+}
+
+func (err *CommitError) Error() string {
+	message := fmt.Sprintf("the commit failed after %d node(s) switched to the new schedule: %v", len(err.Swapped), err.Cause)
+	switch {
+	case err.RolledBack:
+		message += ", the previous schedule was reinstalled"
+	case err.RollbackErr != nil:
+		message += fmt.Sprintf(", the rollback failed: %v", err.RollbackErr)
+	}
+	return message
+}
+
+func (err *CommitError) Unwrap() error {
+	return err.Cause
+}
+
+// AbortRequest makes a node drop the slotframe of the update in progress.
+type AbortRequest struct {
+	Epoch Epoch
+}
+
+func (pkt *AbortRequest) Type() PktType {
+	return PktTypeAbortRequest
+}
+
+func (pkt *AbortRequest) Encode() []byte {
+	return encodePktPrefix(pkt.Type(), pkt.Epoch)
+}
+
+// SetCommitPolicy sets the timeout and the rollback of the commit phase.
+func (updater *Updater) SetCommitPolicy(policy CommitPolicy) {
+	updater.commitPolicy = policy
+}
+
+// commit sends the UpdateConfirmation to the clients one after the other in
+// the given `order`. It returns the clients that switched to the new schedule,
+// the failure stops the commit at the first client not acknowledging it. The
+// commit fails once it lasted more than `timeout`, 0 disables the timeout.
+func (updater *Updater) commit(epoch Epoch, order []addrtranslation.IPString, timeout time.Duration) ([]addrtranslation.IPString, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	swapped := make([]addrtranslation.IPString, 0, len(order))
+	for _, clientIP := range order {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return swapped, errors.New(fmt.Sprintf("the commit phase took more than %v", timeout))
+		}
+		updateCompletePkt := UpdateConfirmation{Epoch: epoch}
+		_, err := updater.writeAllUntil(clientIP, [][]byte{updateCompletePkt.Encode()}, deadline)
+		if err != nil {
+			return swapped, errors.New(fmt.Sprintf("%s did not confirm the update: %v", clientIP, err))
+		}
+		swapped = append(swapped, clientIP)
+	}
+	return swapped, nil
+}
+
+// abort makes the clients drop the update in progress. A client that does not
+// receive the AbortRequest drops it anyway with the next schedule header.
+func (updater *Updater) abort(epoch Epoch, clients []addrtranslation.IPString) {
+	if len(clients) == 0 {
+		return
+	}
+	log.Println("Aborting the update of", len(clients), "clients")
+	abortErrors := updater.sendToEachClientAsync(func(clientIP addrtranslation.IPString) ([][]byte, error) {
+		abortPkt := AbortRequest{Epoch: epoch}
+		return [][]byte{abortPkt.Encode()}, nil
+	}, clients)
+	for ackPacket := range abortErrors {
+		if ackPacket.err != nil {
+			utils.Log.WarningPrintln("Could not abort the update: ", ackPacket.err.Error())
+		}
+	}
+}
+
+// failCommit aborts the clients of `order` that did not switch and rolls back
+// the clients that did. The client at which the commit stopped may have
+// switched without its ACK reaching the server, so it is rolled back as well.
+// Nothing is rolled back when no schedule was installed before: the clients
+// that switched keep the new schedule until the next update.
+func (updater *Updater) failCommit(schedule *Schedule, order []addrtranslation.IPString, swapped []addrtranslation.IPString, cause error) error {
+	commitErr := &CommitError{Cause: cause, Swapped: swapped}
+	if updater.installed == nil {
+		updater.abort(schedule.Epoch, order[len(swapped):])
+		if updater.commitPolicy.Rollback {
+			commitErr.RollbackErr = errors.New("there is no previous schedule to reinstall")
+		}
+		return commitErr
+	}
+	uncertain := order[len(swapped):min(len(swapped)+1, len(order))]
+	updater.abort(schedule.Epoch, order[len(swapped)+len(uncertain):])
+	if !updater.commitPolicy.Rollback {
+		return commitErr
+	}
+
+	// The previous schedule is installed again in a new round
+	previous := *updater.installed
+	var err error
+	if previous.Epoch, err = updater.nextEpoch(); err != nil {
+		commitErr.RollbackErr = err
+		return commitErr
+	}
+	log.Println("Rolling back", len(swapped)+len(uncertain), "clients to the previous schedule")
+	if err := updater.reinstall(&previous, swapped); err != nil {
+		commitErr.RollbackErr = err
+		return commitErr
+	}
+	if err := updater.reinstall(&previous, uncertain); err != nil {
+		commitErr.RollbackErr = errors.New(fmt.Sprintf("%s may still be on the new schedule: %v", uncertain[0], err))
+		return commitErr
+	}
+	updater.installed = &previous
+	commitErr.RolledBack = true
+	return commitErr
+}
+
+// reinstall sends the whole `previous` schedule to the clients and commits it
+// in the given order. The commit has no timeout, it is the last chance to get
+// the network back to a consistent state.
+func (updater *Updater) reinstall(previous *Schedule, order []addrtranslation.IPString) error {
+	if len(order) == 0 {
+		return nil
+	}
+	if err := updater.sendHeaders(previous, false, order); err != nil {
+		return err
+	}
+	declines, err := updater.sendCells(previous.serializeOrEmpty, order)
+	if err == nil && len(declines) > 0 {
+		err = &DeclineError{Declines: declines}
+	}
+	if err != nil {
+		updater.abort(previous.Epoch, order)
+		return err
+	}
+	reinstalled, err := updater.commit(previous.Epoch, order, 0)
+	if err != nil {
+		return errors.New(fmt.Sprintf("%v, still on the new schedule: %s",
+			err, strings.Join(ipStrings(order[len(reinstalled):]), ", ")))
+	}
+	return nil
+}
+
+func ipStrings(clients []addrtranslation.IPString) []string {
+	ips := make([]string, len(clients))
+	for i, clientIP := range clients {
+		ips[i] = string(clientIP)
+	}
+	return ips
+}
@@ -0,0 +1,134 @@
+package scheduleupdater
+
+// Declines: a node declines an update packet it cannot apply and gives the
+// reason in the ACK. The Updater then asks for a revised schedule taking into
+// account the constraint of the node, and sends it only to the nodes whose
+// cells changed, while the update of the other nodes stays pending.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"scheduleupdater-server/addrtranslation"
+	"strings"
+)
+
+// DeclineReason mirrors `enum schedule_updater_decline_reason` in common/schedule_updater.h.
+type DeclineReason byte
+
+const (
+	DeclineReasonNone DeclineReason = iota
+	// The node has no link memory left for the cells
+	DeclineReasonLinkMemory
+	// The neighbor of the cells is not in the neighbor table of the node
+	DeclineReasonUnknownNeighbor
+	// The node could not create the new slotframe
+	DeclineReasonSlotframeBusy
+	// The packet belongs to another update than the one in progress on the node
+	DeclineReasonStaleEpoch
+)
+
+func (reason DeclineReason) String() string {
+	switch reason {
+	case DeclineReasonNone:
+		return "none"
+	case DeclineReasonLinkMemory:
+		return "not enough link memory"
+	case DeclineReasonUnknownNeighbor:
+		return "unknown neighbor"
+	case DeclineReasonSlotframeBusy:
+		return "slotframe busy"
+	case DeclineReasonStaleEpoch:
+		return "stale epoch"
+	}
+	return fmt.Sprintf("unknown reason %d", byte(reason))
+}
+
+// maxRenegotiations is the number of revised schedules sent before giving up.
+const maxRenegotiations = 5
+
+// Decline is an update packet that a node could not apply.
+type Decline struct {
+	ClientIP addrtranslation.IPString
+	Reason   DeclineReason
+	// Neighbor and Cells are the content of the declined UpdateRequest or RemoveRequest
+	Neighbor addrtranslation.MacAddr
+	Cells    []Cell
+	// FailedCells is the number of cells the node could not install
+	FailedCells int
+}
+
+func (decline Decline) String() string {
+	return fmt.Sprintf("%s declined %d cells toward %v: %s", decline.ClientIP, decline.FailedCells, decline.Neighbor, decline.Reason)
+}
+
+// DeclineError is returned by UpdateClients when the declines could not be
+// resolved by renegotiation.
+type DeclineError struct {
+	Declines []Decline
+}
+
+func (err *DeclineError) Error() string {
+	declines := make([]string, len(err.Declines))
+	for i, decline := range err.Declines {
+		declines[i] = decline.String()
+	}
+	return "the schedule was declined: " + strings.Join(declines, ", ")
+}
+
+// Renegotiate returns a revised schedule satisfying the constraints of the
+// nodes that declined `schedule`.
+type Renegotiate = func(schedule *Schedule, declines []Decline) (*Schedule, error)
+
+// DecodeUpdateRequest returns the neighbor and the cells of an UpdateRequest or
+// a RemoveRequest.
+func DecodeUpdateRequest(pkt []byte) (addrtranslation.MacAddr, []Cell, error) {
+	var neighbor addrtranslation.MacAddr
+	const headerSize = PktPrefixSize + len(neighbor) + 1
+	const cellSize = 5
+	if len(pkt) < headerSize {
+		return neighbor, nil, errors.New("the update request is too short")
+	}
+	copy(neighbor[:], pkt[PktPrefixSize:])
+	cellCount := int(pkt[headerSize-1])
+	if len(pkt) < headerSize+cellCount*cellSize {
+		return neighbor, nil, errors.New("the update request does not contain all its cells")
+	}
+	cells := make([]Cell, cellCount)
+	for i := range cells {
+		raw := pkt[headerSize+i*cellSize:]
+		cells[i] = Cell{
+			LinkOptions: LinkOptions(raw[0]),
+			TimeSlot:    binary.LittleEndian.Uint16(raw[1:]),
+			Channel:     binary.LittleEndian.Uint16(raw[3:]),
+		}
+	}
+	return neighbor, cells, nil
+}
+
+// newDecline returns the Decline of the declined `request` of `clientIP`.
+func newDecline(clientIP addrtranslation.IPString, request []byte, ackPacket []byte) Decline {
+	decline := Decline{ClientIP: clientIP}
+	if len(ackPacket) > 1 {
+		decline.Reason = DeclineReason(ackPacket[1])
+	}
+	if len(ackPacket) > 2 {
+		decline.FailedCells = int(ackPacket[2])
+	}
+	decline.Neighbor, decline.Cells, _ = DecodeUpdateRequest(request)
+	return decline
+}
+
+// affectedClients returns the clients whose cells differ between `schedule`
+// and `revised`, and the clients that declined.
+func affectedClients(clients []addrtranslation.IPString, schedule *Schedule, revised *Schedule, declines []Decline) []addrtranslation.IPString {
+	diff := Diff(schedule, revised)
+	declined := make(map[addrtranslation.IPString]bool)
+	for _, decline := range declines {
+		declined[decline.ClientIP] = true
+	}
+	return filterClients(clients, func(clientIP addrtranslation.IPString) bool {
+		_, changed := diff[clientIP]
+		return changed || declined[clientIP]
+	})
+}
@@ -0,0 +1,138 @@
+package scheduleupdater
+
+// Incremental updates: instead of reinstalling the whole schedule of a node,
+// the node copies its installed slotframe into the new one and only the cells
+// that changed are sent. A TSCH link is identified by its timeslot and channel
+// offset, adding a cell replaces the link installed at the same offsets, so the
+// cells are only removed when their offsets are not used anymore by the node.
+
+import (
+	"scheduleupdater-server/addrtranslation"
+	"sort"
+)
+
+// NodeDiff is the cells to add and to remove, grouped by neighbor, to go from
+// the installed schedule of a node to its new schedule.
+type NodeDiff struct {
+	// Epoch is the epoch of the new schedule
+	Epoch   Epoch
+	Added   map[addrtranslation.MacAddr][]Cell
+	Removed map[addrtranslation.MacAddr][]Cell
+}
+
+// ScheduleDiff is the NodeDiff of each node whose schedule changed.
+type ScheduleDiff map[addrtranslation.IPString]*NodeDiff
+
+type cellOffsets struct {
+	timeslot uint16
+	channel  uint16
+}
+
+// Diff compares the `installed` schedule with the `next` one. The nodes whose
+// cells did not change are not part of the diff.
+func Diff(installed *Schedule, next *Schedule) ScheduleDiff {
+	diff := make(ScheduleDiff)
+	nodes := make(map[addrtranslation.IPString]bool)
+	for node := range installed.Cells {
+		nodes[node] = true
+	}
+	for node := range next.Cells {
+		nodes[node] = true
+	}
+	for node := range nodes {
+		nodeDiff := diffNode(cellsByOffsets(installed.Cells[node]), cellsByOffsets(next.Cells[node]))
+		nodeDiff.Epoch = next.Epoch
+		if !nodeDiff.Empty() {
+			diff[node] = nodeDiff
+		}
+	}
+	return diff
+}
+
+type neighborCell struct {
+	neighbor addrtranslation.MacAddr
+	cell     Cell
+}
+
+func cellsByOffsets(cells map[addrtranslation.MacAddr][]Cell) map[cellOffsets]neighborCell {
+	byOffsets := make(map[cellOffsets]neighborCell)
+	for neighbor, neighborCells := range cells {
+		for _, cell := range neighborCells {
+			byOffsets[cellOffsets{cell.TimeSlot, cell.Channel}] = neighborCell{neighbor: neighbor, cell: cell}
+		}
+	}
+	return byOffsets
+}
+
+func diffNode(installed map[cellOffsets]neighborCell, next map[cellOffsets]neighborCell) *NodeDiff {
+	nodeDiff := &NodeDiff{
+		Added:   make(map[addrtranslation.MacAddr][]Cell),
+		Removed: make(map[addrtranslation.MacAddr][]Cell),
+	}
+	for offsets, nextCell := range next {
+		if installedCell, in := installed[offsets]; !in || installedCell != nextCell {
+			nodeDiff.Added[nextCell.neighbor] = append(nodeDiff.Added[nextCell.neighbor], nextCell.cell)
+		}
+	}
+	for offsets, installedCell := range installed {
+		if _, in := next[offsets]; !in {
+			nodeDiff.Removed[installedCell.neighbor] = append(nodeDiff.Removed[installedCell.neighbor], installedCell.cell)
+		}
+	}
+	return nodeDiff
+}
+
+func (nodeDiff *NodeDiff) Empty() bool {
+	return len(nodeDiff.Added) == 0 && len(nodeDiff.Removed) == 0
+}
+
+// Serialize returns the UpdateRequest and RemoveRequest packets of the node `clientIP`.
+func (diff ScheduleDiff) Serialize(clientIP addrtranslation.IPString) ([][]byte, error) {
+	nodeDiff, in := diff[clientIP]
+	if !in {
+		return [][]byte{}, nil
+	}
+	pkts := make([][]byte, 0)
+	for _, neighbor := range sortedNeighbors(nodeDiff.Removed) {
+		cells := sortedCells(nodeDiff.Removed[neighbor])
+		for i := 0; i < len(cells); i += ScheduleUpdaterPktMaxCells {
+			pkt := RemoveRequest{
+				Epoch:        nodeDiff.Epoch,
+				NeighborAddr: neighbor,
+				Cells:        cells[i:min(i+ScheduleUpdaterPktMaxCells, len(cells))],
+			}
+			pkts = append(pkts, pkt.Encode())
+		}
+	}
+	for _, neighbor := range sortedNeighbors(nodeDiff.Added) {
+		cells := sortedCells(nodeDiff.Added[neighbor])
+		for i := 0; i < len(cells); i += ScheduleUpdaterPktMaxCells {
+			pkt := UpdateRequest{
+				Epoch:        nodeDiff.Epoch,
+				NeighborAddr: neighbor,
+				Cells:        cells[i:min(i+ScheduleUpdaterPktMaxCells, len(cells))],
+			}
+			pkts = append(pkts, pkt.Encode())
+		}
+	}
+	return pkts, nil
+}
+
+func sortedNeighbors(cells map[addrtranslation.MacAddr][]Cell) []addrtranslation.MacAddr {
+	neighbors := make([]addrtranslation.MacAddr, 0, len(cells))
+	for neighbor := range cells {
+		neighbors = append(neighbors, neighbor)
+	}
+	sort.Slice(neighbors, func(i, j int) bool { return string(neighbors[i][:]) < string(neighbors[j][:]) })
+	return neighbors
+}
+
+func sortedCells(cells []Cell) []Cell {
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].TimeSlot != cells[j].TimeSlot {
+			return cells[i].TimeSlot < cells[j].TimeSlot
+		}
+		return cells[i].Channel < cells[j].Channel
+	})
+	return cells
+}
@@ -0,0 +1,96 @@
+package scheduleupdater
+
+import (
+	"reflect"
+	"scheduleupdater-server/addrtranslation"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	node := addrtranslation.IPString("fd00::202:2:2:2")
+	unchanged := addrtranslation.IPString("fd00::203:3:3:3")
+	parent := addrtranslation.MacAddr{0, 1, 0, 1, 0, 1, 0, 1}
+	child := addrtranslation.MacAddr{0, 3, 0, 3, 0, 3, 0, 3}
+	tx := func(timeslot uint16) Cell { return Cell{LinkOptions: LinkOptionTX, TimeSlot: timeslot, Channel: 1} }
+	rx := func(timeslot uint16) Cell { return Cell{LinkOptions: LinkOptionRX, TimeSlot: timeslot, Channel: 1} }
+
+	installed := NewSchedule(NewDefaultSlotframeGeometry())
+	installed.AddCell(node, parent, &Cell{LinkOptions: LinkOptionTX, TimeSlot: 1, Channel: 1})
+	installed.AddCell(node, parent, &Cell{LinkOptions: LinkOptionTX, TimeSlot: 2, Channel: 1})
+	installed.AddCell(node, parent, &Cell{LinkOptions: LinkOptionTX, TimeSlot: 4, Channel: 1})
+	installed.AddCell(unchanged, child, &Cell{LinkOptions: LinkOptionTX, TimeSlot: 3, Channel: 1})
+	next := NewSchedule(NewDefaultSlotframeGeometry())
+	next.Epoch = 7
+	// The cell in the timeslot 1 is kept, the one in the timeslot 2 is
+	// replaced by a cell toward the child, the one in the timeslot 4 is removed
+	next.AddCell(node, parent, &Cell{LinkOptions: LinkOptionTX, TimeSlot: 1, Channel: 1})
+	next.AddCell(node, child, &Cell{LinkOptions: LinkOptionRX, TimeSlot: 2, Channel: 1})
+	next.AddCell(node, parent, &Cell{LinkOptions: LinkOptionTX, TimeSlot: 5, Channel: 1})
+	next.AddCell(unchanged, child, &Cell{LinkOptions: LinkOptionTX, TimeSlot: 3, Channel: 1})
+
+	diff := Diff(&installed, &next)
+	expected := ScheduleDiff{node: &NodeDiff{
+		Epoch:   7,
+		Added:   map[addrtranslation.MacAddr][]Cell{child: {rx(2)}, parent: {tx(5)}},
+		Removed: map[addrtranslation.MacAddr][]Cell{parent: {tx(4)}},
+	}}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Fatalf("got the diff %+v, expected %+v", diff[node], expected[node])
+	}
+
+	// The cells are removed before the new ones are added
+	pkts, err := diff.Serialize(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedPkts := []struct {
+		pktType  PktType
+		neighbor addrtranslation.MacAddr
+		cells    []Cell
+	}{
+		{PktTypeRemoveRequest, parent, []Cell{tx(4)}},
+		{PktTypeUpdateRequest, parent, []Cell{tx(5)}},
+		{PktTypeUpdateRequest, child, []Cell{rx(2)}},
+	}
+	if len(pkts) != len(expectedPkts) {
+		t.Fatalf("got %d packets, expected %d", len(pkts), len(expectedPkts))
+	}
+	for i, pkt := range pkts {
+		neighbor, cells, err := DecodeUpdateRequest(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if PktType(pkt[0]) != expectedPkts[i].pktType || PktEpoch(pkt) != 7 ||
+			neighbor != expectedPkts[i].neighbor || !reflect.DeepEqual(cells, expectedPkts[i].cells) {
+			t.Errorf("the packet %d is of type %d with the epoch %d and the cells %+v toward %v, expected %+v",
+				i, pkt[0], PktEpoch(pkt), cells, neighbor, expectedPkts[i])
+		}
+	}
+	if pkts, _ := diff.Serialize(unchanged); len(pkts) != 0 {
+		t.Errorf("%d packets sent to a node whose cells did not change", len(pkts))
+	}
+}
+
+func TestDiffSplitsTheCellsInPackets(t *testing.T) {
+	node := addrtranslation.IPString("fd00::202:2:2:2")
+	parent := addrtranslation.MacAddr{0, 1, 0, 1, 0, 1, 0, 1}
+	installed := NewSchedule(NewDefaultSlotframeGeometry())
+	next := NewSchedule(NewDefaultSlotframeGeometry())
+	for timeslot := uint16(1); timeslot <= ScheduleUpdaterPktMaxCells+1; timeslot++ {
+		installed.AddCell(node, parent, &Cell{LinkOptions: LinkOptionTX, TimeSlot: timeslot, Channel: 1})
+		next.AddCell(node, parent, &Cell{LinkOptions: LinkOptionTX, TimeSlot: timeslot, Channel: 2})
+	}
+	// Every cell moves to another channel, the old offsets are all removed
+	pkts, err := Diff(&installed, &next).Serialize(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := make([]PktType, len(pkts))
+	for i, pkt := range pkts {
+		types[i] = PktType(pkt[0])
+	}
+	expected := []PktType{PktTypeRemoveRequest, PktTypeRemoveRequest, PktTypeUpdateRequest, PktTypeUpdateRequest}
+	if !reflect.DeepEqual(types, expected) {
+		t.Errorf("got the packets %v, expected %v", types, expected)
+	}
+}
@@ -0,0 +1,201 @@
+package scheduleupdater
+
+// Epochs: every update round has an epoch, incremented by the Updater and
+// carried by all its packets, so that a delayed packet of an earlier round is
+// not applied to the slotframe of the current one. The nodes acknowledge each
+// packet with the epoch of the update they are preparing and the epoch of the
+// schedule they run. An ACK with another epoch than the packet belongs to an
+// earlier round whose sequence number was reused: it is ignored and the packet
+// is sent again.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/utils"
+	"time"
+)
+
+// Epoch identifies an update round. 0 means that a node did not receive any
+// update yet, the epochs wrap around without going through 0.
+type Epoch uint16
+
+// Older reports whether `epoch` is before `other`, that is less than half of
+// the epoch space behind it (`epoch_older` in common/schedule_updater.c).
+func (epoch Epoch) Older(other Epoch) bool {
+	return int16(epoch-other) < 0
+}
+
+func (epoch Epoch) next() Epoch {
+	if epoch+1 == 0 {
+		return 1
+	}
+	return epoch + 1
+}
+
+// PktPrefixSize is the size of the type and the epoch starting every packet.
+const PktPrefixSize = 3
+
+func encodePktPrefix(pktType PktType, epoch Epoch) []byte {
+	return utils.AppendLittleEndianUint16([]byte{uint8(pktType)}, uint16(epoch))
+}
+
+// PktEpoch returns the epoch of a schedule updater packet.
+func PktEpoch(pkt []byte) Epoch {
+	if len(pkt) < PktPrefixSize {
+		return 0
+	}
+	return Epoch(binary.LittleEndian.Uint16(pkt[1:]))
+}
+
+// EpochQuery is only acknowledged by the node, with its epochs.
+type EpochQuery struct{}
+
+func (pkt *EpochQuery) Type() PktType {
+	return PktTypeEpochQuery
+}
+
+func (pkt *EpochQuery) Encode() []byte {
+	return encodePktPrefix(pkt.Type(), 0)
+}
+
+// NodeEpoch is the state of a node as reported in its ACKs.
+type NodeEpoch struct {
+	// Update is the epoch of the update in progress, or of the last one
+	Update Epoch
+	// Installed is the epoch of the schedule the node runs
+	Installed Epoch
+}
+
+// The ACK payload is the confirmation, the decline reason, the number of failed
+// cells and the NodeEpoch.
+const (
+	ackUpdateEpochOffset    = 3
+	ackInstalledEpochOffset = 5
+	// AckPayloadSize is the size of the ACK payload sent by the nodes
+	AckPayloadSize = 7
+)
+
+func decodeNodeEpoch(ackPacket []byte) (NodeEpoch, error) {
+	if len(ackPacket) < AckPayloadSize {
+		return NodeEpoch{}, errors.New("the ACK does not contain the epochs of the node")
+	}
+	return NodeEpoch{
+		Update:    Epoch(binary.LittleEndian.Uint16(ackPacket[ackUpdateEpochOffset:])),
+		Installed: Epoch(binary.LittleEndian.Uint16(ackPacket[ackInstalledEpochOffset:])),
+	}, nil
+}
+
+// isStaleAck reports whether `ackPacket` does not acknowledge the packet `pkt`
+// of the current round.
+func isStaleAck(pkt []byte, ackPacket []byte) bool {
+	if len(pkt) < 1 || PktType(pkt[0]) == PktTypeEpochQuery {
+		return false
+	}
+	nodeEpoch, err := decodeNodeEpoch(ackPacket)
+	if err != nil {
+		return true
+	}
+	if PktType(pkt[0]) == PktTypeUpdateConfirmation {
+		return nodeEpoch.Installed != PktEpoch(pkt)
+	}
+	return nodeEpoch.Update != PktEpoch(pkt)
+}
+
+// maxStaleResends is the number of times a packet acknowledged by a stale ACK
+// is sent again before giving up.
+const maxStaleResends = 3
+
+// writeAll sends the packets to `clientIP` and returns their ACKs, the packets
+// acknowledged by a stale ACK are sent again.
+func (updater *Updater) writeAll(clientIP addrtranslation.IPString, pkts [][]byte) ([][]byte, error) {
+	return updater.writeAllUntil(clientIP, pkts, time.Time{})
+}
+
+// writeAllUntil is writeAll giving up when the packets are not acknowledged
+// before `deadline`, a zero deadline never expires.
+func (updater *Updater) writeAllUntil(clientIP addrtranslation.IPString, pkts [][]byte, deadline time.Time) ([][]byte, error) {
+	err, ackPackets := updater.conn.WriteAllToUntil(pkts, updater.peerAddr(clientIP), deadline)
+	if err != nil {
+		return nil, err
+	}
+	for resends := 0; ; resends++ {
+		stale := make([]int, 0)
+		for i, ackPacket := range ackPackets {
+			if isStaleAck(pkts[i], ackPacket) {
+				stale = append(stale, i)
+			}
+		}
+		if len(stale) == 0 {
+			return ackPackets, nil
+		}
+		nodeEpoch, _ := decodeNodeEpoch(ackPackets[stale[0]])
+		if resends >= maxStaleResends {
+			return nil, errors.New(fmt.Sprintf("%s holds the epochs %+v instead of %d", clientIP, nodeEpoch, PktEpoch(pkts[stale[0]])))
+		}
+		utils.Log.WarningPrintln("Ignoring ", len(stale), " stale ACKs of ", clientIP, " holding the epochs ", nodeEpoch)
+		resent := make([][]byte, len(stale))
+		for i, index := range stale {
+			resent[i] = pkts[index]
+		}
+		err, resentAcks := updater.conn.WriteAllToUntil(resent, updater.peerAddr(clientIP), deadline)
+		if err != nil {
+			return nil, err
+		}
+		for i, index := range stale {
+			ackPackets[index] = resentAcks[i]
+		}
+	}
+}
+
+// QueryEpochs asks each client the epoch of the schedule it runs and of the
+// update it prepares.
+func (updater *Updater) QueryEpochs(clients []addrtranslation.IPString) (map[addrtranslation.IPString]NodeEpoch, error) {
+	epochs := make(map[addrtranslation.IPString]NodeEpoch, len(clients))
+	queryAcks := updater.sendToEachClientAsync(func(clientIP addrtranslation.IPString) ([][]byte, error) {
+		queryPkt := EpochQuery{}
+		return [][]byte{queryPkt.Encode()}, nil
+	}, clients)
+	for ackPacket := range queryAcks {
+		if ackPacket.err != nil {
+			return nil, ackPacket.err
+		}
+		nodeEpoch, err := decodeNodeEpoch(ackPacket.packet)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %v", ackPacket.clientIP, err))
+		}
+		epochs[ackPacket.clientIP] = nodeEpoch
+	}
+	return epochs, nil
+}
+
+// Epoch returns the epoch of the last update round, 0 before the first one.
+func (updater *Updater) Epoch() Epoch {
+	return updater.epoch
+}
+
+// nextEpoch starts a new update round. The first round of the Updater
+// continues after the epochs of the nodes, which may have been updated by a
+// previous run of the server.
+func (updater *Updater) nextEpoch() (Epoch, error) {
+	if updater.epoch == 0 {
+		epochs, err := updater.QueryEpochs(updater.clients)
+		if err != nil {
+			return 0, err
+		}
+		for _, nodeEpoch := range epochs {
+			for _, epoch := range []Epoch{nodeEpoch.Update, nodeEpoch.Installed} {
+				if epoch != 0 && (updater.epoch == 0 || updater.epoch.Older(epoch)) {
+					updater.epoch = epoch
+				}
+			}
+		}
+		if updater.epoch != 0 {
+			log.Println("The nodes already received the epoch", updater.epoch)
+		}
+	}
+	updater.epoch = updater.epoch.next()
+	return updater.epoch, nil
+}
@@ -0,0 +1,107 @@
+package scheduleupdater
+
+import (
+	"net"
+	"os"
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/udpack"
+	"scheduleupdater-server/utils"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	utils.NewLogger(utils.LogLevelError, utils.WHITE)
+	os.Exit(m.Run())
+}
+
+func listenLocalUDP(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// startTestMote acknowledges the packets received on `mote` with the update
+// epoch returned by `updateEpoch` for the reception `n` (from 0) of a packet
+// of the epoch `epoch`. The number of receptions is sent to the channel
+// when the mote stops.
+func startTestMote(mote *net.UDPConn, updateEpoch func(n int, epoch Epoch) Epoch) <-chan int {
+	receptions := make(chan int, 1)
+	go func() {
+		buffer := make([]byte, 2048)
+		n := 0
+		for {
+			_ = mote.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			size, addr, err := mote.ReadFromUDP(buffer)
+			if err != nil {
+				receptions <- n
+				return
+			}
+			header, pkt := udpack.RemoveHeaderFromPacket(buffer[:size])
+			ack, _ := udpack.NewAckPacket(udpack.DecodeSequenceNumber(header))
+			ack = append(ack, 1, byte(DeclineReasonNone), 0)
+			ack = utils.AppendLittleEndianUint16(ack, uint16(updateEpoch(n, PktEpoch(pkt))))
+			ack = utils.AppendLittleEndianUint16(ack, 0)
+			_, _ = mote.WriteTo(ack, addr)
+			n++
+		}
+	}()
+	return receptions
+}
+
+func newTestUpdater(t *testing.T, mote *net.UDPConn) (*Updater, addrtranslation.IPString) {
+	conn := udpack.NewUDPAckServer(listenLocalUDP(t), &udpack.UDPAckConnSendConfig{
+		MaxRetries:          3,
+		TimesBetweenRetries: time.Millisecond,
+		Timeout:             time.Second,
+		MinTimeout:          time.Second,
+	})
+	go func() { _ = conn.Serve(func(addr net.Addr, packet []byte) {}) }()
+	t.Cleanup(func() { _ = conn.Close() })
+	moteIP := addrtranslation.AddrToIPString(mote.LocalAddr())
+	updater := NewUpdater(conn, []addrtranslation.IPString{moteIP}, func(addrtranslation.IPString) net.Addr {
+		return mote.LocalAddr()
+	})
+	return &updater, moteIP
+}
+
+func TestWriteAllResendsOnStaleAck(t *testing.T) {
+	mote := listenLocalUDP(t)
+	// The first ACK belongs to the previous round
+	receptions := startTestMote(mote, func(n int, epoch Epoch) Epoch {
+		if n == 0 {
+			return epoch - 1
+		}
+		return epoch
+	})
+	updater, moteIP := newTestUpdater(t, mote)
+
+	pkt := append(encodePktPrefix(PktTypeUpdateRequest, 5), make([]byte, 9)...)
+	acks, err := updater.writeAll(moteIP, [][]byte{pkt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeEpoch, _ := decodeNodeEpoch(acks[0]); nodeEpoch.Update != 5 {
+		t.Errorf("got the ACK of the epoch %d, expected 5", nodeEpoch.Update)
+	}
+	if n := <-receptions; n != 2 {
+		t.Errorf("the mote received the packet %d times, expected 2", n)
+	}
+}
+
+func TestWriteAllGivesUpOnStaleAcks(t *testing.T) {
+	mote := listenLocalUDP(t)
+	receptions := startTestMote(mote, func(n int, epoch Epoch) Epoch { return epoch - 1 })
+	updater, moteIP := newTestUpdater(t, mote)
+
+	pkt := append(encodePktPrefix(PktTypeUpdateRequest, 5), make([]byte, 9)...)
+	if _, err := updater.writeAll(moteIP, [][]byte{pkt}); err == nil {
+		t.Fatal("no error while the mote only sends stale ACKs")
+	}
+	if n := <-receptions; n != maxStaleResends+1 {
+		t.Errorf("the mote received the packet %d times, expected %d", n, maxStaleResends+1)
+	}
+}
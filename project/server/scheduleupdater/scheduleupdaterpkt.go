@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"os"
 	"scheduleupdater-server/addrtranslation"
 	"scheduleupdater-server/applications"
 	stats "scheduleupdater-server/stats"
@@ -17,80 +16,218 @@ import (
 
 const ScheduleUpdaterPktMaxCells = 11
 
+// ClientPort is the UDP port on which the motes listen (UDP_CLIENT_PORT in common/udpack-server.c).
+const ClientPort = 0xF0B2
+
+// PeerAddrResolver translates the IP address of a node into the address used
+// by the transport of the UDPAckConn to reach this node.
+type PeerAddrResolver = func(clientIP addrtranslation.IPString) net.Addr
+
+// UDPPeerAddr resolves the address of a node reachable over UDP on `ClientPort`.
+func UDPPeerAddr(clientIP addrtranslation.IPString) net.Addr {
+	return &net.UDPAddr{
+		IP:   net.ParseIP(string(clientIP)),
+		Port: ClientPort,
+		Zone: "",
+	}
+}
+
 type Updater struct {
-	conn    *udpack.UDPAckConn
-	clients []addrtranslation.IPString
+	conn     *udpack.UDPAckConn
+	clients  []addrtranslation.IPString
+	peerAddr PeerAddrResolver
+	// installed is the last schedule confirmed by the clients, nil before the first update
+	installed    *Schedule
+	epoch        Epoch
+	renegotiate  Renegotiate
+	commitPolicy CommitPolicy
 }
 
-func NewUpdater(conn *udpack.UDPAckConn, clients []addrtranslation.IPString) Updater {
+// NewUpdater creates an Updater sending the schedule to `clients` through `conn`.
+// When `peerAddr` is nil, the clients are reached over UDP with `UDPPeerAddr`.
+func NewUpdater(conn *udpack.UDPAckConn, clients []addrtranslation.IPString, peerAddr PeerAddrResolver) Updater {
 	utils.Log.WarningPrintln("Client len: ", len(clients))
+	if peerAddr == nil {
+		peerAddr = UDPPeerAddr
+	}
 	return Updater{
-		conn:    conn,
-		clients: clients,
+		conn:         conn,
+		clients:      clients,
+		peerAddr:     peerAddr,
+		commitPolicy: NewDefaultCommitPolicy(),
 	}
 }
 
-func (updater *Updater) UpdateClients(schedule *Schedule, rplGraph *applications.RPLGraph) {
-	// helper function to check if any error and panic if any
-	panicIfErrors := func(ackPackets <-chan AckPacketOrError) {
-		for ackPacket := range ackPackets {
-			if ackPacket.err != nil {
-				log.Panic(ackPacket.err.Error())
-			}
-		}
+// SetRenegotiation sets the function computing a revised schedule when nodes
+// decline an update. Without it, a decline makes UpdateClients fail.
+func (updater *Updater) SetRenegotiation(renegotiate Renegotiate) {
+	updater.renegotiate = renegotiate
+}
+
+// SetClients sets the clients receiving the next updates.
+func (updater *Updater) SetClients(clients []addrtranslation.IPString) {
+	updater.clients = clients
+}
+
+// Installed returns the last schedule confirmed by the clients, including the
+// revisions made after declines, or nil before the first update.
+func (updater *Updater) Installed() *Schedule {
+	return updater.installed
+}
+
+// UpdateClients sends the new `schedule` to every client and then confirms the
+// update from the leaves to the root of the `rplGraph`. Once a schedule is
+// installed, the next ones with the same geometry are sent as incremental
+// updates to the clients whose cells changed. A failed update is aborted, see
+// CommitPolicy for a failure of the confirmations.
+func (updater *Updater) UpdateClients(schedule *Schedule, rplGraph *applications.RPLGraph) error {
+	epoch, err := updater.nextEpoch()
+	if err != nil {
+		return err
+	}
+	schedule.Epoch = epoch
+
+	// When the geometry does not change, only the changes are sent to the
+	// clients whose schedule changed
+	clients := updater.clients
+	serialize := schedule.Serialize
+	incremental := updater.installed != nil && updater.installed.Geometry == schedule.Geometry
+	if incremental {
+		diff := Diff(updater.installed, schedule)
+		clients = filterClients(updater.clients, func(clientIP addrtranslation.IPString) bool {
+			_, in := diff[clientIP]
+			return in
+		})
+		serialize = diff.Serialize
+		log.Println("Incremental update of", len(clients), "clients")
 	}
 
-	// New schedule update
+	// New schedule update, the header is acknowledged before the cells are sent
+	// so that every node creates the slotframe with the geometry of the schedule
 	stats.SimulationStats.ScheduleUpdateStart = time.Now()
-	scheduleUpdateAckPackets := updater.sendToEachClientAsync(schedule.Serialize, updater.clients)
-	for ackPacket := range scheduleUpdateAckPackets {
-		if ackPacket.err != nil {
-			log.Panic(ackPacket.err.Error())
-		}
-		if ackPacket.confirmation() == AckPacketConfirmationDecline {
-			// TODO HANDLE decline
-			panic("One node declined the new schedule, the code does not handle yet this case")
-		}
+	clients, schedule, err = updater.prepare(schedule, serialize, incremental, clients)
+	if err != nil {
+		updater.abort(epoch, clients)
+		return err
 	}
 	log.Println("No errors detected while sending the new schedule 🎉")
 	stats.SimulationStats.CopyTimeouts()
 
-	order := rplGraph.LeavesToRootOrder()
+	inClients := make(map[addrtranslation.IPString]bool, len(clients))
+	for _, clientIP := range clients {
+		inClients[clientIP] = true
+	}
+	order := filterClients(rplGraph.LeavesToRootOrder(), func(clientIP addrtranslation.IPString) bool {
+		return inClients[clientIP]
+	})
 	// Update complete
-	updateCompleteErrors := updater.sendToEachClientSync(func(clientIP addrtranslation.IPString) ([][]byte, error) {
-		updateCompletePkt := UpdateConfirmation{}
-		return [][]byte{updateCompletePkt.Encode()}, nil
-	}, order)
+	swapped, err := updater.commit(epoch, order, updater.commitPolicy.Timeout)
 	stats.SimulationStats.ScheduleUpdateEnd = time.Now()
-	panicIfErrors(updateCompleteErrors)
+	if err != nil {
+		return updater.failCommit(schedule, order, swapped, err)
+	}
+	updater.installed = schedule
 	log.Println("No errors detected while sending complete pkt 🎉")
 	log.Println("Everything is ok don't worry! Be happy 🎉🎉🎉")
-	stats.SimulationStats.WriteToFile("stats")
-	os.Exit(0)
+	return nil
 }
 
-type Serializer = func(clientIP addrtranslation.IPString) ([][]byte, error)
+// prepare sends the cells of the new schedule to the shadow slotframe of the
+// clients. The declined cells are renegotiated, the revised schedule and the
+// clients that received cells are returned.
+func (updater *Updater) prepare(schedule *Schedule, serialize Serializer, incremental bool, clients []addrtranslation.IPString) ([]addrtranslation.IPString, *Schedule, error) {
+	if err := updater.sendHeaders(schedule, incremental, clients); err != nil {
+		return clients, schedule, err
+	}
+	declines, err := updater.sendCells(serialize, clients)
+	if err != nil {
+		return clients, schedule, err
+	}
+	for renegotiations := 0; len(declines) > 0; renegotiations++ {
+		if updater.renegotiate == nil || renegotiations >= maxRenegotiations {
+			return clients, schedule, &DeclineError{Declines: declines}
+		}
+		for _, decline := range declines {
+			utils.Log.WarningPrintln(decline.String())
+		}
+		revised, err := updater.renegotiate(schedule, declines)
+		if err != nil {
+			return clients, schedule, err
+		}
+		revised.Epoch = schedule.Epoch
+		// The affected clients restart their update with the revised cells
+		affected := affectedClients(updater.clients, schedule, revised, declines)
+		log.Println("Renegotiation", renegotiations+1, "sends the revised schedule to", len(affected), "clients")
+		schedule = revised
+		clients = mergeClients(clients, affected)
+		if err := updater.sendHeaders(schedule, false, affected); err != nil {
+			return clients, schedule, err
+		}
+		declines, err = updater.sendCells(schedule.serializeOrEmpty, affected)
+		if err != nil {
+			return clients, schedule, err
+		}
+	}
+	return clients, schedule, nil
+}
 
-func (updater *Updater) sendToEachClientAsync(serialize Serializer, order []addrtranslation.IPString) <-chan AckPacketOrError {
-	var wg sync.WaitGroup
-	//clientCount := len(updater.clients)
-	ackPackets := make(chan AckPacketOrError, 10000) // TODO MODIFY THIS SOULD NOT TAKE 1000 entries
-	for _, clientIP := range order {
-		wg.Add(1)
-		go updater.serializeAndSend(clientIP, serialize, ackPackets, &wg)
+func (updater *Updater) sendHeaders(schedule *Schedule, incremental bool, clients []addrtranslation.IPString) error {
+	headerErrors := updater.sendToEachClientAsync(func(clientIP addrtranslation.IPString) ([][]byte, error) {
+		headerPkt := ScheduleHeader{Epoch: schedule.Epoch, Geometry: schedule.Geometry, Incremental: incremental}
+		return [][]byte{headerPkt.Encode()}, nil
+	}, clients)
+	for ackPacket := range headerErrors {
+		if ackPacket.err != nil {
+			return ackPacket.err
+		}
 	}
-	wg.Wait()
-	close(ackPackets)
-	return ackPackets
+	return nil
+}
+
+// sendCells sends the cells of each client and returns the packets declined.
+func (updater *Updater) sendCells(serialize Serializer, clients []addrtranslation.IPString) ([]Decline, error) {
+	declines := make([]Decline, 0)
+	for ackPacket := range updater.sendToEachClientAsync(serialize, clients) {
+		if ackPacket.err != nil {
+			return nil, ackPacket.err
+		}
+		if ackPacket.confirmation() == AckPacketConfirmationDecline {
+			declines = append(declines, newDecline(ackPacket.clientIP, ackPacket.request, ackPacket.packet))
+		}
+	}
+	return declines, nil
+}
+
+// mergeClients returns the clients of `a` followed by the clients of `b` that are not in `a`.
+func mergeClients(a []addrtranslation.IPString, b []addrtranslation.IPString) []addrtranslation.IPString {
+	inA := make(map[addrtranslation.IPString]bool, len(a))
+	for _, clientIP := range a {
+		inA[clientIP] = true
+	}
+	return append(append([]addrtranslation.IPString{}, a...), filterClients(b, func(clientIP addrtranslation.IPString) bool {
+		return !inA[clientIP]
+	})...)
+}
+
+func filterClients(clients []addrtranslation.IPString, keep func(clientIP addrtranslation.IPString) bool) []addrtranslation.IPString {
+	kept := make([]addrtranslation.IPString, 0, len(clients))
+	for _, clientIP := range clients {
+		if keep(clientIP) {
+			kept = append(kept, clientIP)
+		}
+	}
+	return kept
 }
 
-func (updater *Updater) sendToEachClientSync(serialize Serializer, order []addrtranslation.IPString) <-chan AckPacketOrError {
+type Serializer = func(clientIP addrtranslation.IPString) ([][]byte, error)
+
+func (updater *Updater) sendToEachClientAsync(serialize Serializer, order []addrtranslation.IPString) <-chan AckPacketOrError {
 	var wg sync.WaitGroup
 	//clientCount := len(updater.clients)
 	ackPackets := make(chan AckPacketOrError, 10000) // TODO MODIFY THIS SOULD NOT TAKE 1000 entries
 	for _, clientIP := range order {
 		wg.Add(1)
-		updater.serializeAndSend(clientIP, serialize, ackPackets, &wg)
+		go updater.serializeAndSend(clientIP, serialize, ackPackets, &wg)
 	}
 	wg.Wait()
 	close(ackPackets)
@@ -98,8 +235,11 @@ func (updater *Updater) sendToEachClientSync(serialize Serializer, order []addrt
 }
 
 type AckPacketOrError struct {
-	err    error
-	packet []byte
+	err      error
+	packet   []byte
+	clientIP addrtranslation.IPString
+	// request is the packet acknowledged by `packet`
+	request []byte
 }
 
 type AckPacketConfirmation byte
@@ -125,22 +265,14 @@ func (updater *Updater) serializeAndSend(clientIP addrtranslation.IPString, seri
 		ackPackets <- AckPacketOrError{err: err}
 		return
 	}
-	for i, pkt := range pkts {
-		utils.Log.Println("Sending to client: ", clientIP, ", packet ", i, " / ", len(pkts))
-		// @incomplete needs refactor
-		udpAddr := &net.UDPAddr{
-			IP:   net.ParseIP(string(clientIP)),
-			Port: 0xF0B2,
-			Zone: "",
-		}
-		log.Println("Pkt size: ", len(pkt))
-		err, packet := updater.conn.WriteTo(pkt, udpAddr)
-		if err != nil {
-			utils.Log.ErrorPrintln(err.Error())
-			ackPackets <- AckPacketOrError{err: err}
-			return
-		}
-		ackPackets <- AckPacketOrError{packet: packet}
+	packets, err := updater.writeAll(clientIP, pkts)
+	if err != nil {
+		utils.Log.ErrorPrintln(err.Error())
+		ackPackets <- AckPacketOrError{err: err}
+		return
+	}
+	for i, packet := range packets {
+		ackPackets <- AckPacketOrError{packet: packet, clientIP: clientIP, request: pkts[i]}
 	}
 }
 
@@ -169,9 +301,86 @@ type PktType int
 const (
 	PktTypeUpdateRequest = iota
 	PktTypeUpdateConfirmation
+	PktTypeScheduleHeader
+	PktTypeRemoveRequest
+	PktTypeAbortRequest
+	PktTypeEpochQuery
 )
 
+// SlotframeGeometry describes the slotframe in which the nodes install the
+// schedule. The nodes alternate between the handles `Handle` and `Handle + 1`
+// to build a new schedule while the current one is still in use.
+type SlotframeGeometry struct {
+	Handle uint16
+	Length uint16
+	// FirstChannel and LastChannel are the channel offsets the cells can use
+	FirstChannel uint16
+	LastChannel  uint16
+}
+
+// NewDefaultSlotframeGeometry returns the geometry used by the nodes before
+// they receive a schedule header (SCHEDULE_UPDATER_SLOTFRAME_* in
+// common/schedule_updater.h). The channel offset 0 is left to the 6TiSCH minimal
+// cell and the offsets 1 to 3 fit the default hopping sequence of 4 channels.
+func NewDefaultSlotframeGeometry() SlotframeGeometry {
+	return SlotframeGeometry{
+		Handle:       1,
+		Length:       21,
+		FirstChannel: 1,
+		LastChannel:  3,
+	}
+}
+
+// MaxHoppingSequenceLength is the number of channels of the longest TSCH
+// hopping sequence (TSCH_HOPPING_SEQUENCE_16_16).
+const MaxHoppingSequenceLength = 16
+
+func (geometry *SlotframeGeometry) Validate() error {
+	if geometry.Handle == 0 {
+		return errors.New("the slotframe handle 0 is used by the 6TiSCH minimal slotframe")
+	}
+	if geometry.Length < 2 {
+		return errors.New(fmt.Sprintf("the slotframe length %d leaves no timeslot besides the timeslot 0", geometry.Length))
+	}
+	if geometry.FirstChannel > geometry.LastChannel {
+		return errors.New(fmt.Sprintf("the first channel offset %d is after the last channel offset %d", geometry.FirstChannel, geometry.LastChannel))
+	}
+	if geometry.LastChannel >= MaxHoppingSequenceLength {
+		return errors.New(fmt.Sprintf("the last channel offset %d is outside the hopping sequences of at most %d channels", geometry.LastChannel, MaxHoppingSequenceLength))
+	}
+	return nil
+}
+
+// ScheduleHeader announces the geometry of the slotframe before the UpdateRequest
+// packets. When `Incremental` is set, the node starts the new slotframe with a
+// copy of the installed one and the packets only contain the changes (see Diff).
+type ScheduleHeader struct {
+	Epoch       Epoch
+	Geometry    SlotframeGeometry
+	Incremental bool
+}
+
+const ScheduleHeaderFlagIncremental = 1
+
+func (pkt *ScheduleHeader) Type() PktType {
+	return PktTypeScheduleHeader
+}
+
+func (pkt *ScheduleHeader) Encode() []byte {
+	buffer := encodePktPrefix(pkt.Type(), pkt.Epoch)
+	buffer = utils.AppendLittleEndianUint16(buffer, pkt.Geometry.Handle)
+	buffer = utils.AppendLittleEndianUint16(buffer, pkt.Geometry.Length)
+	buffer = utils.AppendLittleEndianUint16(buffer, pkt.Geometry.FirstChannel)
+	buffer = utils.AppendLittleEndianUint16(buffer, pkt.Geometry.LastChannel)
+	flags := uint8(0)
+	if pkt.Incremental {
+		flags |= ScheduleHeaderFlagIncremental
+	}
+	return append(buffer, flags)
+}
+
 type UpdateRequest struct {
+	Epoch        Epoch
 	NeighborAddr addrtranslation.MacAddr
 	Cells        []Cell
 }
@@ -181,46 +390,73 @@ func (pkt *UpdateRequest) Type() PktType {
 }
 
 func (pkt *UpdateRequest) Encode() []byte {
-	buffer := make([]byte, 0)
-	buffer = append(buffer, uint8(pkt.Type()))
+	return encodeCellsRequest(pkt.Type(), pkt.Epoch, pkt.NeighborAddr, pkt.Cells)
+}
+
+// RemoveRequest removes the links installed toward a neighbor at the timeslots
+// and channel offsets of `Cells`, it has the same layout as an UpdateRequest.
+type RemoveRequest struct {
+	Epoch        Epoch
+	NeighborAddr addrtranslation.MacAddr
+	Cells        []Cell
+}
+
+func (pkt *RemoveRequest) Type() PktType {
+	return PktTypeRemoveRequest
+}
+
+func (pkt *RemoveRequest) Encode() []byte {
+	return encodeCellsRequest(pkt.Type(), pkt.Epoch, pkt.NeighborAddr, pkt.Cells)
+}
+
+func encodeCellsRequest(pktType PktType, epoch Epoch, neighborAddr addrtranslation.MacAddr, cells []Cell) []byte {
+	buffer := encodePktPrefix(pktType, epoch)
 	// Appending the neighborAddr uint16 to the buffer
-	for _, v := range pkt.NeighborAddr {
+	for _, v := range neighborAddr {
 		buffer = append(buffer, v)
 	}
-	buffer = append(buffer, uint8(len(pkt.Cells)))
-    fmt.Println("SIZE BEFORE CELLS: ", len(buffer))
-    fmt.Println("Number of cells: ", len(pkt.Cells))
-	for i := 0; i < len(pkt.Cells); i++ {
-		buffer = append(buffer, uint8(pkt.Cells[i].LinkOptions))
-		buffer = utils.AppendLittleEndianUint16(buffer, pkt.Cells[i].TimeSlot)
-		buffer = utils.AppendLittleEndianUint16(buffer, pkt.Cells[i].Channel)
+	buffer = append(buffer, uint8(len(cells)))
+	for i := 0; i < len(cells); i++ {
+		buffer = append(buffer, uint8(cells[i].LinkOptions))
+		buffer = utils.AppendLittleEndianUint16(buffer, cells[i].TimeSlot)
+		buffer = utils.AppendLittleEndianUint16(buffer, cells[i].Channel)
 	}
-    fmt.Println("PKT SIZE TOTAL: ", len(buffer))
 	return buffer
 }
 
-type UpdateConfirmation struct{}
+type UpdateConfirmation struct {
+	Epoch Epoch
+}
 
 func (pkt *UpdateConfirmation) Type() PktType {
 	return PktTypeUpdateConfirmation
 }
 
 func (pkt *UpdateConfirmation) Encode() []byte {
-	return []byte{uint8(pkt.Type())}
+	return encodePktPrefix(pkt.Type(), pkt.Epoch)
 }
 
-type Schedule map[addrtranslation.IPString]map[*addrtranslation.MacAddr][]Cell
+// Schedule is the cells of each node toward each of its neighbors, installed
+// in a slotframe described by `Geometry`. `Epoch` is set by the Updater to
+// the epoch of the update round sending the schedule.
+type Schedule struct {
+	Epoch    Epoch
+	Geometry SlotframeGeometry
+	Cells    map[addrtranslation.IPString]map[addrtranslation.MacAddr][]Cell
+}
 
-func NewSchedule() Schedule {
-	return make(Schedule)
+func NewSchedule(geometry SlotframeGeometry) Schedule {
+	return Schedule{
+		Geometry: geometry,
+		Cells:    make(map[addrtranslation.IPString]map[addrtranslation.MacAddr][]Cell),
+	}
 }
 
-func (schedulePtr *Schedule) AddCell(nodeAddr addrtranslation.IPString, neighborAddr *addrtranslation.MacAddr, cell *Cell) {
-	schedule := *schedulePtr
-	mapCells, in := schedule[nodeAddr]
+func (schedule *Schedule) AddCell(nodeAddr addrtranslation.IPString, neighborAddr addrtranslation.MacAddr, cell *Cell) {
+	mapCells, in := schedule.Cells[nodeAddr]
 	if !in {
-		mapCells = make(map[*addrtranslation.MacAddr][]Cell)
-		schedule[nodeAddr] = mapCells
+		mapCells = make(map[addrtranslation.MacAddr][]Cell)
+		schedule.Cells[nodeAddr] = mapCells
 	}
 	cells, in := mapCells[neighborAddr]
 	if !in {
@@ -230,8 +466,8 @@ func (schedulePtr *Schedule) AddCell(nodeAddr addrtranslation.IPString, neighbor
 	mapCells[neighborAddr] = append(cells, *cell)
 }
 
-func (schedulePtr Schedule) Serialize(clientIP addrtranslation.IPString) ([][]byte, error) {
-	clientSchedule, in := schedulePtr[clientIP]
+func (schedule *Schedule) Serialize(clientIP addrtranslation.IPString) ([][]byte, error) {
+	clientSchedule, in := schedule.Cells[clientIP]
 	if !in {
 		return nil, errors.New(fmt.Sprintf("the udpack ip address (%s) doesn't have any schedule associated with it", clientIP))
 	}
@@ -240,7 +476,8 @@ func (schedulePtr Schedule) Serialize(clientIP addrtranslation.IPString) ([][]by
 	for neighborAddr, neighborCells := range clientSchedule {
 		for i := 0; i < len(neighborCells); i += ScheduleUpdaterPktMaxCells {
 			pkt := UpdateRequest{
-				NeighborAddr: *neighborAddr,
+				Epoch:        schedule.Epoch,
+				NeighborAddr: neighborAddr,
 				Cells:        neighborCells[i:min(i+ScheduleUpdaterPktMaxCells, len(neighborCells))],
 			}
 			pkts = append(pkts, pkt.Encode())
@@ -251,8 +488,17 @@ func (schedulePtr Schedule) Serialize(clientIP addrtranslation.IPString) ([][]by
 	return pkts, nil
 }
 
-func (schedulePtr Schedule) IsCellUsed(nodeAddr addrtranslation.IPString, neighborAddr *addrtranslation.MacAddr, cell *Cell) bool {
-	for _, scheduleCell := range schedulePtr[nodeAddr][neighborAddr] {
+// serializeOrEmpty serializes the cells of `clientIP`, a client without cells
+// installs an empty slotframe.
+func (schedule *Schedule) serializeOrEmpty(clientIP addrtranslation.IPString) ([][]byte, error) {
+	if _, in := schedule.Cells[clientIP]; !in {
+		return [][]byte{}, nil
+	}
+	return schedule.Serialize(clientIP)
+}
+
+func (schedule *Schedule) IsCellUsed(nodeAddr addrtranslation.IPString, neighborAddr addrtranslation.MacAddr, cell *Cell) bool {
+	for _, scheduleCell := range schedule.Cells[nodeAddr][neighborAddr] {
 		if cell.Equals(&scheduleCell) {
 			return true
 		}
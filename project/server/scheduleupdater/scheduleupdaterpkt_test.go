@@ -0,0 +1,47 @@
+package scheduleupdater
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSlotframeGeometryValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		geometry SlotframeGeometry
+		valid    bool
+	}{
+		{"default", NewDefaultSlotframeGeometry(), true},
+		{"handle of the minimal slotframe", SlotframeGeometry{Handle: 0, Length: 21, FirstChannel: 1, LastChannel: 3}, false},
+		{"no timeslot besides the timeslot 0", SlotframeGeometry{Handle: 1, Length: 1, FirstChannel: 1, LastChannel: 3}, false},
+		{"two timeslots", SlotframeGeometry{Handle: 1, Length: 2, FirstChannel: 1, LastChannel: 3}, true},
+		{"first channel after the last one", SlotframeGeometry{Handle: 1, Length: 21, FirstChannel: 4, LastChannel: 3}, false},
+		{"a single channel", SlotframeGeometry{Handle: 1, Length: 21, FirstChannel: 3, LastChannel: 3}, true},
+		{"longest hopping sequence", SlotframeGeometry{Handle: 1, Length: 21, FirstChannel: 0, LastChannel: MaxHoppingSequenceLength - 1}, true},
+		{"beyond the longest hopping sequence", SlotframeGeometry{Handle: 1, Length: 21, FirstChannel: 1, LastChannel: MaxHoppingSequenceLength}, false},
+	}
+	for _, test := range tests {
+		if err := test.geometry.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: Validate() = %v, expected valid %t", test.name, err, test.valid)
+		}
+	}
+}
+
+// The offsets are the HEADER_PKT_*_OFFSET of common/schedule_updater.h.
+func TestScheduleHeaderEncode(t *testing.T) {
+	header := ScheduleHeader{
+		Epoch:       0x0102,
+		Geometry:    SlotframeGeometry{Handle: 0x0304, Length: 0x0506, FirstChannel: 0x0708, LastChannel: 0x090a},
+		Incremental: true,
+	}
+	expected := []byte{PktTypeScheduleHeader, 0x02, 0x01, 0x04, 0x03, 0x06, 0x05, 0x08, 0x07, 0x0a, 0x09, ScheduleHeaderFlagIncremental}
+	if encoded := header.Encode(); !bytes.Equal(encoded, expected) {
+		t.Errorf("incremental header encoded as %v, expected %v", encoded, expected)
+	}
+
+	header.Incremental = false
+	expected[len(expected)-1] = 0
+	if encoded := header.Encode(); !bytes.Equal(encoded, expected) {
+		t.Errorf("full header encoded as %v, expected %v", encoded, expected)
+	}
+}
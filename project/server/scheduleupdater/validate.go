@@ -0,0 +1,257 @@
+package scheduleupdater
+
+// Validation of a schedule before it is sent to the motes. Without it, a bad
+// schedule is only discovered when `tsch_schedule_add_link` fails on a mote.
+
+import (
+	"fmt"
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/applications"
+	"sort"
+)
+
+type DiagnosticKind int
+
+const (
+	// A TX cell without the RX cell on the neighbor, or the other way around
+	DiagnosticUnpairedCell DiagnosticKind = iota
+	// A node taking part in two links in the same timeslot
+	DiagnosticHalfDuplex
+	// The same cell appearing twice toward the same neighbor
+	DiagnosticDuplicateCell
+	// A channel offset outside the hopping sequence or the channels of the slotframe geometry
+	DiagnosticChannelOutOfRange
+	// A timeslot beyond the slotframe length of the geometry
+	DiagnosticTimeslotOutOfRange
+	// A link toward a node which is neither a neighbor nor the RPL parent or child
+	DiagnosticNotNeighbor
+	// More cells for a node than the TSCH links pool (TSCH_SCHEDULE_MAX_LINKS)
+	DiagnosticTooManyCells
+	// Channel offsets of the slotframe geometry outside the hopping sequence
+	DiagnosticGeometryOutOfRange
+)
+
+func (kind DiagnosticKind) String() string {
+	switch kind {
+	case DiagnosticUnpairedCell:
+		return "unpaired-cell"
+	case DiagnosticHalfDuplex:
+		return "half-duplex"
+	case DiagnosticDuplicateCell:
+		return "duplicate-cell"
+	case DiagnosticChannelOutOfRange:
+		return "channel-out-of-range"
+	case DiagnosticTimeslotOutOfRange:
+		return "timeslot-out-of-range"
+	case DiagnosticNotNeighbor:
+		return "not-neighbor"
+	case DiagnosticTooManyCells:
+		return "too-many-cells"
+	case DiagnosticGeometryOutOfRange:
+		return "geometry-out-of-range"
+	}
+	return fmt.Sprintf("unknown(%d)", int(kind))
+}
+
+// Diagnostic is a problem found in the schedule of `Node`. `Neighbor` and
+// `Cell` are only meaningful for the diagnostics about a single cell, `Node`
+// is empty for the diagnostics about the geometry.
+type Diagnostic struct {
+	Kind     DiagnosticKind
+	Node     addrtranslation.IPString
+	Neighbor addrtranslation.MacAddr
+	Cell     Cell
+	Message  string
+}
+
+func (diagnostic Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s: %s", diagnostic.Node, diagnostic.Kind, diagnostic.Message)
+}
+
+// ValidationConfig describes the limits of the motes. The slotframe length and
+// the channel offsets are the ones of the geometry of the schedule.
+type ValidationConfig struct {
+	// HoppingSequenceLength number of channels of the TSCH hopping sequence
+	HoppingSequenceLength uint16
+	// MaxCells number of links a node can hold (TSCH_SCHEDULE_MAX_LINKS), shared
+	// by all the slotframes of the node
+	MaxCells int
+}
+
+// NewDefaultValidationConfig returns the values used by the motes: the
+// TSCH_HOPPING_SEQUENCE_4_4 and the TSCH_SCHEDULE_MAX_LINKS of Contiki-NG.
+func NewDefaultValidationConfig() ValidationConfig {
+	return ValidationConfig{
+		HoppingSequenceLength: 4,
+		MaxCells:              32,
+	}
+}
+
+// Validate checks `schedule` with the default configuration of the motes.
+func Validate(schedule Schedule, graph *applications.RPLGraph, topology *applications.Topology) []Diagnostic {
+	return ValidateWithConfig(schedule, graph, topology, NewDefaultValidationConfig())
+}
+
+// ValidateWithConfig returns the problems found in `schedule`, sorted by node.
+// An empty list means that the schedule can be installed by the motes.
+func ValidateWithConfig(schedule Schedule, graph *applications.RPLGraph, topology *applications.Topology, config ValidationConfig) []Diagnostic {
+	validator := scheduleValidator{
+		schedule:  schedule,
+		graph:     graph,
+		topology:  topology,
+		config:    config,
+		neighbors: validNeighbors(graph, topology),
+	}
+	validator.validateGeometry()
+	nodes := make([]addrtranslation.IPString, 0, len(schedule.Cells))
+	for node := range schedule.Cells {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i] < nodes[j] })
+	for _, node := range nodes {
+		validator.validateNode(node)
+	}
+	return validator.diagnostics
+}
+
+type scheduleValidator struct {
+	schedule    Schedule
+	graph       *applications.RPLGraph
+	topology    *applications.Topology
+	config      ValidationConfig
+	neighbors   map[addrtranslation.IPString]map[addrtranslation.MacAddr]bool
+	diagnostics []Diagnostic
+}
+
+func (validator *scheduleValidator) report(kind DiagnosticKind, node addrtranslation.IPString, neighbor addrtranslation.MacAddr, cell Cell, format string, a ...interface{}) {
+	validator.diagnostics = append(validator.diagnostics, Diagnostic{
+		Kind:     kind,
+		Node:     node,
+		Neighbor: neighbor,
+		Cell:     cell,
+		Message:  fmt.Sprintf(format, a...),
+	})
+}
+
+// validateGeometry checks that the motes can hop over the channel offsets of
+// the geometry, a mote built with a shorter hopping sequence cannot use them.
+func (validator *scheduleValidator) validateGeometry() {
+	geometry := &validator.schedule.Geometry
+	if geometry.LastChannel >= validator.config.HoppingSequenceLength {
+		validator.report(DiagnosticGeometryOutOfRange, "", addrtranslation.MacAddr{}, Cell{},
+			"the channel offsets %d to %d of the slotframe are outside the hopping sequence of %d channels",
+			geometry.FirstChannel, geometry.LastChannel, validator.config.HoppingSequenceLength)
+	}
+}
+
+func (validator *scheduleValidator) validateNode(node addrtranslation.IPString) {
+	nodeMac, nodeMacFound := validator.topology.MacIPTranslation.FindMac(node)
+	// The neighbors are sorted so that the diagnostics are always in the same order
+	neighborsMacs := make([]addrtranslation.MacAddr, 0, len(validator.schedule.Cells[node]))
+	for neighborMac := range validator.schedule.Cells[node] {
+		neighborsMacs = append(neighborsMacs, neighborMac)
+	}
+	sort.Slice(neighborsMacs, func(i, j int) bool {
+		return string(neighborsMacs[i][:]) < string(neighborsMacs[j][:])
+	})
+
+	geometry := &validator.schedule.Geometry
+	cellsCount := 0
+	timeslots := make(map[uint16]addrtranslation.MacAddr)
+	for _, neighbor := range neighborsMacs {
+		if !validator.neighbors[node][neighbor] {
+			validator.report(DiagnosticNotNeighbor, node, neighbor, Cell{},
+				"%v is neither a neighbor nor the RPL parent or child", neighbor)
+		}
+		cells := make(map[Cell]bool)
+		for _, cell := range validator.schedule.Cells[node][neighbor] {
+			cellsCount++
+			if cell.TimeSlot >= geometry.Length {
+				validator.report(DiagnosticTimeslotOutOfRange, node, neighbor, cell,
+					"timeslot %d toward %v is beyond the slotframe length %d", cell.TimeSlot, neighbor, geometry.Length)
+			}
+			if cell.Channel >= validator.config.HoppingSequenceLength {
+				validator.report(DiagnosticChannelOutOfRange, node, neighbor, cell,
+					"channel offset %d toward %v is outside the hopping sequence of %d channels", cell.Channel, neighbor, validator.config.HoppingSequenceLength)
+			} else if cell.Channel < geometry.FirstChannel || cell.Channel > geometry.LastChannel {
+				validator.report(DiagnosticChannelOutOfRange, node, neighbor, cell,
+					"channel offset %d toward %v is outside the channel offsets %d to %d of the slotframe", cell.Channel, neighbor, geometry.FirstChannel, geometry.LastChannel)
+			}
+			if cells[cell] {
+				validator.report(DiagnosticDuplicateCell, node, neighbor, cell,
+					"cell %+v toward %v appears more than once", cell, neighbor)
+				continue
+			}
+			cells[cell] = true
+			if other, in := timeslots[cell.TimeSlot]; in {
+				validator.report(DiagnosticHalfDuplex, node, neighbor, cell,
+					"timeslot %d is used toward %v and %v", cell.TimeSlot, other, neighbor)
+			} else {
+				timeslots[cell.TimeSlot] = neighbor
+			}
+			if nodeMacFound {
+				validator.validatePairing(node, nodeMac, neighbor, cell)
+			}
+		}
+	}
+	if cellsCount > validator.config.MaxCells {
+		validator.report(DiagnosticTooManyCells, node, addrtranslation.MacAddr{}, Cell{},
+			"%d cells while a node can hold at most %d", cellsCount, validator.config.MaxCells)
+	}
+}
+
+// validatePairing checks that the neighbor has the RX cell matching a TX cell
+// of the node, or the TX cell matching a RX cell.
+func (validator *scheduleValidator) validatePairing(node addrtranslation.IPString, nodeMac addrtranslation.MacAddr, neighbor addrtranslation.MacAddr, cell Cell) {
+	var expected LinkOptions
+	switch {
+	case cell.LinkOptions&LinkOptionTX != 0:
+		expected = LinkOptionRX
+	case cell.LinkOptions&LinkOptionRX != 0:
+		expected = LinkOptionTX
+	default:
+		return
+	}
+	neighborIP, ok := validator.topology.MacIPTranslation.Find(neighbor)
+	if ok {
+		for _, neighborCell := range validator.schedule.Cells[neighborIP][nodeMac] {
+			if neighborCell.Equals(&cell) && neighborCell.LinkOptions&expected != 0 {
+				return
+			}
+		}
+	}
+	validator.report(DiagnosticUnpairedCell, node, neighbor, cell,
+		"cell %+v toward %v has no matching cell on the neighbor", cell, neighbor)
+}
+
+// validNeighbors returns, for each node, the MAC addresses of the nodes it can
+// have a link with: its neighbors (in both directions) and its RPL parent and children.
+func validNeighbors(graph *applications.RPLGraph, topology *applications.Topology) map[addrtranslation.IPString]map[addrtranslation.MacAddr]bool {
+	neighbors := make(map[addrtranslation.IPString]map[addrtranslation.MacAddr]bool)
+	add := func(node addrtranslation.IPString, neighbor addrtranslation.MacAddr) {
+		if neighbors[node] == nil {
+			neighbors[node] = make(map[addrtranslation.MacAddr]bool)
+		}
+		neighbors[node][neighbor] = true
+	}
+	addBoth := func(a addrtranslation.IPString, b addrtranslation.IPString) {
+		aMac, aFound := topology.MacIPTranslation.FindMac(a)
+		bMac, bFound := topology.MacIPTranslation.FindMac(b)
+		if aFound && bFound {
+			add(a, bMac)
+			add(b, aMac)
+		}
+	}
+	for node, macNeighbors := range topology.TopologyMap {
+		for _, macNeighbor := range macNeighbors {
+			add(node, *macNeighbor)
+			if neighborIP, ok := topology.MacIPTranslation.Find(*macNeighbor); ok {
+				addBoth(node, neighborIP)
+			}
+		}
+	}
+	for child, rplLink := range *graph {
+		addBoth(child, rplLink.ParentIP)
+	}
+	return neighbors
+}
@@ -38,17 +38,129 @@ func (d *IncDict) Increment(ip addrtranslation.IPString) {
 	d.IPMap[ip]++
 }
 
+// Set sets the number of `ip` to `value`.
+func (d *IncDict) Set(ip addrtranslation.IPString, value int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.IPMap[ip] = value
+}
+
+// Copy returns a copy of the numbers, which can be read while the IncDict is
+// being incremented.
+func (d *IncDict) Copy() IncDict {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	copied := make(map[addrtranslation.IPString]int, len(d.IPMap))
+	for ip, value := range d.IPMap {
+		copied[ip] = value
+	}
+	return IncDict{IPMap: copied}
+}
+
+// Reset sets back the number of each IP address to 0.
+func (d *IncDict) Reset() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.IPMap = make(map[addrtranslation.IPString]int)
+}
+
+// KeyIncDict hash map that counts, for each IP address, a number for each key.
+type KeyIncDict struct {
+	IPMap map[addrtranslation.IPString]map[string]int `json:"IPMap,omitempty"`
+	lock  sync.RWMutex
+}
+
+func NewKeyIncDict() KeyIncDict {
+	return KeyIncDict{
+		IPMap: make(map[addrtranslation.IPString]map[string]int),
+		lock:  sync.RWMutex{},
+	}
+}
+
+func (d *KeyIncDict) Increment(ip addrtranslation.IPString, key string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, in := d.IPMap[ip]; !in {
+		d.IPMap[ip] = make(map[string]int)
+	}
+	d.IPMap[ip][key]++
+}
+
+// Copy returns a copy of the numbers, which can be read while the KeyIncDict
+// is being incremented.
+func (d *KeyIncDict) Copy() KeyIncDict {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	copied := make(map[addrtranslation.IPString]map[string]int, len(d.IPMap))
+	for ip, keys := range d.IPMap {
+		copied[ip] = make(map[string]int, len(keys))
+		for key, value := range keys {
+			copied[ip][key] = value
+		}
+	}
+	return KeyIncDict{IPMap: copied}
+}
+
+// Reset sets back all the numbers to 0.
+func (d *KeyIncDict) Reset() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.IPMap = make(map[addrtranslation.IPString]map[string]int)
+}
+
+// ValueDict hash map that stores the latest value recorded for each IP address.
+type ValueDict struct {
+	IPMap map[addrtranslation.IPString]float64 `json:"IPMap,omitempty"`
+	lock  sync.RWMutex
+}
+
+func NewValueDict() ValueDict {
+	return ValueDict{
+		IPMap: make(map[addrtranslation.IPString]float64),
+		lock:  sync.RWMutex{},
+	}
+}
+
+func (d *ValueDict) Set(ip addrtranslation.IPString, value float64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.IPMap[ip] = value
+}
+
+// Copy returns a copy of the values, which can be read while the ValueDict is
+// being updated.
+func (d *ValueDict) Copy() ValueDict {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	copied := make(map[addrtranslation.IPString]float64, len(d.IPMap))
+	for ip, value := range d.IPMap {
+		copied[ip] = value
+	}
+	return ValueDict{IPMap: copied}
+}
+
 type Stats struct {
-	Nsent                      IncDict   `json:"nsent,omitempty"`
-	Nreceived                  IncDict   `json:"nreceived,omitempty"`
-	Timeouts                   IncDict   `json:"timeouts,omitempty"`
-	TimeoutsBeforeConfirmation IncDict   `json:"timeoutsBeforeConfirmation,omitempty"`
-	ProtocolSent               IncDict   `json:"protocolSent,omitempty"`
-	ProtocolReceived           IncDict   `json:"protocolReceived,omitempty"`
-	ScheduleUpdateStart        time.Time `json:"scheduleUpdateStart,omitempty"`
-	ScheduleUpdateEnd          time.Time `json:"scheduleUpdateEnd,omitempty"`
-	Nclients                   uint      `json:"nclients,omitempty"`
-	Timeout                    float64   `json:"timeoutS,omitempty"`
+	Nsent                      IncDict    `json:"nsent,omitempty"`
+	Nreceived                  IncDict    `json:"nreceived,omitempty"`
+	Timeouts                   IncDict    `json:"timeouts,omitempty"`
+	TimeoutsBeforeConfirmation IncDict    `json:"timeoutsBeforeConfirmation,omitempty"`
+	ProtocolSent               IncDict    `json:"protocolSent,omitempty"`
+	ProtocolReceived           IncDict    `json:"protocolReceived,omitempty"`
+	Rejected                   KeyIncDict `json:"rejected,omitempty"`
+	Dropped                    IncDict    `json:"dropped,omitempty"`
+	SmoothedRTT                ValueDict  `json:"smoothedRttS,omitempty"`
+	RTTVariance                ValueDict  `json:"rttVarianceS,omitempty"`
+	RTO                        ValueDict  `json:"rtoS,omitempty"`
+	ScheduleUpdateStart        time.Time  `json:"scheduleUpdateStart,omitempty"`
+	ScheduleUpdateEnd          time.Time  `json:"scheduleUpdateEnd,omitempty"`
+	Nclients                   uint       `json:"nclients,omitempty"`
+	Timeout                    float64    `json:"timeoutS,omitempty"`
+	// Round is the index of the scheduling round, starting at 1
+	Round uint `json:"round,omitempty"`
+	// Trigger lists the applications whose changes started the round
+	Trigger []string `json:"trigger,omitempty"`
+	Epoch   uint16   `json:"epoch,omitempty"`
+	Error   string   `json:"error,omitempty"`
 }
 
 var SimulationStats = Stats{
@@ -58,13 +170,18 @@ var SimulationStats = Stats{
 	TimeoutsBeforeConfirmation: NewIncDict(),
 	ProtocolSent:               NewIncDict(),
 	ProtocolReceived:           NewIncDict(),
+	Rejected:                   NewKeyIncDict(),
+	Dropped:                    NewIncDict(),
+	SmoothedRTT:                NewValueDict(),
+	RTTVariance:                NewValueDict(),
+	RTO:                        NewValueDict(),
 	Nclients:                   0,
 }
 
 func (stats *Stats) WriteToFile(prefix string) {
 	filename := prefix + strconv.FormatInt(time.Now().Unix(), 10) + ".json"
 	utils.Log.Println("Writing stats to file.")
-	statsJson, err := json.MarshalIndent(stats, "", "    ")
+	statsJson, err := json.MarshalIndent(stats.copy(), "", "    ")
 	if err != nil {
 		log.Panicln(err)
 	}
@@ -74,9 +191,51 @@ func (stats *Stats) WriteToFile(prefix string) {
 	}
 }
 
+// NewRound starts the stats of a new scheduling round: the counters restart
+// from 0 while the RTT estimations are kept.
+func (stats *Stats) NewRound(round uint, trigger []string) {
+	for _, counter := range []*IncDict{&stats.Nsent, &stats.Nreceived, &stats.Timeouts,
+		&stats.TimeoutsBeforeConfirmation, &stats.ProtocolSent, &stats.ProtocolReceived, &stats.Dropped} {
+		counter.Reset()
+	}
+	stats.Rejected.Reset()
+	stats.ScheduleUpdateStart = time.Time{}
+	stats.ScheduleUpdateEnd = time.Time{}
+	stats.Round = round
+	stats.Trigger = trigger
+	stats.Epoch = 0
+	stats.Error = ""
+}
+
+// copy returns a copy of the stats, the dicts keep being updated by the
+// connections while the copy is written.
+func (stats *Stats) copy() *Stats {
+	return &Stats{
+		Nsent:                      stats.Nsent.Copy(),
+		Nreceived:                  stats.Nreceived.Copy(),
+		Timeouts:                   stats.Timeouts.Copy(),
+		TimeoutsBeforeConfirmation: stats.TimeoutsBeforeConfirmation.Copy(),
+		ProtocolSent:               stats.ProtocolSent.Copy(),
+		ProtocolReceived:           stats.ProtocolReceived.Copy(),
+		Rejected:                   stats.Rejected.Copy(),
+		Dropped:                    stats.Dropped.Copy(),
+		SmoothedRTT:                stats.SmoothedRTT.Copy(),
+		RTTVariance:                stats.RTTVariance.Copy(),
+		RTO:                        stats.RTO.Copy(),
+		ScheduleUpdateStart:        stats.ScheduleUpdateStart,
+		ScheduleUpdateEnd:          stats.ScheduleUpdateEnd,
+		Nclients:                   stats.Nclients,
+		Timeout:                    stats.Timeout,
+		Round:                      stats.Round,
+		Trigger:                    stats.Trigger,
+		Epoch:                      stats.Epoch,
+		Error:                      stats.Error,
+	}
+}
+
 func (stats *Stats) CopyTimeouts() {
-	timeouts := stats.Timeouts.IPMap
-	for k, v := range timeouts {
-		stats.TimeoutsBeforeConfirmation.IPMap[k] = v
+	timeouts := stats.Timeouts.Copy()
+	for k, v := range timeouts.IPMap {
+		stats.TimeoutsBeforeConfirmation.Set(k, v)
 	}
 }
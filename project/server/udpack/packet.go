@@ -16,7 +16,7 @@ const (
 	PacketTypeAck
 )
 
-func newAckPacket(sequenceNumber uint8) ([]byte, error) {
+func NewAckPacket(sequenceNumber uint8) ([]byte, error) {
 	header, err := newHeader(PacketTypeAck, sequenceNumber)
 	if err != nil {
 		return nil, err
@@ -24,7 +24,7 @@ func newAckPacket(sequenceNumber uint8) ([]byte, error) {
 	return []byte{byte(header)}, nil
 }
 
-func newDataPacket(sequenceNumber uint8, packet []byte) ([]byte, error) {
+func NewDataPacket(sequenceNumber uint8, packet []byte) ([]byte, error) {
 	header, err := newHeader(PacketTypeData, sequenceNumber)
 	if err != nil {
 		return nil, err
@@ -35,6 +35,17 @@ func newDataPacket(sequenceNumber uint8, packet []byte) ([]byte, error) {
 	return packetWithHeader, nil
 }
 
+// NewDataNoACKPacket prepends to `packet` the header of a data packet that
+// must not be acknowledged.
+func NewDataNoACKPacket(packet []byte) []byte {
+	header := Header(0)
+	header.encodePacketType(PacketTypeDataNoACK)
+	packetWithHeader := make([]byte, len(packet)+1)
+	packetWithHeader[0] = byte(header)
+	copy(packetWithHeader[1:], packet)
+	return packetWithHeader
+}
+
 type Header uint8
 
 func newHeader(packetType PacketType, sequenceNumber uint8) (Header, error) {
@@ -59,20 +70,18 @@ func DecodePacketType(header Header) PacketType {
 }
 
 func (header *Header) encodeSequenceNumber(sequenceNumber uint8) error {
-	const maxSequenceNumber = 0b00111111
-	if sequenceNumber > maxSequenceNumber {
+	if sequenceNumber >= SequenceNumberSpace {
 		return errors.New(fmt.Sprintf(
 			"The sequence number given %d is greater than the maximum sequence number authorized which is %d",
 			sequenceNumber,
-			maxSequenceNumber))
+			SequenceNumberSpace-1))
 	}
 	*header |= Header(sequenceNumber)
 	return nil
 }
 
-func decodeSequenceNumber(header Header) uint8 {
-	const sequenceNumberMask = 0b00111111
-	return uint8(header) & sequenceNumberMask
+func DecodeSequenceNumber(header Header) uint8 {
+	return uint8(header) & (SequenceNumberSpace - 1)
 }
 
 // RemoveHeaderFromPacket remove the header that contains a PacketType and a SequenceNumber
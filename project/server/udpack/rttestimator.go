@@ -0,0 +1,120 @@
+package udpack
+
+// RTT estimator: computes a retransmission timeout (RTO) per peer based on the
+// time needed to receive the ACKs, following the Jacobson/Karels algorithm
+// (RFC 6298). Nodes close to the border router get a short timeout while deep
+// nodes get a longer one.
+
+import (
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/stats"
+	"sync"
+	"time"
+)
+
+const (
+	rttAlpha       = 0.125 // gain of the smoothed RTT
+	rttBeta        = 0.25  // gain of the RTT variance
+	rttK           = 4     // weight of the RTT variance in the timeout
+	rttGranularity = 10 * time.Millisecond
+)
+
+type rttEstimate struct {
+	smoothedRTT time.Duration
+	rttVariance time.Duration
+	timeout     time.Duration
+	measured    bool
+}
+
+// RTTEstimator keeps a RTT estimate for each IP address. The timeouts computed
+// are bounded by `minTimeout` and `maxTimeout`, `maxTimeout` is also the timeout
+// used before the first measure. This struct is thread safe.
+type RTTEstimator struct {
+	estimates  map[addrtranslation.IPString]*rttEstimate
+	minTimeout time.Duration
+	maxTimeout time.Duration
+	lock       sync.RWMutex
+}
+
+func NewRTTEstimator(minTimeout time.Duration, maxTimeout time.Duration) RTTEstimator {
+	if minTimeout > maxTimeout {
+		minTimeout = maxTimeout
+	}
+	return RTTEstimator{
+		estimates:  make(map[addrtranslation.IPString]*rttEstimate),
+		minTimeout: minTimeout,
+		maxTimeout: maxTimeout,
+		lock:       sync.RWMutex{},
+	}
+}
+
+// Timeout returns the current retransmission timeout of `addrIP`.
+func (estimator *RTTEstimator) Timeout(addrIP addrtranslation.IPString) time.Duration {
+	estimator.lock.RLock()
+	defer estimator.lock.RUnlock()
+	if estimate, in := estimator.estimates[addrIP]; in {
+		return estimate.timeout
+	}
+	return estimator.maxTimeout
+}
+
+// Sample updates the estimate of `addrIP` with a new RTT measure. Following Karn's
+// algorithm, the caller must only sample packets that were not retransmitted.
+func (estimator *RTTEstimator) Sample(addrIP addrtranslation.IPString, rtt time.Duration) {
+	estimator.lock.Lock()
+	defer estimator.lock.Unlock()
+	estimate := estimator.estimate(addrIP)
+	if !estimate.measured {
+		estimate.smoothedRTT = rtt
+		estimate.rttVariance = rtt / 2
+		estimate.measured = true
+	} else {
+		delta := estimate.smoothedRTT - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		estimate.rttVariance = time.Duration((1-rttBeta)*float64(estimate.rttVariance) + rttBeta*float64(delta))
+		estimate.smoothedRTT = time.Duration((1-rttAlpha)*float64(estimate.smoothedRTT) + rttAlpha*float64(rtt))
+	}
+	variance := rttK * estimate.rttVariance
+	if variance < rttGranularity {
+		variance = rttGranularity
+	}
+	estimate.timeout = estimator.bound(estimate.smoothedRTT + variance)
+	estimator.record(addrIP, estimate)
+}
+
+// Backoff doubles the retransmission timeout of `addrIP` after a timeout expired.
+func (estimator *RTTEstimator) Backoff(addrIP addrtranslation.IPString) {
+	estimator.lock.Lock()
+	defer estimator.lock.Unlock()
+	estimate := estimator.estimate(addrIP)
+	estimate.timeout = estimator.bound(2 * estimate.timeout)
+	estimator.record(addrIP, estimate)
+}
+
+// estimate returns the estimate of `addrIP`, the caller must hold the lock.
+func (estimator *RTTEstimator) estimate(addrIP addrtranslation.IPString) *rttEstimate {
+	estimate, in := estimator.estimates[addrIP]
+	if !in {
+		estimate = &rttEstimate{timeout: estimator.maxTimeout}
+		estimator.estimates[addrIP] = estimate
+	}
+	return estimate
+}
+
+func (estimator *RTTEstimator) bound(timeout time.Duration) time.Duration {
+	if timeout < estimator.minTimeout {
+		return estimator.minTimeout
+	}
+	if timeout > estimator.maxTimeout {
+		return estimator.maxTimeout
+	}
+	return timeout
+}
+
+func (estimator *RTTEstimator) record(addrIP addrtranslation.IPString, estimate *rttEstimate) {
+	stats.SimulationStats.SmoothedRTT.Set(addrIP, estimate.smoothedRTT.Seconds())
+	stats.SimulationStats.RTTVariance.Set(addrIP, estimate.rttVariance.Seconds())
+	stats.SimulationStats.RTO.Set(addrIP, estimate.timeout.Seconds())
+}
@@ -0,0 +1,65 @@
+package udpack
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTTEstimatorTimeout(t *testing.T) {
+	const addrIP = "fd00::202:2:2:2"
+	tests := []struct {
+		name       string
+		minTimeout time.Duration
+		maxTimeout time.Duration
+		samples    []time.Duration
+		backoffs   int
+		expected   time.Duration
+	}{
+		{"no sample", time.Millisecond, 10 * time.Second, nil, 0, 10 * time.Second},
+		// SRTT = 100ms, RTTVAR = 50ms
+		{"first sample", time.Millisecond, 10 * time.Second, []time.Duration{100 * time.Millisecond}, 0, 300 * time.Millisecond},
+		// SRTT = 112.5ms, RTTVAR = 62.5ms
+		{"second sample", time.Millisecond, 10 * time.Second, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}, 0, 362500 * time.Microsecond},
+		// SRTT = 100ms, RTTVAR = 37.5ms
+		{"stable samples", time.Millisecond, 10 * time.Second, []time.Duration{100 * time.Millisecond, 100 * time.Millisecond}, 0, 250 * time.Millisecond},
+		// The variance is at least the clock granularity
+		{"granularity", time.Millisecond, 10 * time.Second, []time.Duration{time.Millisecond}, 0, 11 * time.Millisecond},
+		{"min timeout", 500 * time.Millisecond, 10 * time.Second, []time.Duration{100 * time.Millisecond}, 0, 500 * time.Millisecond},
+		{"max timeout", time.Millisecond, 200 * time.Millisecond, []time.Duration{100 * time.Millisecond}, 0, 200 * time.Millisecond},
+		{"min above max", 20 * time.Second, 10 * time.Second, []time.Duration{100 * time.Millisecond}, 0, 10 * time.Second},
+		{"backoff", time.Millisecond, 10 * time.Second, []time.Duration{100 * time.Millisecond}, 1, 600 * time.Millisecond},
+		{"backoffs", time.Millisecond, 10 * time.Second, []time.Duration{100 * time.Millisecond}, 3, 2400 * time.Millisecond},
+		{"backoff clamped", time.Millisecond, time.Second, []time.Duration{100 * time.Millisecond}, 3, time.Second},
+		{"backoff before sample", time.Millisecond, time.Second, nil, 1, time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			estimator := NewRTTEstimator(test.minTimeout, test.maxTimeout)
+			for _, rtt := range test.samples {
+				estimator.Sample(addrIP, rtt)
+			}
+			for i := 0; i < test.backoffs; i++ {
+				estimator.Backoff(addrIP)
+			}
+			if timeout := estimator.Timeout(addrIP); timeout != test.expected {
+				t.Errorf("got the timeout %v, expected %v", timeout, test.expected)
+			}
+			if timeout := estimator.Timeout("fd00::203:3:3:3"); timeout != estimator.maxTimeout {
+				t.Errorf("got the timeout %v for a peer without sample, expected %v", timeout, estimator.maxTimeout)
+			}
+		})
+	}
+}
+
+func TestRTTEstimatorSampleAfterBackoff(t *testing.T) {
+	const addrIP = "fd00::202:2:2:2"
+	estimator := NewRTTEstimator(time.Millisecond, 10*time.Second)
+	estimator.Sample(addrIP, 100*time.Millisecond)
+	estimator.Backoff(addrIP)
+	estimator.Backoff(addrIP)
+	// SRTT = 100ms, RTTVAR = 37.5ms: the backoff is forgotten
+	estimator.Sample(addrIP, 100*time.Millisecond)
+	if timeout := estimator.Timeout(addrIP); timeout != 250*time.Millisecond {
+		t.Errorf("got the timeout %v, expected %v", timeout, 250*time.Millisecond)
+	}
+}
@@ -0,0 +1,33 @@
+package udpack
+
+// Sequence numbers: serial number arithmetic (RFC 1982) over the 6 bits
+// sequence number space of the Header. Sequence numbers wrap around to 0 after
+// 63, therefore they must never be compared with plain `<` or `>`.
+
+// SequenceNumberSpace is the number of sequence numbers of the 6 bits field.
+const SequenceNumberSpace = 64
+
+// sequenceNumberAt returns the sequence number that comes `offset` packets
+// after `sequenceNumber`.
+func sequenceNumberAt(sequenceNumber uint8, offset int) uint8 {
+	return uint8((int(sequenceNumber) + offset) % SequenceNumberSpace)
+}
+
+// sequenceNumberDistance returns the number of packets between `from` and `to`,
+// going forward in the sequence number space.
+func sequenceNumberDistance(from uint8, to uint8) int {
+	return (int(to) - int(from) + SequenceNumberSpace) % SequenceNumberSpace
+}
+
+// sequenceNumberLess reports whether `s1` comes before `s2`. As defined by
+// RFC 1982, two sequence numbers exactly half a space apart are not comparable
+// and neither is less than the other.
+func sequenceNumberLess(s1 uint8, s2 uint8) bool {
+	distance := sequenceNumberDistance(s1, s2)
+	return distance != 0 && distance < SequenceNumberSpace/2
+}
+
+// sequenceNumberGreater reports whether `s1` comes after `s2`.
+func sequenceNumberGreater(s1 uint8, s2 uint8) bool {
+	return sequenceNumberLess(s2, s1)
+}
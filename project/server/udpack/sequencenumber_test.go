@@ -0,0 +1,97 @@
+package udpack
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSequenceNumberAtWraps(t *testing.T) {
+	tests := []struct {
+		sequenceNumber uint8
+		offset         int
+		expected       uint8
+	}{
+		{0, 1, 1},
+		{62, 1, 63},
+		{63, 1, 0},
+		{60, 10, 6},
+		{5, 64, 5},
+		{1, 300, 45},
+	}
+	for _, test := range tests {
+		if got := sequenceNumberAt(test.sequenceNumber, test.offset); got != test.expected {
+			t.Errorf("sequenceNumberAt(%d, %d) = %d, expected %d", test.sequenceNumber, test.offset, got, test.expected)
+		}
+	}
+}
+
+func TestSequenceNumberLess(t *testing.T) {
+	tests := []struct {
+		s1, s2   uint8
+		expected bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{5, 5, false},
+		{63, 0, true},
+		{0, 63, false},
+		{60, 3, true},
+		{3, 60, false},
+		{0, 31, true},
+		{31, 0, false},
+		// Half a space apart: not comparable in either direction
+		{0, 32, false},
+		{32, 0, false},
+	}
+	for _, test := range tests {
+		if got := sequenceNumberLess(test.s1, test.s2); got != test.expected {
+			t.Errorf("sequenceNumberLess(%d, %d) = %t, expected %t", test.s1, test.s2, got, test.expected)
+		}
+		if test.s1 != test.s2 && sequenceNumberDistance(test.s1, test.s2) != SequenceNumberSpace/2 {
+			if got := sequenceNumberGreater(test.s2, test.s1); got != test.expected {
+				t.Errorf("sequenceNumberGreater(%d, %d) = %t, expected %t", test.s2, test.s1, got, test.expected)
+			}
+		}
+	}
+}
+
+func TestSequenceNumbersMapWrapsAround(t *testing.T) {
+	sequenceNumbers := NewSequenceNumbersMap()
+	const addrIP = "fd00::1"
+	expected := sequenceNumbers.expected(addrIP)
+	if expected != 1 {
+		t.Fatalf("the initial sequence number should be 1, got %d", expected)
+	}
+	for i := 0; i < 500; i++ {
+		sequenceNumbers.increment(addrIP, expected)
+		next := sequenceNumbers.expected(addrIP)
+		if !sequenceNumberLess(expected, next) || sequenceNumberDistance(expected, next) != 1 {
+			t.Fatalf("after %d increments, %d should directly follow %d", i+1, next, expected)
+		}
+		expected = next
+	}
+	sequenceNumbers.advance(addrIP, 70)
+	if got := sequenceNumbers.expected(addrIP); got != sequenceNumberAt(expected, 70) {
+		t.Fatalf("advance(70) from %d gave %d, expected %d", expected, got, sequenceNumberAt(expected, 70))
+	}
+}
+
+func TestSequenceNumbersMapConcurrentAdvance(t *testing.T) {
+	sequenceNumbers := NewSequenceNumbersMap()
+	const addrIP = "fd00::1"
+	const senders, advances = 8, 100
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < advances; j++ {
+				sequenceNumbers.advance(addrIP, 3)
+			}
+		}()
+	}
+	wg.Wait()
+	if got, expected := sequenceNumbers.expected(addrIP), sequenceNumberAt(1, senders*advances*3); got != expected {
+		t.Fatalf("the concurrent advances gave %d, expected %d", got, expected)
+	}
+}
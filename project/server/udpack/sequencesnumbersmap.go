@@ -5,16 +5,17 @@ import (
 	"sync"
 )
 
-const maxSequenceNumber = 0b00111111
-
 // SequenceNumbersMap a helper struct to keep a hash map of expected sequence numbers
-// for each IP address. The maximum value (127) for a sequence number is based on the protocole.
+// for each IP address. The maximum value (63) for a sequence number is based on the protocole.
 // This struct is thread safe.
 type SequenceNumbersMap struct {
 	expectedSequenceNumbers map[addrtranslation.IPString]uint8
 	lock                    sync.RWMutex
 }
 
+// initialSequenceNumber is the first sequence number used toward a peer.
+const initialSequenceNumber = uint8(1)
+
 func NewSequenceNumbersMap() SequenceNumbersMap {
 	return SequenceNumbersMap{
 		expectedSequenceNumbers: make(map[addrtranslation.IPString]uint8),
@@ -25,7 +26,6 @@ func NewSequenceNumbersMap() SequenceNumbersMap {
 func (sequenceNumberMap *SequenceNumbersMap) initializeAddrIP(addrIP addrtranslation.IPString) uint8 {
 	sequenceNumberMap.lock.Lock()
 	defer sequenceNumberMap.lock.Unlock()
-	initialSequenceNumber := uint8(1)
 	sequenceNumberMap.expectedSequenceNumbers[addrIP] = initialSequenceNumber
 	return initialSequenceNumber
 }
@@ -33,11 +33,19 @@ func (sequenceNumberMap *SequenceNumbersMap) initializeAddrIP(addrIP addrtransla
 func (sequenceNumberMap *SequenceNumbersMap) increment(addrIP addrtranslation.IPString, currentSequenceNumber uint8) {
 	sequenceNumberMap.lock.Lock()
 	defer sequenceNumberMap.lock.Unlock()
-	if currentSequenceNumber >= maxSequenceNumber {
-		sequenceNumberMap.expectedSequenceNumbers[addrIP] = 0
-		return
+	sequenceNumberMap.expectedSequenceNumbers[addrIP] = sequenceNumberAt(currentSequenceNumber, 1)
+}
+
+// advance moves the expected sequence number of `addrIP` forward by `count`
+// sequence numbers, wrapping around the sequence number space.
+func (sequenceNumberMap *SequenceNumbersMap) advance(addrIP addrtranslation.IPString, count int) {
+	sequenceNumberMap.lock.Lock()
+	defer sequenceNumberMap.lock.Unlock()
+	expectedSequenceNumber, in := sequenceNumberMap.expectedSequenceNumbers[addrIP]
+	if !in {
+		expectedSequenceNumber = initialSequenceNumber
 	}
-	sequenceNumberMap.expectedSequenceNumbers[addrIP] += 1
+	sequenceNumberMap.expectedSequenceNumbers[addrIP] = sequenceNumberAt(expectedSequenceNumber, count)
 }
 
 func (sequenceNumberMap *SequenceNumbersMap) expected(addrIP addrtranslation.IPString) uint8 {
@@ -3,7 +3,6 @@ package udpack
 import (
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"scheduleupdater-server/addrtranslation"
 	"scheduleupdater-server/stats"
@@ -12,27 +11,36 @@ import (
 	"time"
 )
 
-// UDPAckConn handles UDP connections with ACK of packets. Only one UDP packet
-// can be in transit at the same time.
+// UDPAckConn handles UDP connections with ACK of packets. With `WriteTo` only
+// one UDP packet can be in transit at the same time, `WriteAllTo` allows up to
+// `Config.WindowSize` packets in transit toward the same peer.
 type UDPAckConn struct {
 	Config                   *UDPAckConnSendConfig
-	conn                     *net.UDPConn
+	conn                     net.PacketConn
 	receivedSequencesNumbers SequenceNumbersMap
 	sentSequencesNumbers     SequenceNumbersMap
+	rtt                      RTTEstimator
 	ackChannels              map[addrtranslation.IPString]chan []byte
 	lock                     sync.RWMutex
+	// receiveBuffers are the packets received ahead of the expected sequence
+	// number of each peer, they are only used by `Serve`
+	receiveBuffers map[addrtranslation.IPString]map[uint8][]byte
 }
 
-func NewUDPAckServer(conn *net.UDPConn, config *UDPAckConnSendConfig) *UDPAckConn {
+// NewUDPAckServer creates a UDPAckConn on top of any `net.PacketConn`: a UDP
+// socket, an in-memory network for tests or a bridge to a border router.
+func NewUDPAckServer(conn net.PacketConn, config *UDPAckConnSendConfig) *UDPAckConn {
 	if config == nil {
 		config = newDefaultUDPAckConnSendConfig()
 	}
-	fmt.Println("Timeout value: ", config.Timeout)
+	utils.Log.InfoPrintln("Timeout value: ", config.Timeout)
 	return &UDPAckConn{
 		Config:                   config,
 		conn:                     conn,
 		receivedSequencesNumbers: NewSequenceNumbersMap(),
+		receiveBuffers:           make(map[addrtranslation.IPString]map[uint8][]byte),
 		sentSequencesNumbers:     NewSequenceNumbersMap(),
+		rtt:                      NewRTTEstimator(config.MinTimeout, config.Timeout),
 		ackChannels:              make(map[addrtranslation.IPString]chan []byte),
 		lock:                     sync.RWMutex{},
 	}
@@ -44,18 +52,18 @@ func NewUDPAckServer(conn *net.UDPConn, config *UDPAckConnSendConfig) *UDPAckCon
 // and `PacketTypeAck` which corresponds to an ACK packet. The Ack packet must be
 // processed by the handler and resent the latest packet if the sequence number
 // contained in the Ack is not the sequence number expected.
-type UDPAckServerHandler = func(addr *net.UDPAddr, packet []byte)
+type UDPAckServerHandler = func(addr net.Addr, packet []byte)
 
 // Serve listen to all incoming packets, verify the sequence number and dispatch
 // the UDP packet to the handler
 func (udpAckConn *UDPAckConn) Serve(handler UDPAckServerHandler) error {
 	buffer := make([]byte, 2048)
 	for {
-		rlen, remote, err := udpAckConn.conn.ReadFromUDP(buffer[:])
+		rlen, remote, err := udpAckConn.conn.ReadFrom(buffer[:])
 		if err != nil {
 			return err
 		}
-		remoteAddrString := remote.IP.String()
+		remoteAddrString := addrtranslation.AddrToIPString(remote)
 		utils.Log.InfoPrintln("Message received from ", remoteAddrString)
 		packet := make([]byte, rlen)
 		copy(packet, buffer)
@@ -69,17 +77,17 @@ func (udpAckConn *UDPAckConn) Serve(handler UDPAckServerHandler) error {
 
 // WriteTo writes a packet to the specified addr and wait for the ACK to be received correctly.
 // This function uses the `Config` struct parameter to control the number of retries and timeout values.
-func (udpAckConn *UDPAckConn) WriteTo(packet []byte, addr *net.UDPAddr) (error, []byte) {
+func (udpAckConn *UDPAckConn) WriteTo(packet []byte, addr net.Addr) (error, []byte) {
+	return udpAckConn.writeToUntil(packet, addr, time.Time{})
+}
+
+// writeToUntil is WriteTo giving up when the ACK is not received before `deadline`.
+func (udpAckConn *UDPAckConn) writeToUntil(packet []byte, addr net.Addr, deadline time.Time) (error, []byte) {
 	addrIP := addrtranslation.AddrToIPString(addr)
-	udpAckConn.lock.Lock()
-	ackChan, in := udpAckConn.ackChannels[addrIP]
-	if !in {
-		ackChan = make(chan []byte)
-		udpAckConn.ackChannels[addrIP] = ackChan
-	}
-	udpAckConn.lock.Unlock()
+	ackChan := udpAckConn.ackChannel(addrIP)
+	drainAcks(ackChan)
 	nextSequenceNumber := udpAckConn.sentSequencesNumbers.expected(addrIP)
-	packetWithHeader, err := newDataPacket(nextSequenceNumber, packet)
+	packetWithHeader, err := NewDataPacket(nextSequenceNumber, packet)
 	if err != nil {
 		return err, nil
 	}
@@ -98,35 +106,49 @@ func (udpAckConn *UDPAckConn) WriteTo(packet []byte, addr *net.UDPAddr) (error,
 		}
 	}
 	if err != nil {
-		log.Panic("Error maximum numbre of retries exhausted panicking with error : ", err)
+		return errors.New(fmt.Sprintf("the packet could not be sent after %d retries: %v", config.MaxRetries, err)), nil
 	}
-	// Waiting for the ack to be received
-	for i := 0; i < config.MaxRetries; i++ {
+	sentAt := time.Now()
+	retransmitted := false
+	expired := deadlineExpired(deadline)
+	// Waiting for the ack to be received, the late ACKs of the previous packets
+	// do not count as retries
+	for retries := 0; retries < config.MaxRetries; {
 		utils.Log.WarningPrintln("Looping...")
 		select {
+		case <-expired:
+			return errors.New("the ACK was not received before the deadline"), nil
 		case pkt := <-ackChan:
 			stats.SimulationStats.ProtocolReceived.Increment(addrIP)
 			header, packetWithoutHeader := RemoveHeaderFromPacket(pkt)
-			sequenceNumber := decodeSequenceNumber(header)
+			sequenceNumber := DecodeSequenceNumber(header)
 			expectedSequenceNumber := udpAckConn.sentSequencesNumbers.expected(addrIP)
 			if sequenceNumber == expectedSequenceNumber {
 				utils.Log.InfoPrintln("ACK correctly received")
+				if !retransmitted {
+					udpAckConn.rtt.Sample(addrIP, time.Since(sentAt))
+				}
 				udpAckConn.sentSequencesNumbers.increment(addrIP, expectedSequenceNumber)
 				return nil, packetWithoutHeader // Client correctly received the pktToSend
-			} else if sequenceNumber < expectedSequenceNumber {
+			} else if sequenceNumberLess(sequenceNumber, expectedSequenceNumber) {
 				utils.Log.InfoPrintln("Already received this ack -> doing nothing")
 			} else {
 				utils.Log.InfoPrintln("Ack received that was not the expected Ack, resending the packet. Expected ACK: ", expectedSequenceNumber, ", got ", sequenceNumber)
 				stats.SimulationStats.ProtocolSent.Increment(addrIP)
 				stats.SimulationStats.Nsent.Increment(addrIP)
+				retransmitted = true
+				retries++
 				_, err := conn.WriteTo(packetWithHeader, addr)
 				if err != nil {
 					return err, nil
 				}
 			}
-		case <-time.After(config.Timeout):
-			utils.Log.WarningPrintln("Timeout on addr: ", addrIP, " resending pkt\n")
+		case <-time.After(udpAckConn.rtt.Timeout(addrIP)):
+			utils.Log.WarningPrintln("Timeout on addr: ", addrIP, " resending pkt")
 			stats.SimulationStats.Timeouts.Increment(addrIP)
+			udpAckConn.rtt.Backoff(addrIP)
+			retransmitted = true
+			retries++
 			_, err := conn.WriteTo(packetWithHeader, addr)
 			stats.SimulationStats.ProtocolSent.Increment(addrIP)
 			stats.SimulationStats.Nsent.Increment(addrIP)
@@ -143,56 +165,83 @@ func (udpAckConn *UDPAckConn) Close() error {
 }
 
 // handlePacket handles a packet received from `addr`. If the packet is an ACK it verified that the expected sequence number
-// is present in the packet. If the packet is a data packet it sends the ACK and gives the packet the `handler` function.
-func (udpAckConn *UDPAckConn) handlePacket(addr *net.UDPAddr, packet []byte, handler UDPAckServerHandler) error {
+// is present in the packet. The data packets are given to the `handler` function in the order of their sequence
+// numbers, each one is acknowledged when it is given to the handler.
+func (udpAckConn *UDPAckConn) handlePacket(addr net.Addr, packet []byte, handler UDPAckServerHandler) error {
 	addrIP := addrtranslation.AddrToIPString(addr)
 	stats.SimulationStats.Nreceived.Increment(addrIP)
+	if len(packet) < 1 {
+		utils.Log.WarningPrintln("Ignoring an empty packet from ", addrIP)
+		stats.SimulationStats.Rejected.Increment(addrIP, "udpack")
+		return nil
+	}
 	packetHeader, packetWithoutHeader := RemoveHeaderFromPacket(packet)
 	packetType := DecodePacketType(packetHeader)
+	if packetType > PacketTypeAck {
+		utils.Log.WarningPrintln("Ignoring a packet from ", addrIP, " with the unknown packet type ", packetType)
+		stats.SimulationStats.Rejected.Increment(addrIP, "udpack")
+		return nil
+	}
 	if packetType == PacketTypeDataNoACK {
 		handler(addr, packetWithoutHeader)
 		return nil
 	}
 
-	sequenceNumber := decodeSequenceNumber(packetHeader)
+	sequenceNumber := DecodeSequenceNumber(packetHeader)
 	if packetType == PacketTypeAck {
+		if len(packetWithoutHeader) < udpAckConn.Config.AckPayloadSize {
+			utils.Log.WarningPrintln("Ignoring a truncated ACK from ", addrIP, " with ", len(packetWithoutHeader), " bytes of payload")
+			stats.SimulationStats.Rejected.Increment(addrIP, "udpack")
+			return nil
+		}
 		udpAckConn.handleAck(addrIP, packet)
 		return nil
 	}
 	expectedSequenceNumber := udpAckConn.receivedSequencesNumbers.expected(addrIP)
-	if sequenceNumber != expectedSequenceNumber {
-		if sequenceNumber > expectedSequenceNumber && expectedSequenceNumber != 0 {
-			// Rejects the incoming packet because it doesn't contain the expected sequence
-			// number and the sequence number corresponds to a future packet. Doesn't return
-			// an error because we just need to wait for the correct package to arrive
-			utils.Log.WarningPrintln("The sequence number received is greather than the expected sequence number, therefore we do nothing and wait for the precedents packages to arrive")
+	if sequenceNumberLess(sequenceNumber, expectedSequenceNumber) {
+		utils.Log.WarningPrintln("Already received this sequence number, sending the Ack")
+		// We already received this packet, therefore we just send out the Ack to notify
+		// the Addr that we correctly received the packet
+		return udpAckConn.sendAck(addr, sequenceNumber)
+	}
+	if sequenceNumberDistance(expectedSequenceNumber, sequenceNumber) >= maxWindowSize {
+		// The packet is too far ahead to be part of the window of the peer, it
+		// is not acknowledged and the peer sends it again later
+		utils.Log.WarningPrintln("Ignoring the sequence number ", sequenceNumber, " of ", addrIP, " beyond the receive window")
+		return nil
+	}
+	// The packets ahead of the expected sequence number are kept until the
+	// missing ones arrive, they are delivered to the handler in order and
+	// acknowledged once delivered, as `udp_rx_callback` does on the motes
+	received := udpAckConn.receiveBuffers[addrIP]
+	if received == nil {
+		received = make(map[uint8][]byte)
+		udpAckConn.receiveBuffers[addrIP] = received
+	}
+	received[sequenceNumber] = packetWithoutHeader
+	for {
+		packet, in := received[expectedSequenceNumber]
+		if !in {
 			return nil
-		} else {
-			utils.Log.WarningPrintln("Already received this sequence number, sending the Ack")
-			// We already received this packet, therefore we just send out the Ack to notify
-			// the Addr that we correctly received the packet
-			return udpAckConn.sendAck(addr, sequenceNumber)
 		}
+		utils.Log.InfoPrintln("Received the expected sequence number, normal handler is called")
+		delete(received, expectedSequenceNumber)
+		if err := udpAckConn.sendAck(addr, expectedSequenceNumber); err != nil {
+			return err
+		}
+		udpAckConn.receivedSequencesNumbers.increment(addrIP, expectedSequenceNumber)
+		// Note: we could use a goroutine here to speed up the process of the packet and
+		// not block the next packets wainting to be processesd
+		handler(addr, packet)
+		expectedSequenceNumber = sequenceNumberAt(expectedSequenceNumber, 1)
 	}
-	utils.Log.InfoPrintln("Received the expected sequence number, normal handler is called. Packet Type: ", [...]string{"Data", "DataNoACK", "ACK"}[packetType])
-	// We received the packet with the expected sequence number, therefore we
-	// dispatch it to the handler and send out the Ack.
-	err := udpAckConn.sendAck(addr, sequenceNumber)
-	if err != nil {
-		return err
-	}
-	udpAckConn.receivedSequencesNumbers.increment(addrIP, sequenceNumber)
-	// Note: we could use a goroutine here to speed up the process of the packet and
-	// not block the next packets wainting to be processesd
-	handler(addr, packetWithoutHeader)
-	return nil
 }
 
-func (udpAckConn *UDPAckConn) sendAck(addr *net.UDPAddr, sequenceNumber uint8) error {
+func (udpAckConn *UDPAckConn) sendAck(addr net.Addr, sequenceNumber uint8) error {
 	addrIP := addrtranslation.AddrToIPString(addr)
 	stats.SimulationStats.Nsent.Increment(addrIP)
-	utils.Log.InfoPrintln("Sending the ACK to ", addr, " with sequence number ", sequenceNumber, "\n")
-	ackPacket, err := newAckPacket(sequenceNumber)
+	utils.Log.InfoPrintln("Sending the ACK to ", addr, " with sequence number ", sequenceNumber)
+	ackPacket, err := NewAckPacket(sequenceNumber)
 	if err != nil {
 		return err
 	}
@@ -200,8 +249,46 @@ func (udpAckConn *UDPAckConn) sendAck(addr *net.UDPAddr, sequenceNumber uint8) e
 	return err
 }
 
+// deadlineExpired returns a channel receiving when `deadline` is passed, a
+// zero deadline never expires.
+func deadlineExpired(deadline time.Time) <-chan time.Time {
+	if deadline.IsZero() {
+		return nil
+	}
+	return time.After(time.Until(deadline))
+}
+
+// drainAcks drops the ACKs left in `ackChan` by an earlier send: the late or
+// duplicated ACKs of packets already acknowledged.
+func drainAcks(ackChan chan []byte) {
+	for {
+		select {
+		case <-ackChan:
+		default:
+			return
+		}
+	}
+}
+
+// ackChannel returns the channel on which the ACKs coming from `addrIP` are
+// delivered, creating it on first use. The channel is buffered so that a full
+// window of ACKs can be queued while the sender is busy retransmitting.
+func (udpAckConn *UDPAckConn) ackChannel(addrIP addrtranslation.IPString) chan []byte {
+	udpAckConn.lock.Lock()
+	defer udpAckConn.lock.Unlock()
+	ackChan, in := udpAckConn.ackChannels[addrIP]
+	if !in {
+		ackChan = make(chan []byte, maxWindowSize)
+		udpAckConn.ackChannels[addrIP] = ackChan
+	}
+	return ackChan
+}
+
 func (udpAckConn *UDPAckConn) handleAck(addrIP addrtranslation.IPString, packet []byte) {
-	if ackChan, in := udpAckConn.ackChannels[addrIP]; in {
+	udpAckConn.lock.RLock()
+	ackChan, in := udpAckConn.ackChannels[addrIP]
+	udpAckConn.lock.RUnlock()
+	if in {
 		select {
 		case ackChan <- packet:
 			break
@@ -214,7 +301,30 @@ func (udpAckConn *UDPAckConn) handleAck(addrIP addrtranslation.IPString, packet
 type UDPAckConnSendConfig struct {
 	MaxRetries          int
 	TimesBetweenRetries time.Duration
-	Timeout             time.Duration
+	// Timeout is the retransmission timeout used toward a peer before any RTT
+	// was measured, it is also the upper bound of the adaptive timeout.
+	Timeout time.Duration
+	// MinTimeout is the lower bound of the adaptive retransmission timeout.
+	MinTimeout time.Duration
+	// WindowSize is the number of packets that can be in flight toward the same
+	// peer when using `WriteAllTo`. A value of 0 or 1 keeps the stop-and-wait
+	// behaviour. The value is capped to half of the sequence number space.
+	// The motes only buffer UDPACK_RECEIVE_WINDOW packets received out of
+	// order, the packets further ahead are sent again after a timeout.
+	WindowSize int
+	// AckPayloadSize is the minimal size of the payload of the ACKs received,
+	// the shorter ACKs are rejected. 0 accepts the ACKs without payload.
+	AckPayloadSize int
+}
+
+func (config *UDPAckConnSendConfig) windowSize() int {
+	if config.WindowSize < 1 {
+		return 1
+	}
+	if config.WindowSize > maxWindowSize {
+		return maxWindowSize
+	}
+	return config.WindowSize
 }
 
 func newDefaultUDPAckConnSendConfig() *UDPAckConnSendConfig {
@@ -222,5 +332,7 @@ func newDefaultUDPAckConnSendConfig() *UDPAckConnSendConfig {
 		MaxRetries:          100,
 		TimesBetweenRetries: 5 * time.Second,
 		Timeout:             25 * time.Second,
+		MinTimeout:          time.Second,
+		WindowSize:          1,
 	}
 }
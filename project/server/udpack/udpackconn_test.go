@@ -0,0 +1,466 @@
+package udpack
+
+import (
+	"net"
+	"os"
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/stats"
+	"scheduleupdater-server/utils"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The tests below exchange hundreds of packets between a UDPAckConn and a raw
+// UDP socket playing the role of a mote, so that the sequence numbers wrap
+// around several times.
+const exchangeCount = 300
+
+func TestMain(m *testing.M) {
+	utils.NewLogger(utils.LogLevelError, utils.WHITE)
+	os.Exit(m.Run())
+}
+
+func listenLocalUDP(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// newTestServer starts a UDPAckConn serving on the loopback interface. The
+// packets given to the handler are forwarded to the returned channel.
+func newTestServer(t *testing.T, config *UDPAckConnSendConfig) (*UDPAckConn, <-chan []byte) {
+	server := NewUDPAckServer(listenLocalUDP(t), config)
+	delivered := make(chan []byte, exchangeCount*2)
+	go func() {
+		_ = server.Serve(func(addr net.Addr, packet []byte) {
+			delivered <- packet
+		})
+	}()
+	t.Cleanup(func() { _ = server.Close() })
+	return server, delivered
+}
+
+func newTestConfig(windowSize int) *UDPAckConnSendConfig {
+	return &UDPAckConnSendConfig{
+		MaxRetries:          3,
+		TimesBetweenRetries: time.Millisecond,
+		Timeout:             5 * time.Second,
+		MinTimeout:          5 * time.Second,
+		WindowSize:          windowSize,
+	}
+}
+
+func readPacket(t *testing.T, conn *net.UDPConn) (Header, []byte, *net.UDPAddr) {
+	buffer := make([]byte, 2048)
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	n, addr, err := conn.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, packet := RemoveHeaderFromPacket(buffer[:n])
+	return header, packet, addr
+}
+
+func sendDataPacket(t *testing.T, conn *net.UDPConn, addr net.Addr, sequenceNumber uint8, payload []byte) {
+	packet, err := NewDataPacket(sequenceNumber, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo(packet, addr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectAck(t *testing.T, conn *net.UDPConn, sequenceNumber uint8) {
+	header, _, _ := readPacket(t, conn)
+	if DecodePacketType(header) != PacketTypeAck {
+		t.Fatalf("expected an ACK, got packet type %d", DecodePacketType(header))
+	}
+	if got := DecodeSequenceNumber(header); got != sequenceNumber {
+		t.Fatalf("expected the ACK of sequence number %d, got %d", sequenceNumber, got)
+	}
+}
+
+func TestReceiveThroughWrapAroundWithDuplicatesAndReordering(t *testing.T) {
+	server, delivered := newTestServer(t, newTestConfig(1))
+	client := listenLocalUDP(t)
+	defer client.Close()
+	serverAddr := server.conn.LocalAddr()
+
+	payload := func(i int) []byte { return []byte{byte(i), byte(i >> 8)} }
+	sequenceNumber := func(i int) uint8 { return sequenceNumberAt(1, i) }
+	for i := 0; i < exchangeCount; i++ {
+		reordered := i%7 == 3 && i+1 < exchangeCount
+		if reordered {
+			// Reordering: the next packet arrives first, it is kept until the
+			// packet before it arrives and acknowledged once delivered
+			sendDataPacket(t, client, serverAddr, sequenceNumber(i+1), payload(i+1))
+		}
+		sendDataPacket(t, client, serverAddr, sequenceNumber(i), payload(i))
+		expectAck(t, client, sequenceNumber(i))
+		if reordered {
+			expectAck(t, client, sequenceNumber(i+1))
+		}
+		if i%5 == 2 {
+			// Duplicate of the packet just received: acknowledged again only
+			sendDataPacket(t, client, serverAddr, sequenceNumber(i), payload(i))
+			expectAck(t, client, sequenceNumber(i))
+		}
+		if i%11 == 10 {
+			// Late duplicate of an older packet
+			sendDataPacket(t, client, serverAddr, sequenceNumber(i-5), payload(i-5))
+			expectAck(t, client, sequenceNumber(i-5))
+		}
+	}
+
+	for i := 0; i < exchangeCount; i++ {
+		select {
+		case packet := <-delivered:
+			if packet[0] != payload(i)[0] || packet[1] != payload(i)[1] {
+				t.Fatalf("packet %d delivered out of order, got %v", i, packet)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("packet %d was never delivered", i)
+		}
+	}
+	select {
+	case packet := <-delivered:
+		t.Fatalf("a duplicated or future packet was delivered: %v", packet)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWriteToThroughWrapAroundWithStaleAcks(t *testing.T) {
+	server, _ := newTestServer(t, newTestConfig(1))
+	client := listenLocalUDP(t)
+	defer client.Close()
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+
+	received := make(chan uint8, exchangeCount*2)
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			n, addr, err := client.ReadFromUDP(buffer)
+			if err != nil {
+				close(received)
+				return
+			}
+			header, _ := RemoveHeaderFromPacket(buffer[:n])
+			sequenceNumber := DecodeSequenceNumber(header)
+			received <- sequenceNumber
+			// A stale ACK of the previous packet followed by the expected ACK
+			staleAck, _ := NewAckPacket(sequenceNumberAt(sequenceNumber, SequenceNumberSpace-1))
+			_, _ = client.WriteTo(append(staleAck, 0), addr)
+			ack, _ := NewAckPacket(sequenceNumber)
+			_, _ = client.WriteTo(append(ack, sequenceNumber), addr)
+		}
+	}()
+
+	for i := 0; i < exchangeCount; i++ {
+		err, ack := server.WriteTo([]byte{byte(i)}, clientAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := sequenceNumberAt(1, i); ack[0] != expected {
+			t.Fatalf("packet %d: got the ACK payload of sequence number %d, expected %d", i, ack[0], expected)
+		}
+	}
+	_ = client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	count := 0
+	for range received {
+		count++
+	}
+	if count != exchangeCount {
+		t.Fatalf("the client received %d data packets, expected %d without any retransmission", count, exchangeCount)
+	}
+}
+
+func TestWriteAllToThroughWrapAroundWithReorderedAcks(t *testing.T) {
+	server, _ := newTestServer(t, newTestConfig(8))
+	client := listenLocalUDP(t)
+	defer client.Close()
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+
+	received := make(chan byte, exchangeCount*2)
+	go func() {
+		buffer := make([]byte, 2048)
+		var held []byte
+		var heldAddr net.Addr
+		for {
+			_ = client.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+			n, addr, err := client.ReadFromUDP(buffer)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					// Nothing more is coming for now, release the held ACK
+					if held != nil {
+						_, _ = client.WriteTo(held, heldAddr)
+						held = nil
+					}
+					continue
+				}
+				close(received)
+				return
+			}
+			header, packet := RemoveHeaderFromPacket(buffer[:n])
+			sequenceNumber := DecodeSequenceNumber(header)
+			received <- packet[0]
+			ack, _ := NewAckPacket(sequenceNumber)
+			ack = append(ack, packet[0])
+			if sequenceNumber%4 == 0 {
+				// Duplicated ACK
+				_, _ = client.WriteTo(ack, addr)
+			}
+			// Swap the ACKs two by two so that they arrive out of order
+			if held == nil {
+				held, heldAddr = ack, addr
+				continue
+			}
+			_, _ = client.WriteTo(ack, addr)
+			_, _ = client.WriteTo(held, heldAddr)
+			held = nil
+		}
+	}()
+
+	packets := make([][]byte, exchangeCount)
+	for i := range packets {
+		packets[i] = []byte{byte(i)}
+	}
+	err, acks := server.WriteAllTo(packets, clientAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ack := range acks {
+		if ack[0] != byte(i) {
+			t.Fatalf("ACK %d carries the payload of packet %d", i, ack[0])
+		}
+	}
+	if got, expected := server.sentSequencesNumbers.expected(addrtranslation.AddrToIPString(clientAddr)), sequenceNumberAt(1, exchangeCount); got != expected {
+		t.Fatalf("the next sequence number is %d, expected %d", got, expected)
+	}
+	_ = client.Close()
+	count := 0
+	for range received {
+		count++
+	}
+	if count != exchangeCount {
+		t.Fatalf("the client received %d data packets, expected %d without any retransmission", count, exchangeCount)
+	}
+}
+
+func TestReceiveIgnoresPacketsBeyondTheWindow(t *testing.T) {
+	server, delivered := newTestServer(t, newTestConfig(1))
+	client := listenLocalUDP(t)
+	defer client.Close()
+	serverAddr := server.conn.LocalAddr()
+
+	// The packet a whole window ahead is neither acknowledged nor delivered
+	sendDataPacket(t, client, serverAddr, sequenceNumberAt(1, maxWindowSize), []byte{2})
+	sendDataPacket(t, client, serverAddr, 1, []byte{1})
+	expectAck(t, client, 1)
+	select {
+	case packet := <-delivered:
+		if packet[0] != 1 {
+			t.Fatalf("got the packet %d, expected 1", packet[0])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the expected packet was never delivered")
+	}
+	select {
+	case packet := <-delivered:
+		t.Fatalf("the packet beyond the window was delivered: %v", packet)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWriteToIgnoresTheAcksOfEarlierPackets(t *testing.T) {
+	config := newTestConfig(1)
+	config.MaxRetries = 1
+	server, _ := newTestServer(t, config)
+	client := listenLocalUDP(t)
+	defer client.Close()
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+
+	received := make(chan uint8, exchangeCount*2)
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			n, addr, err := client.ReadFromUDP(buffer)
+			if err != nil {
+				close(received)
+				return
+			}
+			header, _ := RemoveHeaderFromPacket(buffer[:n])
+			sequenceNumber := DecodeSequenceNumber(header)
+			received <- sequenceNumber
+			// Every ACK is duplicated, the copy reaches the server after the
+			// packet was acknowledged
+			ack, _ := NewAckPacket(sequenceNumber)
+			_, _ = client.WriteTo(append(ack, sequenceNumber), addr)
+			_, _ = client.WriteTo(append(ack, sequenceNumber), addr)
+		}
+	}()
+
+	for i := 0; i < exchangeCount; i++ {
+		if i%10 == 5 {
+			// The ACKs left by the previous calls fill the ACK channel
+			ackChan := server.ackChannel(addrtranslation.AddrToIPString(clientAddr))
+			for j := 1; j <= cap(ackChan); j++ {
+				ack, _ := NewAckPacket(sequenceNumberAt(1, i-j))
+				select {
+				case ackChan <- ack:
+				default:
+				}
+			}
+		}
+		err, ack := server.WriteTo([]byte{byte(i)}, clientAddr)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if expected := sequenceNumberAt(1, i); ack[0] != expected {
+			t.Fatalf("packet %d: got the ACK payload of sequence number %d, expected %d", i, ack[0], expected)
+		}
+	}
+	_ = client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	count := 0
+	for range received {
+		count++
+	}
+	if count != exchangeCount {
+		t.Fatalf("the client received %d data packets, expected %d without any retransmission", count, exchangeCount)
+	}
+}
+
+func TestWriteAllToBacksOffOncePerLossEvent(t *testing.T) {
+	config := newTestConfig(8)
+	config.MinTimeout = time.Millisecond
+	server, _ := newTestServer(t, config)
+	client := listenLocalUDP(t)
+	defer client.Close()
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	addrIP := addrtranslation.AddrToIPString(clientAddr)
+
+	// The first packet of the window is acknowledged late so that the packet 8
+	// is sent after the other ones. The packets 1 and 8 are lost and expire
+	// one after the other, while the retransmission of the packet 1 is still
+	// waiting for its ACK.
+	firstOfWindow := sequenceNumberAt(1, 1)
+	var lossEvent int32
+	go func() {
+		buffer := make([]byte, 2048)
+		seen := make(map[int]bool)
+		for {
+			n, addr, err := client.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			header, _ := RemoveHeaderFromPacket(buffer[:n])
+			sequenceNumber := DecodeSequenceNumber(header)
+			if atomic.LoadInt32(&lossEvent) == 1 {
+				index := sequenceNumberDistance(firstOfWindow, sequenceNumber)
+				retransmitted := seen[index]
+				seen[index] = true
+				switch {
+				case index == 0:
+					time.Sleep(5 * time.Millisecond)
+				case (index == 1 || index == 8) && !retransmitted:
+					continue
+				case index == 1:
+					time.Sleep(12 * time.Millisecond)
+				}
+			}
+			ack, _ := NewAckPacket(sequenceNumber)
+			_, _ = client.WriteTo(ack, addr)
+		}
+	}()
+
+	// A first packet measures the RTT
+	if err, _ := server.WriteTo([]byte{0}, clientAddr); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&lossEvent, 1)
+	packets := make([][]byte, 9)
+	for i := range packets {
+		packets[i] = []byte{byte(i)}
+	}
+	if err, _ := server.WriteAllTo(packets, clientAddr); err != nil {
+		t.Fatal(err)
+	}
+	// Only the packets that were not retransmitted are sampled, the timeout is
+	// the one of the RTT estimate backed off once
+	server.rtt.lock.RLock()
+	estimate := *server.rtt.estimates[addrIP]
+	server.rtt.lock.RUnlock()
+	variance := rttK * estimate.rttVariance
+	if variance < rttGranularity {
+		variance = rttGranularity
+	}
+	expected := server.rtt.bound(2 * server.rtt.bound(estimate.smoothedRTT+variance))
+	if estimate.timeout != expected {
+		t.Errorf("got the timeout %v after the loss event, expected %v", estimate.timeout, expected)
+	}
+}
+
+func TestMalformedPacketsAreRejected(t *testing.T) {
+	config := newTestConfig(1)
+	config.AckPayloadSize = 2
+	server := NewUDPAckServer(listenLocalUDP(t), config)
+	defer server.Close()
+	unknownType := Header(0)
+	unknownType.encodePacketType(PacketTypeAck + 1)
+	truncatedAck, _ := NewAckPacket(1)
+
+	tests := []struct {
+		name   string
+		addr   *net.UDPAddr
+		packet []byte
+	}{
+		{"zero-length packet", &net.UDPAddr{IP: net.ParseIP("fd00::a1"), Port: 8765}, []byte{}},
+		{"unknown packet type", &net.UDPAddr{IP: net.ParseIP("fd00::a2"), Port: 8765}, []byte{byte(unknownType), 1}},
+		{"truncated ACK", &net.UDPAddr{IP: net.ParseIP("fd00::a3"), Port: 8765}, append(truncatedAck, 1)},
+	}
+	for _, test := range tests {
+		addrIP := addrtranslation.AddrToIPString(test.addr)
+		ackChan := server.ackChannel(addrIP)
+		err := server.handlePacket(test.addr, test.packet, func(addr net.Addr, packet []byte) {
+			t.Errorf("%s: the handler was called with %v", test.name, packet)
+		})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if rejected := stats.SimulationStats.Rejected.Copy().IPMap[addrIP]["udpack"]; rejected != 1 {
+			t.Errorf("%s: expected 1 rejected packet, got %d", test.name, rejected)
+		}
+		select {
+		case ack := <-ackChan:
+			t.Errorf("%s: the packet was forwarded as an ACK: %v", test.name, ack)
+		default:
+		}
+	}
+
+	// An ACK with the whole payload is still forwarded
+	addr := &net.UDPAddr{IP: net.ParseIP("fd00::a4"), Port: 8765}
+	ackChan := server.ackChannel(addrtranslation.AddrToIPString(addr))
+	if err := server.handlePacket(addr, append(truncatedAck, 1, 2), nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ackChan:
+	default:
+		t.Fatal("the complete ACK was not forwarded")
+	}
+}
+
+func TestWriteToReturnsAnErrorWhenTheSocketFails(t *testing.T) {
+	conn := listenLocalUDP(t)
+	server := NewUDPAckServer(conn, newTestConfig(1))
+	_ = conn.Close()
+	err, _ := server.WriteTo([]byte{1}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8765})
+	if err == nil {
+		t.Fatal("WriteTo succeeded on a closed socket")
+	}
+}
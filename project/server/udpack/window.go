@@ -0,0 +1,159 @@
+package udpack
+
+// Window: selective-repeat sending of several packets toward the same peer.
+// Up to `Config.WindowSize` sequence numbers are outstanding at the same time,
+// each ACK is tracked individually and only the packets whose ACK is missing
+// are retransmitted when their timeout expires.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/stats"
+	"scheduleupdater-server/utils"
+	"time"
+)
+
+// maxWindowSize is the largest window usable with selective repeat. The window
+// must not exceed half of the sequence number space, otherwise the receiver
+// cannot tell a retransmission from a new packet once the sequence numbers wrap.
+const maxWindowSize = SequenceNumberSpace / 2
+
+// inFlightPacket is a packet sent but not acknowledged yet.
+type inFlightPacket struct {
+	packetWithHeader []byte
+	sentAt           time.Time
+	deadline         time.Time
+	retries          int
+}
+
+// WriteAllTo writes all the `packets` to the specified addr and waits for all
+// of them to be acknowledged. Up to `Config.WindowSize` packets are kept in
+// flight and only the packets that were not acknowledged are retransmitted.
+// The ACK payloads are returned in the same order as the packets.
+func (udpAckConn *UDPAckConn) WriteAllTo(packets [][]byte, addr net.Addr) (error, [][]byte) {
+	return udpAckConn.WriteAllToUntil(packets, addr, time.Time{})
+}
+
+// WriteAllToUntil is WriteAllTo giving up when the packets are not all
+// acknowledged before `deadline`, a zero deadline never expires.
+func (udpAckConn *UDPAckConn) WriteAllToUntil(packets [][]byte, addr net.Addr, deadline time.Time) (error, [][]byte) {
+	config := udpAckConn.Config
+	window := config.windowSize()
+	if window == 1 {
+		return udpAckConn.writeAllToStopAndWait(packets, addr, deadline)
+	}
+
+	addrIP := addrtranslation.AddrToIPString(addr)
+	ackChan := udpAckConn.ackChannel(addrIP)
+	drainAcks(ackChan)
+	firstSequenceNumber := udpAckConn.sentSequencesNumbers.expected(addrIP)
+	acks := make([][]byte, len(packets))
+	acked := make([]bool, len(packets))
+	inFlight := make(map[int]*inFlightPacket)
+	base := 0 // index of the oldest packet not acknowledged
+	next := 0 // index of the next packet to send for the first time
+	expired := deadlineExpired(deadline)
+	utils.Log.InfoPrintln("Sending ", len(packets), " packets to ", addrIP, " with a window of ", window)
+
+	send := func(packet *inFlightPacket) error {
+		stats.SimulationStats.ProtocolSent.Increment(addrIP)
+		stats.SimulationStats.Nsent.Increment(addrIP)
+		packet.sentAt = time.Now()
+		packet.deadline = packet.sentAt.Add(udpAckConn.rtt.Timeout(addrIP))
+		_, err := udpAckConn.conn.WriteTo(packet.packetWithHeader, addr)
+		return err
+	}
+
+	for base < len(packets) {
+		// Fill the window with packets never sent before
+		for next < len(packets) && next-base < window {
+			packetWithHeader, err := NewDataPacket(sequenceNumberAt(firstSequenceNumber, next), packets[next])
+			if err != nil {
+				return err, nil
+			}
+			packet := &inFlightPacket{packetWithHeader: packetWithHeader}
+			inFlight[next] = packet
+			if err := send(packet); err != nil {
+				return err, nil
+			}
+			next++
+		}
+
+		timer := time.NewTimer(time.Until(earliestDeadline(inFlight)))
+		select {
+		case <-expired:
+			timer.Stop()
+			return errors.New(fmt.Sprintf("%d packets were not acknowledged before the deadline", len(packets)-base)), nil
+		case pkt := <-ackChan:
+			timer.Stop()
+			stats.SimulationStats.ProtocolReceived.Increment(addrIP)
+			header, packetWithoutHeader := RemoveHeaderFromPacket(pkt)
+			sequenceNumber := DecodeSequenceNumber(header)
+			index := base + sequenceNumberDistance(sequenceNumberAt(firstSequenceNumber, base), sequenceNumber)
+			if index >= next || acked[index] {
+				utils.Log.InfoPrintln("Already received this ack or ack outside of the window -> doing nothing")
+				break
+			}
+			if inFlight[index].retries == 0 {
+				udpAckConn.rtt.Sample(addrIP, time.Since(inFlight[index].sentAt))
+			}
+			acked[index] = true
+			acks[index] = packetWithoutHeader
+			delete(inFlight, index)
+		case <-timer.C:
+			now := time.Now()
+			// The packets of the window expire one after the other after a
+			// single loss event, the timeout is only backed off when the
+			// oldest packet expires
+			if oldest, in := inFlight[base]; in && !now.Before(oldest.deadline) {
+				udpAckConn.rtt.Backoff(addrIP)
+			}
+			for index, packet := range inFlight {
+				if now.Before(packet.deadline) {
+					continue
+				}
+				packet.retries++
+				if packet.retries > config.MaxRetries {
+					return errors.New(fmt.Sprintf("the ACK of the packet %d was not received", index)), nil
+				}
+				utils.Log.WarningPrintln("Timeout on addr: ", addrIP, " resending pkt ", index)
+				stats.SimulationStats.Timeouts.Increment(addrIP)
+				if err := send(packet); err != nil {
+					return err, nil
+				}
+			}
+		}
+
+		for base < next && acked[base] {
+			base++
+		}
+	}
+	udpAckConn.sentSequencesNumbers.advance(addrIP, len(packets))
+	return nil, acks
+}
+
+// writeAllToStopAndWait sends the packets one after the other with `WriteTo`.
+func (udpAckConn *UDPAckConn) writeAllToStopAndWait(packets [][]byte, addr net.Addr, deadline time.Time) (error, [][]byte) {
+	acks := make([][]byte, 0, len(packets))
+	for i, packet := range packets {
+		utils.Log.Println("Sending to client: ", addrtranslation.AddrToIPString(addr), ", packet ", i, " / ", len(packets))
+		err, ack := udpAckConn.writeToUntil(packet, addr, deadline)
+		if err != nil {
+			return err, nil
+		}
+		acks = append(acks, ack)
+	}
+	return nil, acks
+}
+
+func earliestDeadline(inFlight map[int]*inFlightPacket) time.Time {
+	earliest := time.Time{}
+	for _, packet := range inFlight {
+		if earliest.IsZero() || packet.deadline.Before(earliest) {
+			earliest = packet.deadline
+		}
+	}
+	return earliest
+}
@@ -0,0 +1,165 @@
+package main
+
+// Validate subcommand: checks the schedule of a network snapshot without
+// running a simulation. The snapshot is a JSON file describing the nodes as
+// the applications would have gathered them, and optionally a schedule. When
+// the schedule is missing, it is computed with the selected scheduler. The
+// geometry of the slotframe is the one given on the command line, unless the
+// snapshot contains both a schedule and its geometry.
+//
+// {
+//   "nodes": [
+//     {"ip": "fd00::202:2:2:2", "mac": "00:02:00:02:00:02:00:02", "parent": "fd00::201:1:1:1",
+//      "bandwidth": 2, "neighbors": ["00:01:00:01:00:01:00:01"]}
+//   ],
+//   "geometry": {"handle": 1, "length": 21, "firstChannel": 1, "lastChannel": 3},
+//   "schedule": {
+//     "fd00::202:2:2:2": {"00:01:00:01:00:01:00:01": [{"linkOptions": 1, "timeslot": 1, "channel": 1}]}
+//   }
+// }
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"scheduleupdater-server/addrtranslation"
+	"scheduleupdater-server/applications"
+	"scheduleupdater-server/scheduler"
+	"scheduleupdater-server/scheduleupdater"
+)
+
+type snapshotNode struct {
+	IP        addrtranslation.IPString `json:"ip"`
+	Mac       string                   `json:"mac"`
+	Parent    addrtranslation.IPString `json:"parent"`
+	Bandwidth uint                     `json:"bandwidth"`
+	Neighbors []string                 `json:"neighbors"`
+}
+
+type snapshotCell struct {
+	LinkOptions scheduleupdater.LinkOptions `json:"linkOptions"`
+	TimeSlot    uint16                      `json:"timeslot"`
+	Channel     uint16                      `json:"channel"`
+}
+
+type snapshotGeometry struct {
+	Handle       uint16 `json:"handle"`
+	Length       uint16 `json:"length"`
+	FirstChannel uint16 `json:"firstChannel"`
+	LastChannel  uint16 `json:"lastChannel"`
+}
+
+type snapshot struct {
+	Geometry *snapshotGeometry                                      `json:"geometry"`
+	Nodes    []snapshotNode                                         `json:"nodes"`
+	Schedule map[addrtranslation.IPString]map[string][]snapshotCell `json:"schedule"`
+}
+
+// runValidate validates the schedule of the snapshot `path` and returns the
+// number of problems found.
+func runValidate(path string, networkScheduler scheduler.Scheduler, geometry scheduleupdater.SlotframeGeometry, config scheduleupdater.ValidationConfig) (int, error) {
+	diagnostics, err := validateSnapshot(path, networkScheduler, geometry, config)
+	if err != nil {
+		return 0, err
+	}
+	for _, diagnostic := range diagnostics {
+		fmt.Println(diagnostic)
+	}
+	fmt.Printf("%d problem(s) found\n", len(diagnostics))
+	return len(diagnostics), nil
+}
+
+// validateSnapshot returns the problems found in the schedule of the snapshot
+// `path` for motes with the limits of `config`.
+func validateSnapshot(path string, networkScheduler scheduler.Scheduler, geometry scheduleupdater.SlotframeGeometry, config scheduleupdater.ValidationConfig) ([]scheduleupdater.Diagnostic, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var network snapshot
+	if err := json.NewDecoder(file).Decode(&network); err != nil {
+		return nil, errors.New(fmt.Sprintf("could not decode the snapshot %s: %v", path, err))
+	}
+
+	graph, bandwidthMap, topology, err := network.applications()
+	if err != nil {
+		return nil, err
+	}
+	var schedule scheduleupdater.Schedule
+	if network.Schedule == nil {
+		schedule, err = networkScheduler.Schedule(&graph, &bandwidthMap, topology)
+	} else {
+		if network.Geometry != nil {
+			geometry = scheduleupdater.SlotframeGeometry(*network.Geometry)
+		}
+		schedule, err = network.schedule(geometry)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scheduleupdater.ValidateWithConfig(schedule, &graph, topology, config), nil
+}
+
+// applications returns the information the applications would have gathered
+// from the nodes of the snapshot.
+func (network *snapshot) applications() (applications.RPLGraph, applications.BandwidthMap, *applications.Topology, error) {
+	graph := make(applications.RPLGraph)
+	bandwidthMap := make(applications.BandwidthMap)
+	topology := applications.NewTopology()
+	for _, node := range network.Nodes {
+		mac, err := parseMac(node.Mac)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		neighbors := make([]*addrtranslation.MacAddr, 0, len(node.Neighbors))
+		for _, rawNeighbor := range node.Neighbors {
+			neighbor, err := parseMac(rawNeighbor)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			neighbors = append(neighbors, neighbor)
+		}
+		topology.SetNeighbors(node.IP, &applications.TopologyPacket{MoteAddr: mac, Neighbors: neighbors})
+		bandwidthMap[node.IP] = node.Bandwidth
+		if node.Parent != "" {
+			graph[node.IP] = &applications.RPLLink{ParentIP: node.Parent}
+		}
+	}
+	return graph, bandwidthMap, &topology, nil
+}
+
+func (network *snapshot) schedule(geometry scheduleupdater.SlotframeGeometry) (scheduleupdater.Schedule, error) {
+	schedule := scheduleupdater.NewSchedule(geometry)
+	for node, neighbors := range network.Schedule {
+		for rawNeighbor, cells := range neighbors {
+			neighbor, err := parseMac(rawNeighbor)
+			if err != nil {
+				return scheduleupdater.Schedule{}, err
+			}
+			for _, cell := range cells {
+				schedule.AddCell(node, *neighbor, &scheduleupdater.Cell{
+					LinkOptions: cell.LinkOptions,
+					TimeSlot:    cell.TimeSlot,
+					Channel:     cell.Channel,
+				})
+			}
+		}
+	}
+	return schedule, nil
+}
+
+func parseMac(raw string) (*addrtranslation.MacAddr, error) {
+	hardwareAddr, err := net.ParseMAC(raw)
+	if err != nil {
+		return nil, err
+	}
+	var mac addrtranslation.MacAddr
+	if len(hardwareAddr) != len(mac) {
+		return nil, errors.New(fmt.Sprintf("%s is not a 8 bytes link layer address", raw))
+	}
+	copy(mac[:], hardwareAddr)
+	return &mac, nil
+}
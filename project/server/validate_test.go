@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"scheduleupdater-server/scheduler"
+	"scheduleupdater-server/scheduleupdater"
+	"scheduleupdater-server/utils"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	utils.NewLogger(utils.LogLevelError, utils.WHITE)
+	os.Exit(m.Run())
+}
+
+// Each snapshot of testdata/validate holds a valid schedule of a line of three
+// motes with one mistake, named after the diagnostic it causes.
+func TestValidateDiagnostics(t *testing.T) {
+	kinds := []scheduleupdater.DiagnosticKind{
+		scheduleupdater.DiagnosticUnpairedCell,
+		scheduleupdater.DiagnosticHalfDuplex,
+		scheduleupdater.DiagnosticDuplicateCell,
+		scheduleupdater.DiagnosticChannelOutOfRange,
+		scheduleupdater.DiagnosticTimeslotOutOfRange,
+		scheduleupdater.DiagnosticNotNeighbor,
+		scheduleupdater.DiagnosticTooManyCells,
+		scheduleupdater.DiagnosticGeometryOutOfRange,
+	}
+	geometry := scheduleupdater.NewDefaultSlotframeGeometry()
+	for _, kind := range kinds {
+		t.Run(kind.String(), func(t *testing.T) {
+			diagnostics := validateFixture(t, kind.String(), geometry, scheduleupdater.NewDefaultValidationConfig())
+			if len(diagnostics) == 0 {
+				t.Fatal("no problem found")
+			}
+			for _, diagnostic := range diagnostics {
+				if diagnostic.Kind != kind {
+					t.Error("unexpected problem:", diagnostic)
+				}
+			}
+		})
+	}
+	if diagnostics := validateFixture(t, "valid", geometry, scheduleupdater.NewDefaultValidationConfig()); len(diagnostics) != 0 {
+		t.Error("problems found in a valid schedule:", diagnostics)
+	}
+}
+
+// The channel offsets of the geometry must be in the hopping sequence of the
+// motes, which is not extended to fit the geometry.
+func TestValidateGeometryChannels(t *testing.T) {
+	geometry := scheduleupdater.NewDefaultSlotframeGeometry()
+	geometry.LastChannel = 7
+	config := scheduleupdater.NewDefaultValidationConfig()
+	diagnostics := validateFixture(t, "wide-channels", geometry, config)
+	if len(diagnostics) == 0 || diagnostics[0].Kind != scheduleupdater.DiagnosticGeometryOutOfRange {
+		t.Fatal("expected the geometry out of the hopping sequence, got", diagnostics)
+	}
+	for _, diagnostic := range diagnostics[1:] {
+		if diagnostic.Kind != scheduleupdater.DiagnosticChannelOutOfRange {
+			t.Error("unexpected problem:", diagnostic)
+		}
+	}
+
+	config.HoppingSequenceLength = 8
+	if diagnostics := validateFixture(t, "wide-channels", geometry, config); len(diagnostics) != 0 {
+		t.Error("problems found with the channel offsets 1 to 7 and 8 channels:", diagnostics)
+	}
+	diagnostics = validateFixture(t, "wide-channels", scheduleupdater.NewDefaultSlotframeGeometry(), config)
+	if len(diagnostics) == 0 || diagnostics[0].Kind != scheduleupdater.DiagnosticChannelOutOfRange {
+		t.Error("expected channels out of range with the default geometry, got", diagnostics)
+	}
+}
+
+func validateFixture(t *testing.T, name string, geometry scheduleupdater.SlotframeGeometry, config scheduleupdater.ValidationConfig) []scheduleupdater.Diagnostic {
+	networkScheduler, err := scheduler.New("greedy", geometry, scheduler.Interference{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diagnostics, err := validateSnapshot(filepath.Join("testdata", "validate", name+".json"), networkScheduler, geometry, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return diagnostics
+}